@@ -6,11 +6,14 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/apex/log"
 	"github.com/apex/log/handlers/cli"
 	"github.com/m-lab/go/rtx"
+	"github.com/ooni/netx/modelx"
+	"github.com/ooni/netx/x/har"
 	"github.com/ooni/netx/x/logger"
 	"github.com/ooni/netx/x/porcelain"
 )
@@ -19,6 +22,7 @@ func main() {
 	var (
 		flagDNSAddress   = flag.String("httpdo-dns-address", "", "Transport dependent address")
 		flagDNSTransport = flag.String("httpdo-dns-transport", "system", "DNS transport")
+		flagHAR          = flag.String("httpdo-har", "", "Write a HAR file at the given path")
 		flagMethod       = flag.String("httpdo-method", "GET", "Method to use")
 		flagNoVerify     = flag.Bool("httpdo-no-verify", false, "Skip TLS verification")
 		flagTimeout      = flag.Duration("httpdo-timeout", 60*time.Second, "Overall timeout")
@@ -31,15 +35,40 @@ func main() {
 		context.Background(), *flagTimeout,
 	)
 	defer cancel()
+	beginning := time.Now()
+	var handler modelx.Handler = logger.NewHandler(log.Log)
+	var harHandler *har.Handler
+	if *flagHAR != "" {
+		harHandler = har.NewHandler(beginning)
+		handler = &multiHandler{handlers: []modelx.Handler{handler, harHandler}}
+	}
 	results := porcelain.HTTPDo(ctx, porcelain.HTTPDoConfig{
+		Beginning:          beginning,
 		DNSServerAddress:   *flagDNSAddress,
 		DNSServerNetwork:   *flagDNSTransport,
 		Method:             *flagMethod,
-		Handler:            logger.NewHandler(log.Log),
+		Handler:            handler,
 		InsecureSkipVerify: *flagNoVerify,
 		URL:                *flagURL,
 	})
 	data, err := json.MarshalIndent(results, "", "  ")
 	rtx.Must(err, "json.Marshal failed")
 	fmt.Printf("%s\n", string(data))
+	if harHandler != nil {
+		filep, err := os.Create(*flagHAR)
+		rtx.Must(err, "os.Create failed")
+		rtx.Must(harHandler.Write(filep), "harHandler.Write failed")
+		rtx.Must(filep.Close(), "filep.Close failed")
+	}
+}
+
+// multiHandler forwards each event to all the handlers.
+type multiHandler struct {
+	handlers []modelx.Handler
+}
+
+func (h *multiHandler) OnMeasurement(m modelx.Measurement) {
+	for _, handler := range h.handlers {
+		handler.OnMeasurement(m)
+	}
 }
@@ -4,6 +4,11 @@
 package httpx
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"time"
@@ -50,7 +55,10 @@ func NewTransport(beginning time.Time, handler modelx.Handler) *Transport {
 }
 
 // RoundTrip executes a single HTTP transaction, returning
-// a Response for the provided Request.
+// a Response for the provided Request. Our dialer performs the TLS
+// handshakes, except when using a proxy, where net/http performs them
+// and hence we cannot see the raw HTTP/1.x headers and the plaintext
+// passed to the modelx.MeasurementRoot PlaintextHook.
 func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	return t.transport.RoundTrip(req)
 }
@@ -78,6 +86,20 @@ func (t *Transport) SetCABundle(path string) error {
 	return t.dialer.SetCABundle(path)
 }
 
+// SetCABundleFromPEM internally calls netx.Dialer.SetCABundleFromPEM and
+// therefore it has the same caveats and limitations.
+func (t *Transport) SetCABundleFromPEM(
+	data []byte, appendToSystemRoots bool,
+) (int, error) {
+	return t.dialer.SetCABundleFromPEM(data, appendToSystemRoots)
+}
+
+// SetCAPool internally calls netx.Dialer.SetCAPool and
+// therefore it has the same caveats and limitations.
+func (t *Transport) SetCAPool(pool *x509.CertPool) error {
+	return t.dialer.SetCAPool(pool)
+}
+
 // ForceSpecificSNI forces using a specific SNI.
 func (t *Transport) ForceSpecificSNI(sni string) error {
 	return t.dialer.ForceSpecificSNI(sni)
@@ -88,6 +110,184 @@ func (t *Transport) ForceSkipVerify() error {
 	return t.dialer.ForceSkipVerify()
 }
 
+// SetTLSVersions internally calls netx.Dialer.SetTLSVersions and
+// therefore it has the same caveats and limitations.
+func (t *Transport) SetTLSVersions(min, max uint16) error {
+	return t.dialer.SetTLSVersions(min, max)
+}
+
+// SetCipherSuites internally calls netx.Dialer.SetCipherSuites and
+// therefore it has the same caveats and limitations.
+func (t *Transport) SetCipherSuites(suites []uint16) error {
+	return t.dialer.SetCipherSuites(suites)
+}
+
+// SetALPN internally calls netx.Dialer.SetALPN and
+// therefore it has the same caveats and limitations.
+func (t *Transport) SetALPN(protos []string) error {
+	return t.dialer.SetALPN(protos)
+}
+
+// SetCurvePreferences internally calls netx.Dialer.SetCurvePreferences and
+// therefore it has the same caveats and limitations.
+func (t *Transport) SetCurvePreferences(curves []tls.CurveID) error {
+	return t.dialer.SetCurvePreferences(curves)
+}
+
+// ForceDisableSessionTickets internally calls netx.Dialer.ForceDisableSessionTickets and
+// therefore it has the same caveats and limitations.
+func (t *Transport) ForceDisableSessionTickets() error {
+	return t.dialer.ForceDisableSessionTickets()
+}
+
+// EnableSessionResumption internally calls netx.Dialer.EnableSessionResumption and
+// therefore it has the same caveats and limitations.
+func (t *Transport) EnableSessionResumption(capacity int) error {
+	return t.dialer.EnableSessionResumption(capacity)
+}
+
+// SetKeyLogWriter internally calls netx.Dialer.SetKeyLogWriter and
+// therefore it has the same caveats and limitations.
+func (t *Transport) SetKeyLogWriter(w io.Writer) error {
+	return t.dialer.SetKeyLogWriter(w)
+}
+
+// EnableKeyLogEvents internally calls netx.Dialer.EnableKeyLogEvents
+// and therefore it has the same caveats and limitations.
+func (t *Transport) EnableKeyLogEvents() error {
+	return t.transport.EnableKeyLogEvents()
+}
+
+// EnableHTTP2FrameEvents enables emitting an HTTP2Frame event for each
+// HTTP/2 frame sent or received by connections created from now on.
+// Events referring to a stream have the TransactionID of the transaction
+// using such stream, while events referring to the whole connection use
+// the measurement root of the most recent transaction using it.
+func (t *Transport) EnableHTTP2FrameEvents() error {
+	return t.transport.EnableHTTP2FrameEvents()
+}
+
+// SetClientHelloFingerprint is like netx.Dialer.SetClientHelloFingerprint
+// with the following differences. When parroting, we offer the ALPN of
+// the browser, hence we speak HTTP/2 when the server negotiates h2, and
+// TLS handshakes occurring when using a proxy still use crypto/tls.
+func (t *Transport) SetClientHelloFingerprint(name string) error {
+	return t.transport.SetClientHelloFingerprint(name)
+}
+
+// ForceHTTP3 forces using HTTP/3 over QUIC for all https requests. The
+// QUIC handshake honours the dialer's TLS settings, except that the ALPN
+// is always "h3". Requests using HTTP/3 do not use any configured proxy
+// and we do not fall back to TCP when HTTP/3 fails. You will see QUIC
+// handshake events and UDP datagram events (ReadFrom, WriteTo) along
+// with the usual HTTP events, but not the HTTPConnectionReady event.
+func (t *Transport) ForceHTTP3() error {
+	return t.transport.ForceHTTP3()
+}
+
+// EnableHTTP3AltSvc is like ForceHTTP3 except that we use HTTP/3 for
+// an origin only after it has advertised HTTP/3 support using the
+// Alt-Svc header in a response received over TCP. When an HTTP/3 round
+// trip fails, we forget the advertisement and return the error, so
+// that the next request for such origin will use TCP again.
+func (t *Transport) EnableHTTP3AltSvc() error {
+	return t.transport.EnableHTTP3AltSvc()
+}
+
+// EnableBodyStats configures the transport to compute statistics about
+// each response body while it is being read, rather than emitting an
+// HTTPResponseBodyPart event for each read. The statistics are in the
+// HTTPResponseDone event and include the SHA-256 and the size of the
+// body, the time to first byte, and samples of the download progress
+// taken every interval, which allow to measure throttling. Note that
+// we also count the bytes read to save the snapshot of the body that
+// is in the HTTPRoundTripDone event. The interval must be positive.
+func (t *Transport) EnableBodyStats(interval time.Duration) error {
+	return t.transport.EnableBodyStats(interval)
+}
+
+// EnableDecompression enables transparent decompression of the response
+// bodies using the gzip, deflate, and br content encodings. Unless the
+// request already contains an Accept-Encoding header, we send one saying
+// that we accept such encodings. We decompress regardless of who set
+// the Accept-Encoding header and, like net/http, we remove the headers
+// Content-Encoding and Content-Length from the response we return to
+// the caller. The HTTPRoundTripDone event still contains the
+// original headers and the body snapshot as received from the wire, as
+// well as a snapshot of the decompressed body. The body statistics refer
+// to the wire, while HTTPResponseBodyPart events contain decoded data.
+func (t *Transport) EnableDecompression() error {
+	return t.transport.EnableDecompression()
+}
+
+// SetMaxConnsPerHost sets the maximum number of connections per host,
+// including the ones being dialed, where zero means no limit. By default
+// we use a single connection per host, which leads to less noisy events
+// but does not allow bulk downloads to run in parallel.
+func (t *Transport) SetMaxConnsPerHost(max int) error {
+	return t.transport.SetMaxConnsPerHost(max)
+}
+
+// SetMaxIdleConns sets the maximum number of idle HTTP/1.x connections
+// and the maximum number of idle HTTP/1.x connections per host. Zero
+// means no limit for max and the net/http default for maxPerHost. By
+// default we keep at most 100 idle connections and 2 per host. These
+// settings do not apply to HTTP/2, where connections are shared.
+func (t *Transport) SetMaxIdleConns(max, maxPerHost int) error {
+	return t.transport.SetMaxIdleConns(max, maxPerHost)
+}
+
+// SetIdleConnTimeout sets for how long an idle connection remains
+// in the pool before we close it, where zero means forever. The
+// default is ninety seconds.
+func (t *Transport) SetIdleConnTimeout(timeout time.Duration) error {
+	return t.transport.SetIdleConnTimeout(timeout)
+}
+
+// ForceNewConnections disables HTTP keep-alives such that each
+// transaction uses a new connection, thus ensuring that we measure
+// every handshake. This also applies to HTTP/2, but not to HTTP/3. You
+// should call this method before using the transport. The Reused field
+// of the HTTPConnectionReady event tells you whether a transaction
+// has reused a connection, regardless of this setting.
+func (t *Transport) ForceNewConnections() error {
+	return t.transport.ForceNewConnections()
+}
+
+// SetPinnedSPKIHashes internally calls netx.Dialer.SetPinnedSPKIHashes and
+// therefore it has the same caveats and limitations.
+func (t *Transport) SetPinnedSPKIHashes(pins []string) error {
+	return t.dialer.SetPinnedSPKIHashes(pins)
+}
+
+// SetVerificationHook internally calls netx.Dialer.SetVerificationHook and
+// therefore it has the same caveats and limitations.
+func (t *Transport) SetVerificationHook(
+	hook func(serverName string, state tls.ConnectionState) error,
+) error {
+	return t.dialer.SetVerificationHook(hook)
+}
+
+// SetWriteSegmentation internally calls netx.Dialer.SetWriteSegmentation and
+// therefore it has the same caveats and limitations.
+func (t *Transport) SetWriteSegmentation(
+	offsets []int, splitSNI bool, delay time.Duration,
+) error {
+	return t.dialer.SetWriteSegmentation(offsets, splitSNI, delay)
+}
+
+// SetLocalAddress internally calls netx.Dialer.SetLocalAddress and
+// therefore it has the same caveats and limitations.
+func (t *Transport) SetLocalAddress(address string) error {
+	return t.dialer.SetLocalAddress(address)
+}
+
+// BindToDevice internally calls netx.Dialer.BindToDevice and
+// therefore it has the same caveats and limitations.
+func (t *Transport) BindToDevice(device string) error {
+	return t.dialer.BindToDevice(device)
+}
+
 // Client is a replacement for http.Client.
 type Client struct {
 	// HTTPClient is the underlying client. Pass this client to existing code
@@ -144,6 +344,20 @@ func (c *Client) SetCABundle(path string) error {
 	return c.Transport.SetCABundle(path)
 }
 
+// SetCABundleFromPEM internally calls netx.Dialer.SetCABundleFromPEM and
+// therefore it has the same caveats and limitations.
+func (c *Client) SetCABundleFromPEM(
+	data []byte, appendToSystemRoots bool,
+) (int, error) {
+	return c.Transport.SetCABundleFromPEM(data, appendToSystemRoots)
+}
+
+// SetCAPool internally calls netx.Dialer.SetCAPool and
+// therefore it has the same caveats and limitations.
+func (c *Client) SetCAPool(pool *x509.CertPool) error {
+	return c.Transport.SetCAPool(pool)
+}
+
 // ForceSpecificSNI forces using a specific SNI.
 func (c *Client) ForceSpecificSNI(sni string) error {
 	return c.Transport.ForceSpecificSNI(sni)
@@ -153,3 +367,185 @@ func (c *Client) ForceSpecificSNI(sni string) error {
 func (c *Client) ForceSkipVerify() error {
 	return c.Transport.ForceSkipVerify()
 }
+
+// SetTLSVersions internally calls netx.Dialer.SetTLSVersions and
+// therefore it has the same caveats and limitations.
+func (c *Client) SetTLSVersions(min, max uint16) error {
+	return c.Transport.SetTLSVersions(min, max)
+}
+
+// SetCipherSuites internally calls netx.Dialer.SetCipherSuites and
+// therefore it has the same caveats and limitations.
+func (c *Client) SetCipherSuites(suites []uint16) error {
+	return c.Transport.SetCipherSuites(suites)
+}
+
+// SetALPN internally calls netx.Dialer.SetALPN and
+// therefore it has the same caveats and limitations.
+func (c *Client) SetALPN(protos []string) error {
+	return c.Transport.SetALPN(protos)
+}
+
+// SetCurvePreferences internally calls netx.Dialer.SetCurvePreferences and
+// therefore it has the same caveats and limitations.
+func (c *Client) SetCurvePreferences(curves []tls.CurveID) error {
+	return c.Transport.SetCurvePreferences(curves)
+}
+
+// ForceDisableSessionTickets internally calls netx.Dialer.ForceDisableSessionTickets and
+// therefore it has the same caveats and limitations.
+func (c *Client) ForceDisableSessionTickets() error {
+	return c.Transport.ForceDisableSessionTickets()
+}
+
+// EnableSessionResumption internally calls netx.Dialer.EnableSessionResumption and
+// therefore it has the same caveats and limitations.
+func (c *Client) EnableSessionResumption(capacity int) error {
+	return c.Transport.EnableSessionResumption(capacity)
+}
+
+// SetKeyLogWriter internally calls netx.Dialer.SetKeyLogWriter and
+// therefore it has the same caveats and limitations.
+func (c *Client) SetKeyLogWriter(w io.Writer) error {
+	return c.Transport.SetKeyLogWriter(w)
+}
+
+// EnableKeyLogEvents internally calls the namesake method
+// of Transport and therefore it has the same caveats and limitations.
+func (c *Client) EnableKeyLogEvents() error {
+	return c.Transport.EnableKeyLogEvents()
+}
+
+// EnableHTTP2FrameEvents internally calls the namesake method
+// of Transport and therefore it has the same caveats and limitations.
+func (c *Client) EnableHTTP2FrameEvents() error {
+	return c.Transport.EnableHTTP2FrameEvents()
+}
+
+// SetClientHelloFingerprint internally calls the namesake method
+// of Transport and therefore it has the same caveats and limitations.
+func (c *Client) SetClientHelloFingerprint(name string) error {
+	return c.Transport.SetClientHelloFingerprint(name)
+}
+
+// ForceHTTP3 internally calls the namesake method of Transport
+// and therefore it has the same caveats and limitations.
+func (c *Client) ForceHTTP3() error {
+	return c.Transport.ForceHTTP3()
+}
+
+// EnableHTTP3AltSvc internally calls the namesake method of Transport
+// and therefore it has the same caveats and limitations.
+func (c *Client) EnableHTTP3AltSvc() error {
+	return c.Transport.EnableHTTP3AltSvc()
+}
+
+// EnableBodyStats internally calls the namesake method of Transport
+// and therefore it has the same caveats and limitations.
+func (c *Client) EnableBodyStats(interval time.Duration) error {
+	return c.Transport.EnableBodyStats(interval)
+}
+
+// EnableDecompression internally calls the namesake method of Transport
+// and therefore it has the same caveats and limitations.
+func (c *Client) EnableDecompression() error {
+	return c.Transport.EnableDecompression()
+}
+
+// SetMaxConnsPerHost internally calls the namesake method of Transport
+// and therefore it has the same caveats and limitations.
+func (c *Client) SetMaxConnsPerHost(max int) error {
+	return c.Transport.SetMaxConnsPerHost(max)
+}
+
+// SetMaxIdleConns internally calls the namesake method of Transport
+// and therefore it has the same caveats and limitations.
+func (c *Client) SetMaxIdleConns(max, maxPerHost int) error {
+	return c.Transport.SetMaxIdleConns(max, maxPerHost)
+}
+
+// SetIdleConnTimeout internally calls the namesake method of Transport
+// and therefore it has the same caveats and limitations.
+func (c *Client) SetIdleConnTimeout(timeout time.Duration) error {
+	return c.Transport.SetIdleConnTimeout(timeout)
+}
+
+// ForceNewConnections internally calls the namesake method of Transport
+// and therefore it has the same caveats and limitations.
+func (c *Client) ForceNewConnections() error {
+	return c.Transport.ForceNewConnections()
+}
+
+// SetPinnedSPKIHashes internally calls netx.Dialer.SetPinnedSPKIHashes and
+// therefore it has the same caveats and limitations.
+func (c *Client) SetPinnedSPKIHashes(pins []string) error {
+	return c.Transport.SetPinnedSPKIHashes(pins)
+}
+
+// SetVerificationHook internally calls netx.Dialer.SetVerificationHook and
+// therefore it has the same caveats and limitations.
+func (c *Client) SetVerificationHook(
+	hook func(serverName string, state tls.ConnectionState) error,
+) error {
+	return c.Transport.SetVerificationHook(hook)
+}
+
+// SetWriteSegmentation internally calls netx.Dialer.SetWriteSegmentation and
+// therefore it has the same caveats and limitations.
+func (c *Client) SetWriteSegmentation(
+	offsets []int, splitSNI bool, delay time.Duration,
+) error {
+	return c.Transport.SetWriteSegmentation(offsets, splitSNI, delay)
+}
+
+// SetLocalAddress internally calls netx.Dialer.SetLocalAddress and
+// therefore it has the same caveats and limitations.
+func (c *Client) SetLocalAddress(address string) error {
+	return c.Transport.SetLocalAddress(address)
+}
+
+// BindToDevice internally calls netx.Dialer.BindToDevice and
+// therefore it has the same caveats and limitations.
+func (c *Client) BindToDevice(device string) error {
+	return c.Transport.BindToDevice(device)
+}
+
+// SetCookieJar configures the HTTPClient to use jar for storing the
+// cookies set by servers and for sending them with later requests,
+// including the ones caused by redirects. A nil jar means that we do
+// not use any cookie jar, which is the default. The cookies sent and
+// received by each transaction are in the HTTPRoundTripDone event.
+// Use net/http/cookiejar to create a jar behaving like a browser.
+func (c *Client) SetCookieJar(jar http.CookieJar) error {
+	c.HTTPClient.Jar = jar
+	return nil
+}
+
+// ErrTooManyRedirects indicates that we stopped following
+// redirects because we reached the configured maximum.
+var ErrTooManyRedirects = errors.New("httpx: too many redirects")
+
+// SetMaxRedirects configures the HTTPClient to follow at most max
+// redirects. When a request would exceed this limit, the client fails
+// with an error wrapping ErrTooManyRedirects and the previous response
+// with the body closed, as documented in net/http. A negative max means
+// that we don't follow redirects and instead return the redirect response.
+// By default, we use the net/http policy, i.e., at most ten redirects.
+//
+// Regardless of this setting, each hop is a separate transaction, and
+// the ParentTransactionID field of the round trip events contains the
+// ID of the transaction whose redirect caused the round trip, thus
+// allowing you to reconstruct redirect chains.
+func (c *Client) SetMaxRedirects(max int) error {
+	c.HTTPClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if max < 0 {
+			return http.ErrUseLastResponse
+		}
+		if len(via) > max {
+			return fmt.Errorf("%w: stopped after %d redirects",
+				ErrTooManyRedirects, max)
+		}
+		return nil
+	}
+	return nil
+}
@@ -1,17 +1,31 @@
 package httpx_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"io"
 	"io/ioutil"
+	"log"
 	"net"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/ooni/netx/handlers"
 	"github.com/ooni/netx/httpx"
+	"github.com/ooni/netx/modelx"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
 )
 
 func TestIntegration(t *testing.T) {
@@ -142,3 +156,879 @@ func TestMain(m *testing.M) {
 	os.Setenv("HTTP_PROXY", server.URL)
 	os.Exit(m.Run())
 }
+
+func TestSetALPNForcesHTTP11(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {},
+	))
+	if err := http2.ConfigureServer(server.Config, nil); err != nil {
+		t.Fatal(err)
+	}
+	server.TLS = server.Config.TLSConfig
+	server.StartTLS()
+	defer server.Close()
+	for _, forceHTTP11 := range []bool{false, true} {
+		client := httpx.NewClientWithoutProxy(handlers.NoHandler)
+		client.ForceSkipVerify()
+		expect := "HTTP/2.0"
+		if forceHTTP11 {
+			if err := client.SetALPN([]string{"http/1.1"}); err != nil {
+				t.Fatal(err)
+			}
+			expect = "HTTP/1.1"
+		}
+		resp, err := client.HTTPClient.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		client.Transport.CloseIdleConnections()
+		if resp.Proto != expect {
+			t.Fatal("unexpected protocol", resp.Proto)
+		}
+	}
+}
+
+func TestSetClientHelloFingerprint(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(w, r.Body)
+		},
+	))
+	if err := http2.ConfigureServer(server.Config, nil); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mu     sync.Mutex
+		offers [][]string
+	)
+	server.TLS = server.Config.TLSConfig
+	server.TLS.GetConfigForClient = func(
+		hello *tls.ClientHelloInfo,
+	) (*tls.Config, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		offers = append(offers, hello.SupportedProtos)
+		return nil, nil
+	}
+	server.StartTLS()
+	defer server.Close()
+	handler := new(savingHandler)
+	client := httpx.NewClientWithoutProxy(handler)
+	client.ForceSkipVerify()
+	if err := client.EnableHTTP2FrameEvents(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetClientHelloFingerprint("netscape"); err == nil {
+		t.Fatal("expected an error here")
+	}
+	if err := client.SetClientHelloFingerprint("chrome"); err != nil {
+		t.Fatal(err)
+	}
+	// We use a body to check that we can retry the request using
+	// the HTTP/2 connection adopted by the pool.
+	resp, err := client.HTTPClient.Post(
+		server.URL, "text/plain", strings.NewReader("antani"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	client.Transport.CloseIdleConnections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Proto != "HTTP/2.0" {
+		t.Fatal("unexpected protocol", resp.Proto)
+	}
+	if string(data) != "antani" {
+		t.Fatal("unexpected body", string(data))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// We must offer the same ALPN offered by Chrome.
+	if len(offers) != 1 || strings.Join(offers[0], ",") != "h2,http/1.1" {
+		t.Fatal("unexpected ALPN offers", offers)
+	}
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	var frames int
+	for _, ev := range handler.events {
+		if ev.HTTP2Frame != nil {
+			frames++
+		}
+	}
+	if frames <= 0 {
+		t.Fatal("no HTTP2Frame events")
+	}
+}
+
+func TestSetClientHelloFingerprintUsesRequestRoot(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {},
+	))
+	defer server.Close()
+	client := httpx.NewClientWithoutProxy(handlers.NoHandler)
+	client.ForceSkipVerify()
+	if err := client.SetClientHelloFingerprint("chrome"); err != nil {
+		t.Fatal(err)
+	}
+	handler := new(savingHandler)
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(modelx.WithMeasurementRoot(
+		req.Context(), &modelx.MeasurementRoot{
+			Beginning: time.Now(),
+			Handler:   handler,
+		}))
+	resp, err := client.HTTPClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	client.Transport.CloseIdleConnections()
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	var (
+		txID  int64
+		start *modelx.TLSHandshakeStartEvent
+		done  *modelx.TLSHandshakeDoneEvent
+	)
+	for _, ev := range handler.events {
+		if ev.HTTPRoundTripStart != nil {
+			txID = ev.HTTPRoundTripStart.TransactionID
+		}
+		if ev.TLSHandshakeStart != nil {
+			start = ev.TLSHandshakeStart
+		}
+		if ev.TLSHandshakeDone != nil {
+			done = ev.TLSHandshakeDone
+		}
+	}
+	if start == nil || done == nil {
+		t.Fatal("TLS events did not reach the request's handler")
+	}
+	if txID == 0 || start.TransactionID != txID || done.TransactionID != txID {
+		t.Fatal("TLS events not linked to the transaction")
+	}
+}
+
+type savingHandler struct {
+	mu     sync.Mutex
+	events []modelx.Measurement
+}
+
+func (h *savingHandler) OnMeasurement(m modelx.Measurement) {
+	h.mu.Lock()
+	h.events = append(h.events, m)
+	h.mu.Unlock()
+}
+
+func (h *savingHandler) quicHandshakes() (count int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, ev := range h.events {
+		if ev.QUICHandshakeDone != nil && ev.QUICHandshakeDone.Error == nil {
+			count++
+		}
+	}
+	return
+}
+
+// newHTTP3Server returns a TLS server advertising HTTP/3 using Alt-Svc
+// and the address of the corresponding HTTP/3 server.
+func newHTTP3Server(t *testing.T) (*httptest.Server, string, func()) {
+	var port string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", `h3=":`+port+`"; ma=60`)
+	})
+	server := httptest.NewTLSServer(handler)
+	listener, err := quic.ListenAddrEarly(
+		"127.0.0.1:0", http3.ConfigureTLSConfig(server.TLS.Clone()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ = net.SplitHostPort(listener.Addr().String())
+	h3server := &http3.Server{Handler: handler}
+	go h3server.ServeListener(listener)
+	return server, listener.Addr().String(), func() {
+		h3server.Close()
+		listener.Close()
+		server.Close()
+	}
+}
+
+func TestForceHTTP3(t *testing.T) {
+	_, address, cleanup := newHTTP3Server(t)
+	defer cleanup()
+	handler := new(savingHandler)
+	client := httpx.NewClientWithoutProxy(handler)
+	defer client.Transport.CloseIdleConnections()
+	client.ForceSkipVerify()
+	if err := client.ForceHTTP3(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.HTTPClient.Get("https://" + address + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Proto != "HTTP/3.0" {
+		t.Fatal("unexpected protocol", resp.Proto)
+	}
+	if handler.quicHandshakes() != 1 {
+		t.Fatal("expected a successful QUIC handshake")
+	}
+}
+
+func TestEnableHTTP3AltSvc(t *testing.T) {
+	server, _, cleanup := newHTTP3Server(t)
+	defer cleanup()
+	handler := new(savingHandler)
+	client := httpx.NewClientWithoutProxy(handler)
+	defer client.Transport.CloseIdleConnections()
+	client.ForceSkipVerify()
+	if err := client.EnableHTTP3AltSvc(); err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{"HTTP/1.1", "HTTP/3.0"} {
+		resp, err := client.HTTPClient.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.Proto != expect {
+			t.Fatal("unexpected protocol", resp.Proto)
+		}
+	}
+	if handler.quicHandshakes() != 1 {
+		t.Fatal("expected a successful QUIC handshake")
+	}
+}
+
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestSetKeyLogWriter(t *testing.T) {
+	server, address, cleanup := newHTTP3Server(t)
+	defer cleanup()
+	for _, forceHTTP3 := range []bool{false, true} {
+		keylog := new(lockedBuffer)
+		client := httpx.NewClientWithoutProxy(handlers.NoHandler)
+		client.ForceSkipVerify()
+		if err := client.SetKeyLogWriter(keylog); err != nil {
+			t.Fatal(err)
+		}
+		URL := server.URL
+		if forceHTTP3 {
+			if err := client.ForceHTTP3(); err != nil {
+				t.Fatal(err)
+			}
+			URL = "https://" + address + "/"
+		}
+		resp, err := client.HTTPClient.Get(URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		client.Transport.CloseIdleConnections()
+		if !strings.Contains(keylog.String(), "CLIENT_TRAFFIC_SECRET_0 ") {
+			t.Fatal("expected to see the TLS secrets")
+		}
+	}
+}
+
+func TestEnableKeyLogEvents(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {},
+	))
+	if err := http2.ConfigureServer(server.Config, nil); err != nil {
+		t.Fatal(err)
+	}
+	server.TLS = server.Config.TLSConfig
+	server.StartTLS()
+	defer server.Close()
+	handler := new(savingHandler)
+	client := httpx.NewClientWithoutProxy(handler)
+	defer client.Transport.CloseIdleConnections()
+	client.ForceSkipVerify()
+	if err := client.EnableKeyLogEvents(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.HTTPClient.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Proto != "HTTP/2.0" {
+		t.Fatal("unexpected protocol", resp.Proto)
+	}
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	var handshakeConnID int64
+	secrets := make(map[int64]int)
+	for _, ev := range handler.events {
+		if ev.TLSHandshakeDone != nil {
+			handshakeConnID = ev.TLSHandshakeDone.ConnID
+		}
+		if ev.TLSKeyLog != nil {
+			secrets[ev.TLSKeyLog.ConnID]++
+		}
+	}
+	if handshakeConnID == 0 || len(secrets) != 1 || secrets[handshakeConnID] <= 0 {
+		t.Fatal("expected secrets tagged with the ConnID of the handshake")
+	}
+}
+
+func TestSetCookieJar(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/" {
+				http.SetCookie(w, &http.Cookie{Name: "session", Value: "xyz"})
+				http.Redirect(w, r, "/check", http.StatusFound)
+				return
+			}
+			if cookie, err := r.Cookie("session"); err != nil || cookie.Value != "xyz" {
+				w.WriteHeader(403)
+			}
+		},
+	))
+	defer server.Close()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := new(savingHandler)
+	client := httpx.NewClientWithoutProxy(handler)
+	defer client.Transport.CloseIdleConnections()
+	if err := client.SetCookieJar(jar); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.HTTPClient.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatal("the cookie was not sent")
+	}
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	var events []*modelx.HTTPRoundTripDoneEvent
+	for _, ev := range handler.events {
+		if ev.HTTPRoundTripDone != nil {
+			events = append(events, ev.HTTPRoundTripDone)
+		}
+	}
+	if len(events) != 2 {
+		t.Fatal("unexpected number of transactions")
+	}
+	if len(events[0].RequestCookies) != 0 || len(events[0].ResponseCookies) != 1 ||
+		events[0].ResponseCookies[0].Name != "session" {
+		t.Fatal("unexpected cookies in the first transaction")
+	}
+	if len(events[1].RequestCookies) != 1 || len(events[1].ResponseCookies) != 0 ||
+		events[1].RequestCookies[0].Value != "xyz" {
+		t.Fatal("unexpected cookies in the second transaction")
+	}
+}
+
+func TestResponseHeadersList(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			// Bypass canonicalization to emit odd casing
+			w.Header()["x-ODD-Casing"] = []string{"a"}
+			w.Header()["X-Second"] = []string{"b", "c"}
+		},
+	))
+	if err := http2.ConfigureServer(server.Config, nil); err != nil {
+		t.Fatal(err)
+	}
+	server.TLS = server.Config.TLSConfig
+	server.StartTLS()
+	defer server.Close()
+	for _, forceHTTP11 := range []bool{false, true} {
+		handler := new(savingHandler)
+		client := httpx.NewClientWithoutProxy(handler)
+		client.ForceSkipVerify()
+		if forceHTTP11 {
+			if err := client.SetALPN([]string{"http/1.1"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		resp, err := client.HTTPClient.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		client.Transport.CloseIdleConnections()
+		handler.mu.Lock()
+		var event *modelx.HTTPRoundTripDoneEvent
+		for _, ev := range handler.events {
+			if ev.HTTPRoundTripDone != nil {
+				event = ev.HTTPRoundTripDone
+			}
+		}
+		handler.mu.Unlock()
+		if event == nil {
+			t.Fatal("no HTTPRoundTripDone event")
+		}
+		if len(event.RequestHeadersList) <= 0 {
+			t.Fatal("no request headers list")
+		}
+		var keys, values []string
+		for _, field := range event.ResponseHeadersList {
+			keys = append(keys, field.Key)
+			values = append(values, field.Value)
+		}
+		expectKeys := []string{":status", "x-second", "x-second", "x-odd-casing"}
+		if forceHTTP11 {
+			expectKeys = []string{"X-Second", "X-Second", "x-ODD-Casing"}
+		}
+		// Skip the headers added by net/http, e.g., Date
+		var got []string
+		for _, key := range keys {
+			if strings.HasPrefix(strings.ToLower(key), "x-") || key == ":status" {
+				got = append(got, key)
+			}
+		}
+		if strings.Join(got, " ") != strings.Join(expectKeys, " ") {
+			t.Fatal("unexpected headers", keys, values)
+		}
+	}
+}
+
+func TestResponseHeadersListHTTP11OnlyServer(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header()["x-ODD-Casing"] = []string{"a"}
+		},
+	))
+	defer server.Close()
+	handler := new(savingHandler)
+	client := httpx.NewClientWithoutProxy(handler)
+	client.ForceSkipVerify()
+	resp, err := client.HTTPClient.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	client.Transport.CloseIdleConnections()
+	if resp.ProtoMajor != 1 {
+		t.Fatal("unexpected protocol", resp.Proto)
+	}
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	var found bool
+	for _, ev := range handler.events {
+		if ev.HTTPRoundTripDone == nil {
+			continue
+		}
+		for _, field := range ev.HTTPRoundTripDone.ResponseHeadersList {
+			found = found || field.Key == "x-ODD-Casing"
+		}
+	}
+	if !found {
+		t.Fatal("the raw HTTP/1.1 headers have not been captured")
+	}
+}
+
+func TestEnableHTTP2FrameEvents(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/reset" {
+				panic(http.ErrAbortHandler) // causes RST_STREAM
+			}
+		},
+	))
+	if err := http2.ConfigureServer(server.Config, nil); err != nil {
+		t.Fatal(err)
+	}
+	server.TLS = server.Config.TLSConfig
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+	handler := new(savingHandler)
+	client := httpx.NewClientWithoutProxy(handler)
+	defer client.Transport.CloseIdleConnections()
+	client.ForceSkipVerify()
+	if err := client.EnableHTTP2FrameEvents(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.HTTPClient.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	_, err = client.HTTPClient.Get(server.URL + "/reset")
+	if err == nil || !strings.HasSuffix(err.Error(), "http2_stream_reset") {
+		t.Fatal("not the error we expected", err)
+	}
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	var (
+		settings, headers, resets int
+		txIDs                     = make(map[int64]bool)
+	)
+	for _, ev := range handler.events {
+		if ev.HTTPRoundTripStart != nil {
+			txIDs[ev.HTTPRoundTripStart.TransactionID] = true
+		}
+		frame := ev.HTTP2Frame
+		if frame == nil {
+			continue
+		}
+		if frame.ConnID == 0 {
+			t.Fatal("frame without ConnID")
+		}
+		switch frame.Type {
+		case "SETTINGS":
+			settings++
+		case "HEADERS":
+			if frame.StreamID == 0 || !txIDs[frame.TransactionID] {
+				t.Fatal("HEADERS frame not bound to a transaction")
+			}
+			headers++
+		case "RST_STREAM":
+			if frame.Operation != "read" || frame.ErrCode != "INTERNAL_ERROR" ||
+				!txIDs[frame.TransactionID] {
+				t.Fatal("unexpected RST_STREAM frame")
+			}
+			resets++
+		}
+	}
+	if settings < 2 || headers < 3 || resets != 1 {
+		t.Fatal("unexpected frames", settings, headers, resets)
+	}
+}
+
+func TestFronting(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Host", r.Host)
+			w.Header().Set("X-SNI", r.TLS.ServerName)
+		},
+	))
+	if err := http2.ConfigureServer(server.Config, nil); err != nil {
+		t.Fatal(err)
+	}
+	server.TLS = server.Config.TLSConfig
+	server.StartTLS()
+	defer server.Close()
+	// With ClientHello parroting, we use uTLS rather than crypto/tls
+	// and h2transport adopts the conns because they negotiate h2
+	for _, mode := range []string{"", "keylog", "parrot"} {
+		handler := new(savingHandler)
+		client := httpx.NewClientWithoutProxy(handler)
+		client.ForceSkipVerify()
+		switch mode {
+		case "keylog":
+			if err := client.EnableKeyLogEvents(); err != nil {
+				t.Fatal(err)
+			}
+		case "parrot":
+			if err := client.SetClientHelloFingerprint("chrome"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		fronting := &modelx.Fronting{
+			Address: server.Listener.Addr().String(),
+			Host:    "www.example.org",
+			SNI:     "example.com",
+		}
+		req, err := http.NewRequest("GET", "https://www.example.org.invalid/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = req.WithContext(modelx.WithFronting(req.Context(), fronting))
+		resp, err := client.HTTPClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		client.Transport.CloseIdleConnections()
+		if resp.Header.Get("X-Host") != "www.example.org" {
+			t.Fatal("unexpected Host", resp.Header.Get("X-Host"))
+		}
+		if resp.Header.Get("X-SNI") != "example.com" {
+			t.Fatal("unexpected SNI", resp.Header.Get("X-SNI"))
+		}
+		if resp.ProtoMajor != 2 {
+			t.Fatal("unexpected proto", resp.Proto)
+		}
+		if resp.Request.URL.Host != "www.example.org.invalid" {
+			t.Fatal("unexpected request URL host", resp.Request.URL.Host)
+		}
+		handler.mu.Lock()
+		var (
+			done  *modelx.HTTPRoundTripDoneEvent
+			start *modelx.TLSHandshakeStartEvent
+		)
+		for _, ev := range handler.events {
+			if ev.HTTPRoundTripDone != nil {
+				done = ev.HTTPRoundTripDone
+			}
+			if ev.TLSHandshakeStart != nil {
+				start = ev.TLSHandshakeStart
+			}
+		}
+		handler.mu.Unlock()
+		if done == nil || done.Fronting == nil {
+			t.Fatal("no HTTPRoundTripDone event with Fronting")
+		}
+		if *done.Fronting != *fronting {
+			t.Fatal("unexpected effective fronting", *done.Fronting)
+		}
+		if done.RequestURL != "https://www.example.org.invalid/" {
+			t.Fatal("unexpected request URL", done.RequestURL)
+		}
+		if start == nil || start.SNI != "example.com" {
+			t.Fatal("no TLSHandshakeStart event with the right SNI")
+		}
+		if start.TransactionID == 0 || start.TransactionID != done.TransactionID {
+			t.Fatal("TLSHandshakeStart not linked to the transaction")
+		}
+	}
+}
+
+func TestForceNewConnections(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {},
+	))
+	if err := http2.ConfigureServer(server.Config, nil); err != nil {
+		t.Fatal(err)
+	}
+	server.TLS = server.Config.TLSConfig
+	server.StartTLS()
+	defer server.Close()
+	cleartext := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {},
+	))
+	defer cleartext.Close()
+	for _, URL := range []string{server.URL, cleartext.URL} {
+		for _, force := range []bool{false, true} {
+			handler := new(savingHandler)
+			client := httpx.NewClientWithoutProxy(handler)
+			client.ForceSkipVerify()
+			if force {
+				if err := client.ForceNewConnections(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < 2; i++ {
+				resp, err := client.HTTPClient.Get(URL)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+			client.Transport.CloseIdleConnections()
+			var connects, reused int
+			handler.mu.Lock()
+			for _, ev := range handler.events {
+				if ev.Connect != nil {
+					connects++
+				}
+				if ev.HTTPConnectionReady != nil && ev.HTTPConnectionReady.Reused {
+					reused++
+				}
+			}
+			handler.mu.Unlock()
+			expectConnects, expectReused := 1, 1
+			if force {
+				expectConnects, expectReused = 2, 0
+			}
+			if connects != expectConnects || reused != expectReused {
+				t.Fatal("unexpected counts", URL, force, connects, reused)
+			}
+		}
+	}
+}
+
+func TestConnectionPoolingSettings(t *testing.T) {
+	client := httpx.NewClientWithoutProxy(handlers.NoHandler)
+	if err := client.SetMaxConnsPerHost(-1); err == nil {
+		t.Fatal("expected an error here")
+	}
+	if err := client.SetMaxConnsPerHost(4); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetMaxIdleConns(10, -1); err == nil {
+		t.Fatal("expected an error here")
+	}
+	if err := client.SetMaxIdleConns(10, 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetIdleConnTimeout(-time.Second); err == nil {
+		t.Fatal("expected an error here")
+	}
+	if err := client.SetIdleConnTimeout(time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEnableBodyStats(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			for i := 0; i < 4; i++ {
+				w.Write([]byte("0123456789"))
+				w.(http.Flusher).Flush()
+				time.Sleep(20 * time.Millisecond)
+			}
+		},
+	))
+	defer server.Close()
+	handler := new(savingHandler)
+	client := httpx.NewClientWithoutProxy(handler)
+	if err := client.EnableBodyStats(0); err == nil {
+		t.Fatal("expected an error here")
+	}
+	if err := client.EnableBodyStats(10 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.HTTPClient.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	client.Transport.CloseIdleConnections()
+	var stats *modelx.HTTPBodyStats
+	handler.mu.Lock()
+	for _, ev := range handler.events {
+		if ev.HTTPResponseBodyPart != nil {
+			t.Fatal("unexpected HTTPResponseBodyPart event")
+		}
+		if ev.HTTPResponseDone != nil {
+			stats = ev.HTTPResponseDone.BodyStats
+		}
+	}
+	handler.mu.Unlock()
+	if stats == nil {
+		t.Fatal("no body stats")
+	}
+	sum := sha256.Sum256(data)
+	if stats.SHA256 != hex.EncodeToString(sum[:]) || stats.Size != 40 {
+		t.Fatal("unexpected stats", stats)
+	}
+	if !stats.Complete || stats.TimeToFirstByte <= 0 {
+		t.Fatal("unexpected stats", stats)
+	}
+	if len(stats.Samples) < 2 || stats.Samples[len(stats.Samples)-1].Bytes != 40 {
+		t.Fatal("unexpected samples", stats.Samples)
+	}
+}
+
+func TestEnableDecompression(t *testing.T) {
+	const plaintext = "Hello, world! Hello, world! Hello, world!"
+	var acceptEncoding atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			acceptEncoding.Store(r.Header.Get("Accept-Encoding"))
+			w.Header().Set("Content-Encoding", "gzip")
+			zw := gzip.NewWriter(w)
+			zw.Write([]byte(plaintext))
+			zw.Close()
+		},
+	))
+	defer server.Close()
+	handler := new(savingHandler)
+	client := httpx.NewClientWithoutProxy(handler)
+	if err := client.EnableDecompression(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.HTTPClient.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	client.Transport.CloseIdleConnections()
+	if string(data) != plaintext {
+		t.Fatal("unexpected body", string(data))
+	}
+	if !resp.Uncompressed || resp.Header.Get("Content-Encoding") != "" {
+		t.Fatal("unexpected response", resp.Uncompressed, resp.Header)
+	}
+	if acceptEncoding.Load() != "gzip, deflate, br" {
+		t.Fatal("unexpected Accept-Encoding", acceptEncoding.Load())
+	}
+	var event *modelx.HTTPRoundTripDoneEvent
+	handler.mu.Lock()
+	for _, ev := range handler.events {
+		if ev.HTTPRoundTripDone != nil {
+			event = ev.HTTPRoundTripDone
+		}
+	}
+	handler.mu.Unlock()
+	if event == nil {
+		t.Fatal("no HTTPRoundTripDone event")
+	}
+	if event.ResponseHeaders.Get("Content-Encoding") != "gzip" {
+		t.Fatal("the event does not contain the original headers")
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(event.ResponseBodySnap))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wire, err := ioutil.ReadAll(zr); err != nil || string(wire) != plaintext {
+		t.Fatal("the event does not contain the wire bytes", err)
+	}
+	if string(event.ResponseBodyDecodedSnap) != plaintext {
+		t.Fatal("unexpected decoded snap", string(event.ResponseBodyDecodedSnap))
+	}
+}
+
+func TestPlaintextHook(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {},
+	))
+	defer server.Close()
+	var called int32
+	client := httpx.NewClientWithoutProxy(handlers.NoHandler)
+	client.ForceSkipVerify()
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(modelx.WithMeasurementRoot(
+		req.Context(), &modelx.MeasurementRoot{
+			Beginning: time.Now(),
+			Handler:   handlers.NoHandler,
+			PlaintextHook: func(connID int64, operation string, data []byte) {
+				atomic.AddInt32(&called, 1)
+			},
+		}))
+	resp, err := client.HTTPClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	client.Transport.CloseIdleConnections()
+	if atomic.LoadInt32(&called) <= 0 {
+		t.Fatal("the plaintext hook has not been called")
+	}
+}
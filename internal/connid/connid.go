@@ -2,30 +2,97 @@
 package connid
 
 import (
+	"context"
 	"net"
-	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
 )
 
-// Compute computes the connectionID from the local socket address. The zero
-// value is conventionally returned to mean "unknown".
-func Compute(network, address string) int64 {
-	_, portstring, err := net.SplitHostPort(address)
-	if err != nil {
-		return 0
+var (
+	id       int64
+	activeMu sync.Mutex
+	active   = make(map[string]int64)
+)
+
+// New assigns a new connectionID to conn and remembers it, such that
+// Lookup can later find it using just the connection addresses. The
+// connectionID is unique for the lifetime of the process, hence it does
+// not collide across concurrent measurements, across IPv4 and IPv6, or
+// when the kernel reuses a local port. The zero value is conventionally
+// used to mean "unknown" and is never returned by this function.
+func New(conn net.Conn) int64 {
+	connID := Generate()
+	if key, ok := computeKey(conn); ok {
+		activeMu.Lock()
+		active[key] = connID
+		activeMu.Unlock()
+	}
+	return connID
+}
+
+// Generate returns a new connectionID without remembering it. This
+// is what we use for datagram sockets, which are not connected and
+// hence cannot be found using their addresses.
+func Generate() int64 {
+	return atomic.AddInt64(&id, 1)
+}
+
+// Lookup returns the connectionID previously assigned to conn using
+// New, or zero if we don't know such connection. Because we use the
+// connection addresses as the key, this also works for connections
+// wrapping the original connection, e.g., a *tls.Conn.
+func Lookup(conn net.Conn) (connID int64) {
+	if key, ok := computeKey(conn); ok {
+		activeMu.Lock()
+		connID = active[key]
+		activeMu.Unlock()
 	}
-	portnum, err := strconv.Atoi(portstring)
-	if err != nil {
-		return 0
+	return
+}
+
+// Forget forgets about conn. You should call this function when
+// you're closing conn, so that, if the kernel later reuses the same
+// addresses, we will not confuse the old and the new connection.
+func Forget(conn net.Conn) {
+	if key, ok := computeKey(conn); ok {
+		activeMu.Lock()
+		delete(active, key)
+		activeMu.Unlock()
 	}
-	if portnum < 0 || portnum > 65535 {
-		return 0
+}
+
+func computeKey(conn net.Conn) (string, bool) {
+	if conn == nil || conn.LocalAddr() == nil || conn.RemoteAddr() == nil {
+		return "", false
 	}
-	result := int64(portnum)
-	if strings.Contains(network, "udp") {
-		result *= -1
-	} else if !strings.Contains(network, "tcp") {
-		result = 0
+	local, remote := conn.LocalAddr(), conn.RemoteAddr()
+	return local.Network() + " " + local.String() + " " + remote.String(), true
+}
+
+type contextkey struct{}
+
+// Recorder records the ConnID of the most recent connection that has
+// been established using a specific context. The HTTP code uses it to
+// know the ConnID of the connection on which net/http is going to run
+// the TLS handshake, since net/http does not tell us that.
+type Recorder struct {
+	connID int64
+}
+
+// ConnID returns the most recently recorded ConnID, or zero.
+func (r *Recorder) ConnID() int64 {
+	return atomic.LoadInt64(&r.connID)
+}
+
+// WithRecorder returns a copy of ctx with a new Recorder.
+func WithRecorder(ctx context.Context) (context.Context, *Recorder) {
+	recorder := new(Recorder)
+	return context.WithValue(ctx, contextkey{}, recorder), recorder
+}
+
+// Record records connID into the Recorder of ctx, if any.
+func Record(ctx context.Context, connID int64) {
+	if recorder, ok := ctx.Value(contextkey{}).(*Recorder); ok {
+		atomic.StoreInt64(&recorder.connID, connID)
 	}
-	return result
 }
@@ -1,80 +1,119 @@
 package connid
 
-import "testing"
+import (
+	"context"
+	"net"
+	"testing"
+)
 
-func TestIntegrationTCP(t *testing.T) {
-	num := Compute("tcp", "1.2.3.4:6789")
-	if num != 6789 {
-		t.Fatal("unexpected result")
+func TestUnitNewIsUnique(t *testing.T) {
+	conn := &fakeconn{
+		local:  &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 6789},
+		remote: &net.TCPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 443},
 	}
-}
-
-func TestIntegrationTCP4(t *testing.T) {
-	num := Compute("tcp4", "130.192.91.211:34566")
-	if num != 34566 {
-		t.Fatal("unexpected result")
+	first := New(conn)
+	defer Forget(conn)
+	second := New(conn) // as if the kernel reused the port
+	if first == 0 || second == 0 {
+		t.Fatal("unexpected zero connectionID")
+	}
+	if first == second {
+		t.Fatal("expected different connectionIDs")
+	}
+	if Lookup(conn) != second {
+		t.Fatal("expected to see the most recent connectionID")
 	}
 }
 
-func TestIntegrationTCP6(t *testing.T) {
-	num := Compute("tcp4", "[::1]:4444")
-	if num != 4444 {
-		t.Fatal("unexpected result")
+func TestUnitLookupDistinguishesNetworks(t *testing.T) {
+	tcpconn := &fakeconn{
+		local:  &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 6789},
+		remote: &net.TCPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 53},
+	}
+	udpconn := &fakeconn{
+		local:  &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 6789},
+		remote: &net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 53},
+	}
+	tcpID, udpID := New(tcpconn), New(udpconn)
+	defer Forget(tcpconn)
+	defer Forget(udpconn)
+	if Lookup(tcpconn) != tcpID {
+		t.Fatal("unexpected TCP connectionID")
+	}
+	if Lookup(udpconn) != udpID {
+		t.Fatal("unexpected UDP connectionID")
 	}
 }
 
-func TestIntegrationUDP(t *testing.T) {
-	num := Compute("udp", "1.2.3.4:6789")
-	if num != -6789 {
-		t.Fatal("unexpected result")
+func TestUnitLookupDistinguishesRemotes(t *testing.T) {
+	first := &fakeconn{
+		local:  &net.TCPAddr{IP: net.ParseIP("::1"), Port: 4444},
+		remote: &net.TCPAddr{IP: net.ParseIP("::1"), Port: 80},
+	}
+	second := &fakeconn{
+		local:  &net.TCPAddr{IP: net.ParseIP("::1"), Port: 4444},
+		remote: &net.TCPAddr{IP: net.ParseIP("::1"), Port: 443},
+	}
+	firstID, secondID := New(first), New(second)
+	defer Forget(first)
+	defer Forget(second)
+	if Lookup(first) != firstID || Lookup(second) != secondID {
+		t.Fatal("unexpected connectionID")
 	}
 }
 
-func TestIntegrationUDP4(t *testing.T) {
-	num := Compute("udp4", "130.192.91.211:34566")
-	if num != -34566 {
-		t.Fatal("unexpected result")
+func TestUnitForget(t *testing.T) {
+	conn := &fakeconn{
+		local:  &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 6790},
+		remote: &net.TCPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 443},
+	}
+	New(conn)
+	Forget(conn)
+	if Lookup(conn) != 0 {
+		t.Fatal("expected zero connectionID")
 	}
 }
 
-func TestIntegrationUDP6(t *testing.T) {
-	num := Compute("udp6", "[::1]:4444")
-	if num != -4444 {
-		t.Fatal("unexpected result")
+func TestUnitNilConn(t *testing.T) {
+	if New(nil) == 0 {
+		t.Fatal("unexpected zero connectionID")
 	}
+	if Lookup(nil) != 0 {
+		t.Fatal("expected zero connectionID")
+	}
+	Forget(nil) // should not crash
 }
 
-func TestIntegrationInvalidAddress(t *testing.T) {
-	num := Compute("udp6", "[::1]")
-	if num != 0 {
-		t.Fatal("unexpected result")
+func TestUnitGenerate(t *testing.T) {
+	first, second := Generate(), Generate()
+	if first == 0 || first == second {
+		t.Fatal("expected distinct, nonzero connectionIDs")
 	}
 }
 
-func TestIntegrationInvalidPort(t *testing.T) {
-	num := Compute("udp6", "[::1]:antani")
-	if num != 0 {
-		t.Fatal("unexpected result")
+func TestUnitRecorder(t *testing.T) {
+	Record(context.Background(), 17) // should not crash
+	ctx, recorder := WithRecorder(context.Background())
+	if recorder.ConnID() != 0 {
+		t.Fatal("expected zero connectionID")
+	}
+	Record(ctx, 17)
+	Record(ctx, 18)
+	if recorder.ConnID() != 18 {
+		t.Fatal("expected most recent connectionID")
 	}
 }
 
-func TestIntegrationNegativePort(t *testing.T) {
-	num := Compute("udp6", "[::1]:-1")
-	if num != 0 {
-		t.Fatal("unexpected result")
-	}
+type fakeconn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
 }
 
-func TestIntegrationLargePort(t *testing.T) {
-	num := Compute("udp6", "[::1]:65536")
-	if num != 0 {
-		t.Fatal("unexpected result")
-	}
+func (c *fakeconn) LocalAddr() net.Addr {
+	return c.local
 }
 
-func TestIntegrationInvalidNetwork(t *testing.T) {
-	num := Compute("unix", "[::1]:65531")
-	if num != 0 {
-		t.Fatal("unexpected result")
-	}
+func (c *fakeconn) RemoteAddr() net.Addr {
+	return c.remote
 }
@@ -0,0 +1,130 @@
+// Package binddialer contains the dialer that creates the sockets. It
+// allows to bind sockets to a local address and, on Linux, to a specific
+// network interface. We use it to choose the network path taken by a
+// measurement on multi-homed devices.
+package binddialer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ErrBindToDeviceNotSupported indicates that binding to a specific
+// network interface is not supported on this platform.
+var ErrBindToDeviceNotSupported = errors.New(
+	"binddialer: binding to a device is not supported on this platform")
+
+// Dialer is a modelx.Dialer that binds the sockets it creates
+// to the configured local address and device, if any.
+type Dialer struct {
+	// Device is the name of the network interface to bind to. When
+	// empty, we let the kernel choose the interface.
+	Device string
+
+	// LocalIP is the local IP address to bind to. When nil, we let
+	// the kernel choose the local IP address.
+	LocalIP net.IP
+
+	// LocalPort is the local port to bind to. When zero, we let
+	// the kernel choose the local port.
+	LocalPort int
+}
+
+// New creates a new Dialer.
+func New() *Dialer {
+	return new(Dialer)
+}
+
+// SetLocalAddress configures the local address. The address is either
+// an IP address, or an endpoint where IPv6 addresses are quoted using
+// square brackets, e.g., "[::1]:5555". The IP address may be empty to
+// only configure the local port, e.g., ":5555".
+func (d *Dialer) SetLocalAddress(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host, port = address, "0"
+	}
+	var ip net.IP
+	if host != "" {
+		ip = net.ParseIP(host)
+		if ip == nil {
+			return errors.New("binddialer: invalid local IP address")
+		}
+	}
+	portnum, err := strconv.Atoi(port)
+	if err != nil || portnum < 0 || portnum > 65535 {
+		return errors.New("binddialer: invalid local port")
+	}
+	d.LocalIP, d.LocalPort = ip, portnum
+	return nil
+}
+
+// BindToDevice configures the network interface to use. This is only
+// supported on Linux, where we use the SO_BINDTODEVICE socket option,
+// which typically requires the CAP_NET_RAW capability.
+func (d *Dialer) BindToDevice(device string) error {
+	if !bindToDeviceSupported {
+		return ErrBindToDeviceNotSupported
+	}
+	d.Device = device
+	return nil
+}
+
+// Dial creates a TCP or UDP connection. See net.Dial docs.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext is like Dial but with context.
+func (d *Dialer) DialContext(
+	ctx context.Context, network, address string,
+) (net.Conn, error) {
+	dialer := &net.Dialer{LocalAddr: d.localAddr(network)}
+	if d.Device != "" {
+		device := d.Device
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			return bindToDevice(c, device)
+		}
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// ListenPacket creates a datagram socket. See net.ListenPacket docs. When
+// address is empty, we use the configured local address, if any.
+func (d *Dialer) ListenPacket(
+	ctx context.Context, network, address string,
+) (net.PacketConn, error) {
+	if address == "" {
+		address = ":0"
+		if addr := d.localAddr(network); addr != nil {
+			address = addr.String()
+		}
+	}
+	config := &net.ListenConfig{}
+	if d.Device != "" {
+		device := d.Device
+		config.Control = func(network, address string, c syscall.RawConn) error {
+			return bindToDevice(c, device)
+		}
+	}
+	return config.ListenPacket(ctx, network, address)
+}
+
+func (d *Dialer) localAddr(network string) net.Addr {
+	// Implementation note: we MUST return a nil interface and not
+	// a nil pointer, otherwise net.Dialer will try to use it.
+	if d.LocalIP == nil && d.LocalPort == 0 {
+		return nil
+	}
+	if strings.HasPrefix(network, "tcp") {
+		return &net.TCPAddr{IP: d.LocalIP, Port: d.LocalPort}
+	}
+	if strings.HasPrefix(network, "udp") {
+		return &net.UDPAddr{IP: d.LocalIP, Port: d.LocalPort}
+	}
+	return nil
+}
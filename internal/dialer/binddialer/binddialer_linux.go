@@ -0,0 +1,16 @@
+package binddialer
+
+import "syscall"
+
+const bindToDeviceSupported = true
+
+func bindToDevice(c syscall.RawConn, device string) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = syscall.BindToDevice(int(fd), device)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
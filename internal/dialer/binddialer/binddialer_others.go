@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package binddialer
+
+import "syscall"
+
+const bindToDeviceSupported = false
+
+func bindToDevice(c syscall.RawConn, device string) error {
+	return ErrBindToDeviceNotSupported
+}
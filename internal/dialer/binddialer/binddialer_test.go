@@ -0,0 +1,100 @@
+package binddialer
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestIntegrationSuccess(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	dialer := New()
+	if err := dialer.SetLocalAddress("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	addr, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		t.Fatal("unexpected local address type")
+	}
+	if !addr.IP.Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatal("unexpected local IP address")
+	}
+}
+
+func TestIntegrationUDP(t *testing.T) {
+	dialer := New()
+	if err := dialer.SetLocalAddress("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("udp", "127.0.0.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, ok := conn.LocalAddr().(*net.UDPAddr); !ok {
+		t.Fatal("unexpected local address type")
+	}
+}
+
+func TestIntegrationListenPacket(t *testing.T) {
+	dialer := New()
+	if err := dialer.SetLocalAddress("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, address := range []string{"", "127.0.0.1:0"} {
+		conn, err := dialer.ListenPacket(context.Background(), "udp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr, ok := conn.LocalAddr().(*net.UDPAddr)
+		conn.Close()
+		if !ok || !addr.IP.Equal(net.ParseIP("127.0.0.1")) {
+			t.Fatal("unexpected local address")
+		}
+	}
+}
+
+func TestUnitSetLocalAddress(t *testing.T) {
+	dialer := New()
+	if err := dialer.SetLocalAddress("[::1]:5555"); err != nil {
+		t.Fatal(err)
+	}
+	if !dialer.LocalIP.Equal(net.IPv6loopback) || dialer.LocalPort != 5555 {
+		t.Fatal("unexpected local address")
+	}
+	if err := dialer.SetLocalAddress(":5556"); err != nil {
+		t.Fatal(err)
+	}
+	if dialer.LocalIP != nil || dialer.LocalPort != 5556 {
+		t.Fatal("unexpected local address")
+	}
+}
+
+func TestUnitSetLocalAddressInvalidIP(t *testing.T) {
+	dialer := New()
+	if err := dialer.SetLocalAddress("antani"); err == nil {
+		t.Fatal("expected an error here")
+	}
+}
+
+func TestUnitSetLocalAddressInvalidPort(t *testing.T) {
+	dialer := New()
+	if err := dialer.SetLocalAddress("127.0.0.1:65536"); err == nil {
+		t.Fatal("expected an error here")
+	}
+}
+
+func TestUnitLocalAddrNotConfigured(t *testing.T) {
+	if New().localAddr("tcp") != nil {
+		t.Fatal("expected nil interface here")
+	}
+}
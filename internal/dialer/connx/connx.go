@@ -2,9 +2,13 @@
 package connx
 
 import (
+	"crypto/tls"
+	"errors"
 	"net"
+	"sync"
 	"time"
 
+	"github.com/ooni/netx/internal/connid"
 	"github.com/ooni/netx/internal/errwrapper"
 	"github.com/ooni/netx/modelx"
 )
@@ -12,9 +16,12 @@ import (
 // MeasuringConn is a net.Conn used to perform measurements
 type MeasuringConn struct {
 	net.Conn
-	Beginning time.Time
-	Handler   modelx.Handler
-	ID        int64
+	Beginning   time.Time
+	Handler     modelx.Handler
+	ID          int64
+	MaxSnapSize int64 // default: 0, i.e. don't save bytes
+	readSnap    snapper
+	writeSnap   snapper
 }
 
 // Read reads data from the connection.
@@ -30,6 +37,7 @@ func (c *MeasuringConn) Read(b []byte) (n int, err error) {
 	c.Handler.OnMeasurement(modelx.Measurement{
 		Read: &modelx.ReadEvent{
 			ConnID:                 c.ID,
+			Data:                   c.readSnap.snap(c.MaxSnapSize, b[:n]),
 			DurationSinceBeginning: stop.Sub(c.Beginning),
 			Error:                  err,
 			NumBytes:               int64(n),
@@ -52,6 +60,7 @@ func (c *MeasuringConn) Write(b []byte) (n int, err error) {
 	c.Handler.OnMeasurement(modelx.Measurement{
 		Write: &modelx.WriteEvent{
 			ConnID:                 c.ID,
+			Data:                   c.writeSnap.snap(c.MaxSnapSize, b[:n]),
 			DurationSinceBeginning: stop.Sub(c.Beginning),
 			Error:                  err,
 			NumBytes:               int64(n),
@@ -63,6 +72,7 @@ func (c *MeasuringConn) Write(b []byte) (n int, err error) {
 
 // Close closes the connection
 func (c *MeasuringConn) Close() (err error) {
+	connid.Forget(c.Conn) // the kernel may now reuse the same addresses
 	start := time.Now()
 	err = c.Conn.Close()
 	err = errwrapper.SafeErrWrapperBuilder{
@@ -81,3 +91,170 @@ func (c *MeasuringConn) Close() (err error) {
 	})
 	return
 }
+
+// snapper saves at most a configured number of the bytes flowing
+// in a specific direction of a connection.
+type snapper struct {
+	mu    sync.Mutex
+	saved int64
+}
+
+// snap returns a copy of the bytes of data we should save given
+// maxSnapSize, which has the semantics of MeasurementRoot.MaxConnSnapSize.
+func (s *snapper) snap(maxSnapSize int64, data []byte) []byte {
+	if maxSnapSize == 0 || len(data) <= 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := int64(len(data))
+	if maxSnapSize > 0 && count > maxSnapSize-s.saved {
+		count = maxSnapSize - s.saved
+	}
+	if count <= 0 {
+		return nil
+	}
+	s.saved += count
+	return append([]byte{}, data[:count]...)
+}
+
+// PlaintextConn is a net.Conn passing the data it reads and writes to
+// Hook. We use it on top of TLS connections to expose the plaintext.
+type PlaintextConn struct {
+	net.Conn
+	Hook func(connID int64, operation string, data []byte)
+	ID   int64
+}
+
+// Read reads data from the connection.
+func (c *PlaintextConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	if n > 0 {
+		c.Hook(c.ID, "read", b[:n])
+	}
+	return
+}
+
+// Write writes data to the connection.
+func (c *PlaintextConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	if n > 0 {
+		c.Hook(c.ID, "write", b[:n])
+	}
+	return
+}
+
+// ConnectionState returns the TLS connection state.
+func (c *PlaintextConn) ConnectionState() tls.ConnectionState {
+	type connectionStater interface {
+		ConnectionState() tls.ConnectionState
+	}
+	if cs, ok := c.Conn.(connectionStater); ok {
+		return cs.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
+// MeasuringPacketConn is a net.PacketConn used to perform measurements
+type MeasuringPacketConn struct {
+	net.PacketConn
+	Beginning   time.Time
+	Handler     modelx.Handler
+	ID          int64
+	MaxSnapSize int64 // default: 0, i.e. don't save bytes
+	readSnap    snapper
+	writeSnap   snapper
+}
+
+// ReadFrom reads a datagram from the socket.
+func (c *MeasuringPacketConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	start := time.Now()
+	n, addr, err = c.PacketConn.ReadFrom(b)
+	err = errwrapper.SafeErrWrapperBuilder{
+		ConnID:    c.ID,
+		Error:     err,
+		Operation: "read_from",
+	}.MaybeBuild()
+	stop := time.Now()
+	c.Handler.OnMeasurement(modelx.Measurement{
+		ReadFrom: &modelx.ReadFromEvent{
+			ConnID:                 c.ID,
+			Data:                   c.readSnap.snap(c.MaxSnapSize, b[:n]),
+			DurationSinceBeginning: stop.Sub(c.Beginning),
+			Error:                  err,
+			NumBytes:               int64(n),
+			RemoteAddress:          safeAddrString(addr),
+			SyscallDuration:        stop.Sub(start),
+		},
+	})
+	return
+}
+
+// WriteTo writes a datagram to the socket.
+func (c *MeasuringPacketConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	start := time.Now()
+	n, err = c.PacketConn.WriteTo(b, addr)
+	err = errwrapper.SafeErrWrapperBuilder{
+		ConnID:    c.ID,
+		Error:     err,
+		Operation: "write_to",
+	}.MaybeBuild()
+	stop := time.Now()
+	c.Handler.OnMeasurement(modelx.Measurement{
+		WriteTo: &modelx.WriteToEvent{
+			ConnID:                 c.ID,
+			Data:                   c.writeSnap.snap(c.MaxSnapSize, b[:n]),
+			DurationSinceBeginning: stop.Sub(c.Beginning),
+			Error:                  err,
+			NumBytes:               int64(n),
+			RemoteAddress:          safeAddrString(addr),
+			SyscallDuration:        stop.Sub(start),
+		},
+	})
+	return
+}
+
+// Close closes the socket.
+func (c *MeasuringPacketConn) Close() (err error) {
+	start := time.Now()
+	err = c.PacketConn.Close()
+	err = errwrapper.SafeErrWrapperBuilder{
+		ConnID:    c.ID,
+		Error:     err,
+		Operation: "close",
+	}.MaybeBuild()
+	stop := time.Now()
+	c.Handler.OnMeasurement(modelx.Measurement{
+		Close: &modelx.CloseEvent{
+			ConnID:                 c.ID,
+			DurationSinceBeginning: stop.Sub(c.Beginning),
+			Error:                  err,
+			SyscallDuration:        stop.Sub(start),
+		},
+	})
+	return
+}
+
+// SetReadBuffer sets the size of the receive buffer, if possible. QUIC
+// implementations use this method to increase the buffer size.
+func (c *MeasuringPacketConn) SetReadBuffer(bytes int) error {
+	if conn, ok := c.PacketConn.(interface{ SetReadBuffer(int) error }); ok {
+		return conn.SetReadBuffer(bytes)
+	}
+	return errors.New("connx: cannot set the receive buffer size")
+}
+
+// SetWriteBuffer sets the size of the send buffer, if possible.
+func (c *MeasuringPacketConn) SetWriteBuffer(bytes int) error {
+	if conn, ok := c.PacketConn.(interface{ SetWriteBuffer(int) error }); ok {
+		return conn.SetWriteBuffer(bytes)
+	}
+	return errors.New("connx: cannot set the send buffer size")
+}
+
+func safeAddrString(addr net.Addr) (s string) {
+	if addr != nil {
+		s = addr.String()
+	}
+	return
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/ooni/netx/handlers"
+	"github.com/ooni/netx/modelx"
 )
 
 func TestIntegrationMeasuringConn(t *testing.T) {
@@ -59,3 +60,136 @@ func (fakeconn) SetReadDeadline(t time.Time) (err error) {
 func (fakeconn) SetWriteDeadline(t time.Time) (err error) {
 	return
 }
+
+type savingHandler struct {
+	events []modelx.Measurement
+}
+
+func (h *savingHandler) OnMeasurement(m modelx.Measurement) {
+	h.events = append(h.events, m)
+}
+
+func TestIntegrationMeasuringPacketConn(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	pconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := new(savingHandler)
+	conn := &MeasuringPacketConn{
+		PacketConn: pconn,
+		Handler:    handler,
+		ID:         17,
+	}
+	if err := conn.SetReadBuffer(1 << 16); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.WriteTo([]byte("antani"), server.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buffer := make([]byte, 128)
+	n, addr, err := server.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.WriteTo(buffer[:n], addr); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := conn.ReadFrom(buffer); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if len(handler.events) != 3 {
+		t.Fatal("unexpected number of events")
+	}
+	writeTo := handler.events[0].WriteTo
+	if writeTo == nil || writeTo.ConnID != 17 || writeTo.NumBytes != 6 ||
+		writeTo.RemoteAddress != server.LocalAddr().String() {
+		t.Fatal("unexpected WriteTo event")
+	}
+	readFrom := handler.events[1].ReadFrom
+	if readFrom == nil || readFrom.ConnID != 17 || readFrom.NumBytes != 6 ||
+		readFrom.RemoteAddress != server.LocalAddr().String() {
+		t.Fatal("unexpected ReadFrom event")
+	}
+	if handler.events[2].Close == nil {
+		t.Fatal("expected a Close event")
+	}
+}
+
+func TestIntegrationMeasuringConnSnap(t *testing.T) {
+	handler := new(savingHandler)
+	conn := &MeasuringConn{
+		Conn:        fakeconn{},
+		Handler:     handler,
+		MaxSnapSize: 6,
+	}
+	for _, data := range []string{"antani", "mascetti"} {
+		if _, err := conn.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := conn.Read(make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	if len(handler.events) != 3 {
+		t.Fatal("unexpected number of events")
+	}
+	if string(handler.events[0].Write.Data) != "antani" {
+		t.Fatal("unexpected first write snap")
+	}
+	if handler.events[1].Write.Data != nil {
+		t.Fatal("expected no data after reaching the snap size")
+	}
+	if len(handler.events[2].Read.Data) != 4 {
+		t.Fatal("expected read snap to be independent of write snap")
+	}
+}
+
+func TestUnitSnapper(t *testing.T) {
+	var s snapper
+	if s.snap(0, []byte("antani")) != nil {
+		t.Fatal("expected no data when disabled")
+	}
+	data := []byte("antani")
+	out := s.snap(4, data)
+	if string(out) != "anta" {
+		t.Fatal("unexpected snap")
+	}
+	data[0] = 'A'
+	if out[0] != 'a' {
+		t.Fatal("expected a copy of the data")
+	}
+	if s.snap(4, data) != nil {
+		t.Fatal("expected no data after reaching the snap size")
+	}
+	var unlimited snapper
+	if len(unlimited.snap(-1, make([]byte, 1<<17))) != 1<<17 {
+		t.Fatal("expected all data with negative snap size")
+	}
+}
+
+func TestUnitPlaintextConn(t *testing.T) {
+	var ops []string
+	conn := &PlaintextConn{
+		Conn: fakeconn{},
+		Hook: func(connID int64, operation string, data []byte) {
+			if connID == 17 && len(data) == 4 {
+				ops = append(ops, operation)
+			}
+		},
+		ID: 17,
+	}
+	conn.Read(make([]byte, 4))
+	conn.Write(make([]byte, 4))
+	if len(ops) != 2 || ops[0] != "read" || ops[1] != "write" {
+		t.Fatal("unexpected hook calls")
+	}
+	if conn.ConnectionState().HandshakeComplete {
+		t.Fatal("expected empty connection state")
+	}
+}
@@ -6,8 +6,11 @@ import (
 	"crypto/tls"
 
 	"github.com/ooni/netx/internal/dialer/dnsdialer"
+	"github.com/ooni/netx/internal/dialer/packetlistener"
+	"github.com/ooni/netx/internal/dialer/quicdialer"
 	"github.com/ooni/netx/internal/dialer/tlsdialer"
 	"github.com/ooni/netx/modelx"
+	"github.com/quic-go/quic-go"
 )
 
 // New creates a new modelx.Dialer
@@ -19,3 +22,17 @@ func New(resolver modelx.DNSResolver, dialer modelx.Dialer) *dnsdialer.Dialer {
 func NewTLS(dialer modelx.Dialer, config *tls.Config) *tlsdialer.TLSDialer {
 	return tlsdialer.New(dialer, config)
 }
+
+// NewQUIC creates a new QUIC dialer
+func NewQUIC(
+	resolver modelx.DNSResolver, config *tls.Config, quicConfig *quic.Config,
+) *quicdialer.QUICDialer {
+	return quicdialer.New(resolver, config, quicConfig)
+}
+
+// NewPacketListener creates a new listener for datagram sockets
+func NewPacketListener(
+	listener packetlistener.UnderlyingListener,
+) *packetlistener.Listener {
+	return packetlistener.New(listener)
+}
@@ -5,10 +5,12 @@ package dialerbase
 import (
 	"context"
 	"net"
+	"strconv"
 	"time"
 
 	"github.com/ooni/netx/internal/connid"
 	"github.com/ooni/netx/internal/dialer/connx"
+	"github.com/ooni/netx/internal/dialer/segmenter"
 	"github.com/ooni/netx/internal/errwrapper"
 	"github.com/ooni/netx/internal/transactionid"
 	"github.com/ooni/netx/modelx"
@@ -17,10 +19,12 @@ import (
 // Dialer is a net.Dialer that is only able to connect to
 // remote TCP/UDP endpoints. DNS is not supported.
 type Dialer struct {
-	dialer    modelx.Dialer
-	beginning time.Time
-	handler   modelx.Handler
-	dialID    int64
+	MaxConnSnapSize int64           // default: 0, i.e. don't save bytes
+	Segmentation    *segmenter.Plan // default: nil, i.e. don't segment
+	dialer          modelx.Dialer
+	beginning       time.Time
+	handler         modelx.Handler
+	dialID          int64
 }
 
 // New creates a new dialer
@@ -60,7 +64,7 @@ func (d *Dialer) DialContext(
 		Error:     err,
 		Operation: "connect",
 	}.MaybeBuild()
-	connID := safeConnID(network, conn)
+	connID := safeConnID(ctx, conn)
 	txID := transactionid.ContextTransactionID(ctx)
 	d.handler.OnMeasurement(modelx.Measurement{
 		Connect: &modelx.ConnectEvent{
@@ -68,6 +72,8 @@ func (d *Dialer) DialContext(
 			DialID:                 d.dialID,
 			DurationSinceBeginning: stop.Sub(d.beginning),
 			Error:                  err,
+			LocalAddress:           safeLocalAddress(conn),
+			LocalPort:              safeLocalPort(conn),
 			Network:                network,
 			RemoteAddress:          address,
 			SyscallDuration:        stop.Sub(start),
@@ -77,12 +83,34 @@ func (d *Dialer) DialContext(
 	if err != nil {
 		return nil, err
 	}
-	return &connx.MeasuringConn{
-		Conn:      conn,
-		Beginning: d.beginning,
-		Handler:   d.handler,
-		ID:        connID,
-	}, nil
+	conn = &connx.MeasuringConn{
+		Conn:        conn,
+		Beginning:   d.beginning,
+		Handler:     d.handler,
+		ID:          connID,
+		MaxSnapSize: d.MaxConnSnapSize,
+	}
+	if d.Segmentation != nil && isTCP(network) {
+		conn = &segmenter.Conn{
+			Conn:      conn,
+			Beginning: d.beginning,
+			Handler:   d.handler,
+			ID:        connID,
+			Plan:      d.Segmentation,
+			TxID:      txID,
+		}
+	}
+	return conn, nil
+}
+
+// isTCP tells us whether network is a stream network, since we
+// must not split the datagrams sent over UDP.
+func isTCP(network string) bool {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return true
+	}
+	return false
 }
 
 func safeLocalAddress(conn net.Conn) (s string) {
@@ -92,6 +120,19 @@ func safeLocalAddress(conn net.Conn) (s string) {
 	return
 }
 
-func safeConnID(network string, conn net.Conn) int64 {
-	return connid.Compute(network, safeLocalAddress(conn))
+func safeLocalPort(conn net.Conn) (port int64) {
+	_, portstring, err := net.SplitHostPort(safeLocalAddress(conn))
+	if err == nil {
+		port, _ = strconv.ParseInt(portstring, 10, 64)
+	}
+	return
+}
+
+func safeConnID(ctx context.Context, conn net.Conn) (connID int64) {
+	// A failed connection does not have any ConnID.
+	if conn != nil {
+		connID = connid.New(conn)
+		connid.Record(ctx, connID)
+	}
+	return
 }
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/ooni/netx/handlers"
+	"github.com/ooni/netx/internal/dialer/segmenter"
 	"github.com/ooni/netx/modelx"
 )
 
@@ -35,6 +36,32 @@ func TestIntegrationErrorNoConnect(t *testing.T) {
 	}
 }
 
+func TestUnitSegmentationOnlyForTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	dialer := New(time.Now(), handlers.NoHandler, new(net.Dialer), 17)
+	dialer.Segmentation = &segmenter.Plan{Offsets: []int{1}}
+	conn, err := dialer.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*segmenter.Conn); !ok {
+		t.Fatal("expected a segmenting conn for tcp")
+	}
+	conn, err = dialer.Dial("udp", "127.0.0.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*segmenter.Conn); ok {
+		t.Fatal("expected no segmenting conn for udp")
+	}
+}
+
 // see whether we implement the interface
 func newdialer() modelx.Dialer {
 	return New(
@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	"github.com/ooni/netx/internal/dialer/dialerbase"
+	"github.com/ooni/netx/internal/dialer/segmenter"
 	"github.com/ooni/netx/internal/dialid"
 	"github.com/ooni/netx/modelx"
 )
@@ -15,8 +16,9 @@ import (
 // Dialer defines the dialer API. We implement the most basic form
 // of DNS, but more advanced resolutions are possible.
 type Dialer struct {
-	dialer   modelx.Dialer
-	resolver modelx.DNSResolver
+	Segmentation *segmenter.Plan // default: nil, i.e. don't segment
+	dialer       modelx.Dialer
+	resolver     modelx.DNSResolver
 }
 
 // New creates a new Dialer.
@@ -54,6 +56,8 @@ func (d *Dialer) DialContext(
 		dialer := dialerbase.New(
 			root.Beginning, root.Handler, d.dialer, dialID,
 		)
+		dialer.MaxConnSnapSize = root.MaxConnSnapSize
+		dialer.Segmentation = d.Segmentation
 		target := net.JoinHostPort(addr, onlyport)
 		conn, err = dialer.DialContext(ctx, network, target)
 		if err == nil {
@@ -61,11 +65,13 @@ func (d *Dialer) DialContext(
 		}
 		errorslist = append(errorslist, err)
 	}
-	err = reduceErrors(errorslist)
+	err = ReduceErrors(errorslist)
 	return
 }
 
-func reduceErrors(errorslist []error) error {
+// ReduceErrors returns the most relevant error among the errors
+// that occurred when trying to use each resolved address.
+func ReduceErrors(errorslist []error) error {
 	if len(errorslist) == 0 {
 		return nil
 	}
@@ -89,6 +95,14 @@ func reduceErrors(errorslist []error) error {
 
 func (d *Dialer) lookupHost(
 	ctx context.Context, hostname string,
+) ([]string, error) {
+	return LookupHost(ctx, d.resolver, hostname)
+}
+
+// LookupHost resolves hostname using the MeasurementRoot's LookupHost,
+// if set, and otherwise resolver. IP addresses are returned verbatim.
+func LookupHost(
+	ctx context.Context, resolver modelx.DNSResolver, hostname string,
 ) ([]string, error) {
 	if net.ParseIP(hostname) != nil {
 		return []string{hostname}, nil
@@ -96,7 +110,7 @@ func (d *Dialer) lookupHost(
 	root := modelx.ContextMeasurementRootOrDefault(ctx)
 	lookupHost := root.LookupHost
 	if root.LookupHost == nil {
-		lookupHost = d.resolver.LookupHost
+		lookupHost = resolver.LookupHost
 	}
 	addrs, err := lookupHost(ctx, hostname)
 	return addrs, err
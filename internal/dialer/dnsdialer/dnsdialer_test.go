@@ -72,7 +72,7 @@ func newdialer() modelx.Dialer {
 
 func TestReduceErrors(t *testing.T) {
 	t.Run("no errors", func(t *testing.T) {
-		result := reduceErrors(nil)
+		result := ReduceErrors(nil)
 		if result != nil {
 			t.Fatal("wrong result")
 		}
@@ -80,7 +80,7 @@ func TestReduceErrors(t *testing.T) {
 
 	t.Run("single error", func(t *testing.T) {
 		err := errors.New("mocked error")
-		result := reduceErrors([]error{err})
+		result := ReduceErrors([]error{err})
 		if result != err {
 			t.Fatal("wrong result")
 		}
@@ -89,7 +89,7 @@ func TestReduceErrors(t *testing.T) {
 	t.Run("multiple errors", func(t *testing.T) {
 		err1 := errors.New("mocked error #1")
 		err2 := errors.New("mocked error #2")
-		result := reduceErrors([]error{err1, err2})
+		result := ReduceErrors([]error{err1, err2})
 		if result.Error() != "mocked error #1" {
 			t.Fatal("wrong result")
 		}
@@ -104,7 +104,7 @@ func TestReduceErrors(t *testing.T) {
 			Failure: "connection_refused",
 		}
 		err4 := errors.New("mocked error #3")
-		result := reduceErrors([]error{err1, err2, err3, err4})
+		result := ReduceErrors([]error{err1, err2, err3, err4})
 		if result.Error() != "connection_refused" {
 			t.Fatal("wrong result")
 		}
@@ -0,0 +1,73 @@
+// Package packetlistener contains the code creating datagram sockets
+// that emit events for every datagram they send and receive.
+package packetlistener
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/ooni/netx/internal/connid"
+	"github.com/ooni/netx/internal/dialer/connx"
+	"github.com/ooni/netx/internal/errwrapper"
+	"github.com/ooni/netx/modelx"
+)
+
+// UnderlyingListener is the listener we use to create sockets.
+type UnderlyingListener interface {
+	ListenPacket(
+		ctx context.Context, network, address string) (net.PacketConn, error)
+}
+
+// Listener creates measured datagram sockets.
+type Listener struct {
+	listener UnderlyingListener
+}
+
+// New creates a new Listener.
+func New(listener UnderlyingListener) *Listener {
+	return &Listener{listener: listener}
+}
+
+// ListenPacket creates a new datagram socket bound to address. The
+// events are emitted using the MeasurementRoot in the context.
+func (l *Listener) ListenPacket(
+	ctx context.Context, network, address string,
+) (net.PacketConn, error) {
+	root := modelx.ContextMeasurementRootOrDefault(ctx)
+	start := time.Now()
+	pconn, err := l.listener.ListenPacket(ctx, network, address)
+	stop := time.Now()
+	err = errwrapper.SafeErrWrapperBuilder{
+		Error:     err,
+		Operation: "listen",
+	}.MaybeBuild()
+	var (
+		connID       int64
+		localAddress string
+	)
+	if err == nil {
+		connID = connid.Generate()
+		localAddress = pconn.LocalAddr().String()
+	}
+	root.Handler.OnMeasurement(modelx.Measurement{
+		ListenPacket: &modelx.ListenPacketEvent{
+			ConnID:                 connID,
+			DurationSinceBeginning: stop.Sub(root.Beginning),
+			Error:                  err,
+			LocalAddress:           localAddress,
+			Network:                network,
+			SyscallDuration:        stop.Sub(start),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &connx.MeasuringPacketConn{
+		PacketConn:  pconn,
+		Beginning:   root.Beginning,
+		Handler:     root.Handler,
+		ID:          connID,
+		MaxSnapSize: root.MaxConnSnapSize,
+	}, nil
+}
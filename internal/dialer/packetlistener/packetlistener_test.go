@@ -0,0 +1,91 @@
+package packetlistener
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ooni/netx/internal/dialer/connx"
+	"github.com/ooni/netx/modelx"
+)
+
+type savingHandler struct {
+	mu     sync.Mutex
+	events []modelx.Measurement
+}
+
+func (h *savingHandler) OnMeasurement(m modelx.Measurement) {
+	h.mu.Lock()
+	h.events = append(h.events, m)
+	h.mu.Unlock()
+}
+
+type netListener struct{}
+
+func (netListener) ListenPacket(
+	ctx context.Context, network, address string,
+) (net.PacketConn, error) {
+	return new(net.ListenConfig).ListenPacket(ctx, network, address)
+}
+
+type failingListener struct{}
+
+func (failingListener) ListenPacket(
+	ctx context.Context, network, address string,
+) (net.PacketConn, error) {
+	return nil, errors.New("mocked error")
+}
+
+func newContext(handler modelx.Handler) context.Context {
+	return modelx.WithMeasurementRoot(context.Background(), &modelx.MeasurementRoot{
+		Beginning: time.Now(),
+		Handler:   handler,
+	})
+}
+
+func TestIntegrationSuccess(t *testing.T) {
+	handler := new(savingHandler)
+	pconn, err := New(netListener{}).ListenPacket(
+		newContext(handler), "udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pconn.Close()
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if len(handler.events) != 1 || handler.events[0].ListenPacket == nil {
+		t.Fatal("expected a single ListenPacket event")
+	}
+	ev := handler.events[0].ListenPacket
+	if ev.ConnID == 0 || ev.Error != nil || ev.Network != "udp" {
+		t.Fatal("unexpected ListenPacket event")
+	}
+	if ev.LocalAddress != pconn.LocalAddr().String() {
+		t.Fatal("unexpected local address")
+	}
+	mconn, ok := pconn.(*connx.MeasuringPacketConn)
+	if !ok || mconn.ID != ev.ConnID {
+		t.Fatal("expected a measuring conn with the same ConnID")
+	}
+}
+
+func TestUnitFailure(t *testing.T) {
+	handler := new(savingHandler)
+	pconn, err := New(failingListener{}).ListenPacket(
+		newContext(handler), "udp", "127.0.0.1:0")
+	var wrapper *modelx.ErrWrapper
+	if !errors.As(err, &wrapper) || wrapper.Operation != "listen" {
+		t.Fatal("not the error we expected")
+	}
+	if pconn != nil {
+		t.Fatal("expected nil conn here")
+	}
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if len(handler.events) != 1 || handler.events[0].ListenPacket.Error == nil {
+		t.Fatal("expected a failed ListenPacket event")
+	}
+}
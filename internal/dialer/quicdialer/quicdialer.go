@@ -0,0 +1,261 @@
+// Package quicdialer contains the QUIC dialer
+package quicdialer
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ooni/netx/internal/connid"
+	"github.com/ooni/netx/internal/dialer/connx"
+	"github.com/ooni/netx/internal/dialer/dnsdialer"
+	"github.com/ooni/netx/internal/dialid"
+	"github.com/ooni/netx/internal/errwrapper"
+	"github.com/ooni/netx/internal/tlsx"
+	"github.com/ooni/netx/internal/transactionid"
+	"github.com/ooni/netx/modelx"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+)
+
+// QUICDialer is the QUIC dialer
+type QUICDialer struct {
+	KeyLogEvents         bool             // default: false
+	ListenPacket         ListenPacketFunc // default: net.ListenPacket
+	QUICHandshakeTimeout time.Duration    // default: 10 second
+	config               *tls.Config
+	quicConfig           *quic.Config
+	resolver             modelx.DNSResolver
+}
+
+// ListenPacketFunc creates a datagram socket. When address is empty,
+// the implementation chooses the local address.
+type ListenPacketFunc func(
+	ctx context.Context, network, address string) (net.PacketConn, error)
+
+// New creates a new QUIC dialer. The quicConfig may be nil, in
+// which case we will use the quic-go defaults.
+func New(
+	resolver modelx.DNSResolver, config *tls.Config, quicConfig *quic.Config,
+) *QUICDialer {
+	return &QUICDialer{
+		QUICHandshakeTimeout: 10 * time.Second,
+		config:               config,
+		quicConfig:           quicConfig,
+		resolver:             resolver,
+	}
+}
+
+// DialQUIC dials a new QUIC connection
+func (d *QUICDialer) DialQUIC(address string) (quic.EarlyConnection, error) {
+	return d.DialQUICContext(context.Background(), address)
+}
+
+// DialQUICContext is like DialQUIC, but with context. The returned
+// connection has completed the handshake. Each attempt uses its own
+// datagram socket, which is closed when the connection is closed.
+func (d *QUICDialer) DialQUICContext(
+	ctx context.Context, address string,
+) (quic.EarlyConnection, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ctx = dialid.WithDialID(ctx) // important to create before lookupHost
+	addrs, err := dnsdialer.LookupHost(ctx, d.resolver, host)
+	if err != nil {
+		return nil, err
+	}
+	config := d.config.Clone() // avoid polluting original config
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	var errorslist []error
+	for _, addr := range addrs {
+		target := net.JoinHostPort(addr, port)
+		conn, err := d.dialAddr(ctx, target, config)
+		if err == nil {
+			return conn, nil
+		}
+		errorslist = append(errorslist, err)
+	}
+	return nil, dnsdialer.ReduceErrors(errorslist)
+}
+
+func (d *QUICDialer) listenPacket(ctx context.Context) (net.PacketConn, error) {
+	if d.ListenPacket != nil {
+		return d.ListenPacket(ctx, "udp", "")
+	}
+	return net.ListenPacket("udp", ":0")
+}
+
+func (d *QUICDialer) dialAddr(
+	ctx context.Context, address string, config *tls.Config,
+) (quic.EarlyConnection, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	pconn, err := d.listenPacket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	root := modelx.ContextMeasurementRootOrDefault(ctx)
+	dialID := dialid.ContextDialID(ctx)
+	txID := transactionid.ContextTransactionID(ctx)
+	connID := connid.Generate()
+	mconn := &connx.MeasuringPacketConn{
+		PacketConn:  pconn,
+		Beginning:   root.Beginning,
+		Handler:     root.Handler,
+		ID:          connID,
+		MaxSnapSize: root.MaxConnSnapSize,
+	}
+	if d.KeyLogEvents {
+		config = tlsx.WithKeyLogEvents(config, root, connID, txID)
+	}
+	root.Handler.OnMeasurement(modelx.Measurement{
+		QUICHandshakeStart: &modelx.QUICHandshakeStartEvent{
+			ConnID:                 connID,
+			DialID:                 dialID,
+			DurationSinceBeginning: time.Now().Sub(root.Beginning),
+			LocalAddress:           pconn.LocalAddr().String(),
+			NextProtos:             config.NextProtos,
+			RemoteAddress:          address,
+			SNI:                    config.ServerName,
+			TransactionID:          txID,
+		},
+	})
+	quicConfig, params := withParamsTracer(d.quicConfig)
+	handshakeCtx, cancel := context.WithTimeout(ctx, d.QUICHandshakeTimeout)
+	defer cancel()
+	conn, err := quic.DialEarly(handshakeCtx, mconn, udpAddr, config, quicConfig)
+	if err == nil {
+		err = waitHandshake(handshakeCtx, conn)
+	}
+	err = errwrapper.SafeErrWrapperBuilder{
+		ConnID:        connID,
+		DialID:        dialID,
+		Error:         err,
+		Operation:     "quic_handshake",
+		TransactionID: txID,
+	}.MaybeBuild()
+	var (
+		tlsState tls.ConnectionState
+		version  string
+	)
+	if conn != nil {
+		tlsState = conn.ConnectionState().TLS
+	}
+	if err == nil {
+		version = conn.ConnectionState().Version.String()
+	}
+	state := tlsx.NewConnectionState(
+		config, tlsx.ContextVerificationHook(ctx), config.ServerName,
+		tlsState, err, errwrapper.SafeErrWrapperBuilder{
+			ConnID:        connID,
+			DialID:        dialID,
+			Operation:     "quic_handshake",
+			TransactionID: txID,
+		},
+	)
+	root.Handler.OnMeasurement(modelx.Measurement{
+		QUICHandshakeDone: &modelx.QUICHandshakeDoneEvent{
+			ConnectionState:        state,
+			ConnID:                 connID,
+			DialID:                 dialID,
+			DurationSinceBeginning: time.Now().Sub(root.Beginning),
+			Error:                  err,
+			TransactionID:          txID,
+			TransportParameters:    params.get(),
+			Version:                version,
+		},
+	})
+	if err != nil {
+		if conn != nil {
+			conn.CloseWithError(0, "")
+		}
+		mconn.Close()
+		return nil, err
+	}
+	// quic-go does not close sockets it did not create
+	go func() {
+		<-conn.Context().Done()
+		mconn.Close()
+	}()
+	return conn, nil
+}
+
+func waitHandshake(ctx context.Context, conn quic.EarlyConnection) error {
+	select {
+	case <-conn.HandshakeComplete():
+		return nil
+	case <-conn.Context().Done():
+		return context.Cause(conn.Context())
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type paramsSaver struct {
+	mu     sync.Mutex
+	params *modelx.QUICTransportParameters
+}
+
+func (ps *paramsSaver) get() *modelx.QUICTransportParameters {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.params
+}
+
+func (ps *paramsSaver) save(tp *logging.TransportParameters) {
+	params := &modelx.QUICTransportParameters{
+		AckDelayExponent:                tp.AckDelayExponent,
+		ActiveConnectionIDLimit:         tp.ActiveConnectionIDLimit,
+		DisableActiveMigration:          tp.DisableActiveMigration,
+		InitialMaxData:                  int64(tp.InitialMaxData),
+		InitialMaxStreamDataBidiLocal:   int64(tp.InitialMaxStreamDataBidiLocal),
+		InitialMaxStreamDataBidiRemote:  int64(tp.InitialMaxStreamDataBidiRemote),
+		InitialMaxStreamDataUni:         int64(tp.InitialMaxStreamDataUni),
+		InitialMaxStreamsBidi:           int64(tp.MaxBidiStreamNum),
+		InitialMaxStreamsUni:            int64(tp.MaxUniStreamNum),
+		InitialSourceConnectionID:       tp.InitialSourceConnectionID.Bytes(),
+		MaxAckDelay:                     tp.MaxAckDelay,
+		MaxDatagramFrameSize:            int64(tp.MaxDatagramFrameSize),
+		MaxIdleTimeout:                  tp.MaxIdleTimeout,
+		MaxUDPPayloadSize:               int64(tp.MaxUDPPayloadSize),
+		OriginalDestinationConnectionID: tp.OriginalDestinationConnectionID.Bytes(),
+	}
+	ps.mu.Lock()
+	ps.params = params
+	ps.mu.Unlock()
+}
+
+// withParamsTracer returns a copy of config with a tracer that saves
+// the transport parameters sent by the server, chained with any
+// tracer that was already configured.
+func withParamsTracer(config *quic.Config) (*quic.Config, *paramsSaver) {
+	ps := new(paramsSaver)
+	if config == nil {
+		config = new(quic.Config)
+	}
+	config = config.Clone()
+	orig := config.Tracer
+	config.Tracer = func(
+		ctx context.Context, perspective logging.Perspective,
+		connID quic.ConnectionID,
+	) *logging.ConnectionTracer {
+		tracer := &logging.ConnectionTracer{
+			ReceivedTransportParameters: ps.save,
+		}
+		if orig != nil {
+			if other := orig(ctx, perspective, connID); other != nil {
+				return logging.NewMultiplexedConnectionTracer(other, tracer)
+			}
+		}
+		return tracer
+	}
+	return config, ps
+}
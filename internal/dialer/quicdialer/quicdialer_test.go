@@ -0,0 +1,277 @@
+package quicdialer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ooni/netx/modelx"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+)
+
+type savingHandler struct {
+	mu     sync.Mutex
+	events []modelx.Measurement
+}
+
+func (h *savingHandler) OnMeasurement(m modelx.Measurement) {
+	h.mu.Lock()
+	h.events = append(h.events, m)
+	h.mu.Unlock()
+}
+
+func (h *savingHandler) snapshot() []modelx.Measurement {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]modelx.Measurement{}, h.events...)
+}
+
+// newServer creates a QUIC server reusing the httptest certificate.
+func newServer(t *testing.T) (*quic.Listener, func()) {
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {},
+	))
+	config := server.TLS.Clone()
+	config.NextProtos = []string{"antani"}
+	listener, err := quic.ListenAddr("127.0.0.1:0", config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			<-conn.Context().Done()
+		}
+	}()
+	return listener, func() {
+		listener.Close()
+		server.Close()
+	}
+}
+
+func newContext(handler modelx.Handler) context.Context {
+	return modelx.WithMeasurementRoot(context.Background(), &modelx.MeasurementRoot{
+		Beginning: time.Now(),
+		Handler:   handler,
+	})
+}
+
+func TestIntegrationSuccess(t *testing.T) {
+	listener, cleanup := newServer(t)
+	defer cleanup()
+	handler := new(savingHandler)
+	dialer := New(nil, &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"antani"},
+	}, nil)
+	conn, err := dialer.DialQUICContext(
+		newContext(handler), listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.ConnectionState().TLS.NegotiatedProtocol != "antani" {
+		t.Fatal("unexpected ALPN")
+	}
+	conn.CloseWithError(0, "")
+	var (
+		start     *modelx.QUICHandshakeStartEvent
+		done      *modelx.QUICHandshakeDoneEvent
+		readFrom  int
+		writeTo   int
+		closeSeen bool
+	)
+	deadline := time.Now().Add(5 * time.Second)
+	for !closeSeen && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		start, done, readFrom, writeTo = nil, nil, 0, 0
+		for _, ev := range handler.snapshot() {
+			if ev.QUICHandshakeStart != nil {
+				start = ev.QUICHandshakeStart
+			}
+			if ev.QUICHandshakeDone != nil {
+				done = ev.QUICHandshakeDone
+			}
+			if ev.ReadFrom != nil && ev.ReadFrom.ConnID == start.ConnID {
+				readFrom++
+			}
+			if ev.WriteTo != nil && ev.WriteTo.ConnID == start.ConnID {
+				writeTo++
+			}
+			if ev.Close != nil && ev.Close.ConnID == start.ConnID {
+				closeSeen = true
+			}
+		}
+	}
+	if !closeSeen {
+		t.Fatal("the datagram socket has not been closed")
+	}
+	if start.ConnID == 0 || start.DialID == 0 {
+		t.Fatal("expected nonzero ConnID and DialID")
+	}
+	if start.SNI != "127.0.0.1" || start.RemoteAddress != listener.Addr().String() {
+		t.Fatal("unexpected QUICHandshakeStart fields")
+	}
+	if done.Error != nil || done.ConnID != start.ConnID {
+		t.Fatal("unexpected QUICHandshakeDone fields")
+	}
+	if done.ConnectionState.NegotiatedProtocol != "antani" {
+		t.Fatal("unexpected ALPN in QUICHandshakeDone")
+	}
+	if done.ConnectionState.VerificationError == nil {
+		t.Fatal("expected a verification error with InsecureSkipVerify")
+	}
+	if done.Version != "v1" {
+		t.Fatal("unexpected QUIC version", done.Version)
+	}
+	params := done.TransportParameters
+	if params == nil || len(params.OriginalDestinationConnectionID) <= 0 {
+		t.Fatal("unexpected transport parameters")
+	}
+	if params.MaxDatagramFrameSize != -1 {
+		t.Fatal("expected datagrams to be disabled")
+	}
+	if readFrom < 1 || writeTo < 1 {
+		t.Fatal("expected ReadFrom and WriteTo events")
+	}
+}
+
+func TestIntegrationHandshakeFailure(t *testing.T) {
+	listener, cleanup := newServer(t)
+	defer cleanup()
+	handler := new(savingHandler)
+	dialer := New(nil, &tls.Config{
+		NextProtos: []string{"antani"},
+	}, nil)
+	conn, err := dialer.DialQUICContext(
+		newContext(handler), listener.Addr().String())
+	if err == nil {
+		conn.CloseWithError(0, "")
+		t.Fatal("expected an error here")
+	}
+	var wrapper *modelx.ErrWrapper
+	if !errors.As(err, &wrapper) {
+		t.Fatal("expected a wrapped error")
+	}
+	if wrapper.Operation != "quic_handshake" {
+		t.Fatal("unexpected operation", wrapper.Operation)
+	}
+	if wrapper.Failure != "ssl_unknown_authority" {
+		t.Fatal("unexpected failure", wrapper.Failure)
+	}
+}
+
+func TestIntegrationHandshakeTimeout(t *testing.T) {
+	pconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pconn.Close() // a socket that never replies
+	dialer := New(nil, &tls.Config{NextProtos: []string{"antani"}}, nil)
+	dialer.QUICHandshakeTimeout = 200 * time.Millisecond
+	conn, err := dialer.DialQUIC(pconn.LocalAddr().String())
+	if err == nil {
+		conn.CloseWithError(0, "")
+		t.Fatal("expected an error here")
+	}
+	var wrapper *modelx.ErrWrapper
+	if !errors.As(err, &wrapper) || wrapper.Failure != "generic_timeout_error" {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+func TestUnitFailureSplitHostPort(t *testing.T) {
+	dialer := New(nil, new(tls.Config), nil)
+	conn, err := dialer.DialQUIC("127.0.0.1") // missing port
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if conn != nil {
+		t.Fatal("connection is not nil")
+	}
+}
+
+func TestUnitFailureListenPacket(t *testing.T) {
+	dialer := New(nil, new(tls.Config), nil)
+	dialer.ListenPacket = func(
+		ctx context.Context, network, address string) (net.PacketConn, error) {
+		return nil, errors.New("mocked error")
+	}
+	conn, err := dialer.DialQUIC("127.0.0.1:443")
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if conn != nil {
+		t.Fatal("connection is not nil")
+	}
+}
+
+func TestUnitWithParamsTracerChaining(t *testing.T) {
+	var called bool
+	orig := &quic.Config{
+		Tracer: func(
+			ctx context.Context, perspective logging.Perspective,
+			connID quic.ConnectionID,
+		) *logging.ConnectionTracer {
+			return &logging.ConnectionTracer{
+				ReceivedTransportParameters: func(*logging.TransportParameters) {
+					called = true
+				},
+			}
+		},
+	}
+	config, ps := withParamsTracer(orig)
+	if config == orig {
+		t.Fatal("expected a copy of the config")
+	}
+	tracer := config.Tracer(context.Background(), logging.PerspectiveClient,
+		quic.ConnectionID{})
+	tracer.ReceivedTransportParameters(&logging.TransportParameters{
+		InitialMaxData: 1024,
+	})
+	if !called {
+		t.Fatal("the original tracer has not been called")
+	}
+	if ps.get() == nil || ps.get().InitialMaxData != 1024 {
+		t.Fatal("the transport parameters have not been saved")
+	}
+}
+
+func TestIntegrationKeyLogEvents(t *testing.T) {
+	listener, cleanup := newServer(t)
+	defer cleanup()
+	handler := new(savingHandler)
+	dialer := New(nil, &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"antani"},
+	}, nil)
+	dialer.KeyLogEvents = true
+	conn, err := dialer.DialQUICContext(
+		newContext(handler), listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.CloseWithError(0, "")
+	var connID int64
+	secrets := make(map[int64]int)
+	for _, ev := range handler.snapshot() {
+		if ev.QUICHandshakeDone != nil {
+			connID = ev.QUICHandshakeDone.ConnID
+		}
+		if ev.TLSKeyLog != nil {
+			secrets[ev.TLSKeyLog.ConnID]++
+		}
+	}
+	if connID == 0 || len(secrets) != 1 || secrets[connID] <= 0 {
+		t.Fatal("expected secrets tagged with the ConnID of the handshake")
+	}
+}
@@ -0,0 +1,224 @@
+// Package segmenter splits the first write on a connection into
+// several writes, i.e., TCP segments, to test DPI reassembly.
+package segmenter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ooni/netx/modelx"
+)
+
+// Plan describes how to segment the first write.
+type Plan struct {
+	// Delay is the time to wait between two segments.
+	Delay time.Duration
+
+	// Offsets are the offsets within the first write at which we
+	// should start a new segment. Out of range offsets are ignored.
+	Offsets []int
+
+	// SplitSNI indicates that we should additionally start a new
+	// segment at the beginning and in the middle of the hostname,
+	// which we search inside the SNI extension of a TLS ClientHello
+	// or inside the Host header of a cleartext HTTP request.
+	SplitSNI bool
+}
+
+// Segments returns the sorted offsets at which b must be split
+// according to the plan. The returned offsets are always within
+// the (0, len(b)) open interval and do not contain duplicates.
+func (p *Plan) Segments(b []byte) (out []int) {
+	offsets := append([]int{}, p.Offsets...)
+	if p.SplitSNI {
+		if off, length := findHostname(b); length > 0 {
+			offsets = append(offsets, off, off+length/2)
+		}
+	}
+	sort.Ints(offsets)
+	for _, off := range offsets {
+		if off <= 0 || off >= len(b) {
+			continue
+		}
+		if len(out) > 0 && out[len(out)-1] == off {
+			continue
+		}
+		out = append(out, off)
+	}
+	return
+}
+
+// Conn is a net.Conn that segments the first write according to a
+// plan. You want to wrap a connx.MeasuringConn, such that each segment
+// is also recorded by a WriteEvent.
+type Conn struct {
+	net.Conn
+	Beginning time.Time
+	Handler   modelx.Handler
+	ID        int64
+	Plan      *Plan
+	TxID      int64
+
+	mu       sync.Mutex
+	written  bool
+	deadline time.Time
+}
+
+// SetDeadline sets the read and write deadlines.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.setDeadline(t)
+	return c.Conn.SetDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.setDeadline(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *Conn) setDeadline(t time.Time) {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+}
+
+// sleep waits for the delay between two segments, but not beyond
+// the write deadline, so the next write fails rather than blocking.
+func (c *Conn) sleep() {
+	delay := c.Plan.Delay
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+	if !deadline.IsZero() {
+		if remaining := deadline.Sub(time.Now()); remaining < delay {
+			delay = remaining
+		}
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// Write writes data to the connection.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	first := !c.written
+	c.written = true
+	c.mu.Unlock()
+	if !first {
+		return c.Conn.Write(b)
+	}
+	segments := c.Plan.Segments(b)
+	offsets := make([]int64, 0, len(segments))
+	for _, off := range segments {
+		offsets = append(offsets, int64(off))
+	}
+	c.Handler.OnMeasurement(modelx.Measurement{
+		WriteSegmentation: &modelx.WriteSegmentationEvent{
+			ConnID:                 c.ID,
+			Delay:                  c.Plan.Delay,
+			DurationSinceBeginning: time.Now().Sub(c.Beginning),
+			NumBytes:               int64(len(b)),
+			Offsets:                offsets,
+			TransactionID:          c.TxID,
+		},
+	})
+	var total int
+	for idx, end := range append(segments, len(b)) {
+		if idx > 0 {
+			c.sleep()
+		}
+		n, err := c.Conn.Write(b[total:end])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// findHostname returns the offset and the length of the hostname
+// inside b, or zero length if we cannot find any hostname.
+func findHostname(b []byte) (offset, length int) {
+	if off, length := findSNI(b); length > 0 {
+		return off, length
+	}
+	return findHost(b)
+}
+
+// findSNI parses a TLS record containing a ClientHello and returns
+// the offset and the length of the server_name extension value.
+func findSNI(b []byte) (offset, length int) {
+	const (
+		recordHeaderLen    = 5
+		handshakeHeaderLen = 4
+		contentHandshake   = 22
+		typeClientHello    = 1
+		extServerName      = 0
+		nameTypeHostname   = 0
+	)
+	if len(b) < recordHeaderLen+handshakeHeaderLen ||
+		b[0] != contentHandshake || b[recordHeaderLen] != typeClientHello {
+		return 0, 0
+	}
+	off := recordHeaderLen + handshakeHeaderLen
+	off += 2 + 32 // client version and random
+	skip := func(lenbytes int) bool {
+		if off+lenbytes > len(b) {
+			return false
+		}
+		var n int
+		for _, v := range b[off : off+lenbytes] {
+			n = n<<8 | int(v)
+		}
+		off += lenbytes + n
+		return off <= len(b)
+	}
+	if !skip(1) || !skip(2) || !skip(1) { // session ID, ciphers, compression
+		return 0, 0
+	}
+	if off+2 > len(b) {
+		return 0, 0
+	}
+	off += 2 // extensions length
+	for off+4 <= len(b) {
+		extType := binary.BigEndian.Uint16(b[off:])
+		extLen := int(binary.BigEndian.Uint16(b[off+2:]))
+		off += 4
+		if off+extLen > len(b) {
+			return 0, 0
+		}
+		if extType == extServerName {
+			// list length (2), name type (1), name length (2), name
+			if extLen < 5 || b[off+2] != nameTypeHostname {
+				return 0, 0
+			}
+			nameLen := int(binary.BigEndian.Uint16(b[off+3:]))
+			if off+5+nameLen > len(b) {
+				return 0, 0
+			}
+			return off + 5, nameLen
+		}
+		off += extLen
+	}
+	return 0, 0
+}
+
+// findHost returns the offset and the length of the value of
+// the Host header inside a cleartext HTTP/1.x request.
+func findHost(b []byte) (offset, length int) {
+	idx := bytes.Index(b, []byte("\r\nHost: "))
+	if idx < 0 {
+		return 0, 0
+	}
+	offset = idx + len("\r\nHost: ")
+	length = bytes.Index(b[offset:], []byte("\r\n"))
+	if length < 0 {
+		return 0, 0
+	}
+	return offset, length
+}
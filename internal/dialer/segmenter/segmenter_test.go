@@ -0,0 +1,175 @@
+package segmenter
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ooni/netx/modelx"
+)
+
+func TestUnitSegmentsOffsets(t *testing.T) {
+	plan := &Plan{Offsets: []int{7, 0, 3, 3, 100}}
+	segments := plan.Segments(make([]byte, 10))
+	if !reflect.DeepEqual(segments, []int{3, 7}) {
+		t.Fatal("unexpected segments", segments)
+	}
+}
+
+func TestUnitSegmentsSNI(t *testing.T) {
+	hello := clientHello(t, "www.example.com")
+	plan := &Plan{SplitSNI: true}
+	segments := plan.Segments(hello)
+	if len(segments) != 2 {
+		t.Fatal("unexpected number of segments")
+	}
+	sni := string(hello[segments[0] : segments[0]+len("www.example.com")])
+	if sni != "www.example.com" {
+		t.Fatal("unexpected SNI offset", sni)
+	}
+	if segments[1] != segments[0]+len("www.example.com")/2 {
+		t.Fatal("unexpected second offset")
+	}
+}
+
+func TestUnitSegmentsHost(t *testing.T) {
+	request := []byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n")
+	plan := &Plan{SplitSNI: true}
+	segments := plan.Segments(request)
+	if len(segments) != 2 {
+		t.Fatal("unexpected number of segments")
+	}
+	if string(request[segments[0]:segments[1]]) != "www.exa" {
+		t.Fatal("unexpected segments", segments)
+	}
+}
+
+func TestUnitSegmentsNoHostname(t *testing.T) {
+	plan := &Plan{SplitSNI: true}
+	for _, input := range [][]byte{
+		nil,
+		[]byte("GET / HTTP/1.1\r\n\r\n"),
+		{22, 3, 1, 0, 10, 1, 0, 0, 6, 3},
+	} {
+		if segments := plan.Segments(input); len(segments) != 0 {
+			t.Fatal("expected no segments")
+		}
+	}
+}
+
+func TestUnitConnSegmentsFirstWrite(t *testing.T) {
+	conn := new(recordingConn)
+	handler := new(savingHandler)
+	sconn := &Conn{
+		Conn:    conn,
+		Handler: handler,
+		ID:      17,
+		Plan:    &Plan{Delay: time.Millisecond, Offsets: []int{2, 4}},
+		TxID:    11,
+	}
+	n, err := sconn.Write([]byte("abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 6 {
+		t.Fatal("unexpected number of bytes written")
+	}
+	if _, err := sconn.Write([]byte("ghi")); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(conn.writes, []string{"ab", "cd", "ef", "ghi"}) {
+		t.Fatal("unexpected writes", conn.writes)
+	}
+	if len(handler.events) != 1 {
+		t.Fatal("unexpected number of events")
+	}
+	ev := handler.events[0]
+	if ev.ConnID != 17 || ev.TransactionID != 11 || ev.NumBytes != 6 {
+		t.Fatal("unexpected event fields")
+	}
+	if ev.Delay != time.Millisecond || !reflect.DeepEqual(ev.Offsets, []int64{2, 4}) {
+		t.Fatal("unexpected segmentation plan")
+	}
+}
+
+func TestUnitConnWriteFailure(t *testing.T) {
+	conn := &recordingConn{err: errors.New("mocked error")}
+	sconn := &Conn{
+		Conn:    conn,
+		Handler: new(savingHandler),
+		Plan:    &Plan{Offsets: []int{2}},
+	}
+	n, err := sconn.Write([]byte("abcdef"))
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if n != 0 {
+		t.Fatal("unexpected number of bytes written")
+	}
+	if len(conn.writes) != 1 {
+		t.Fatal("expected to stop after the first failure")
+	}
+}
+
+func TestUnitConnDelayBoundedByDeadline(t *testing.T) {
+	conn := new(recordingConn)
+	sconn := &Conn{
+		Conn:    conn,
+		Handler: new(savingHandler),
+		Plan:    &Plan{Delay: time.Hour, Offsets: []int{2, 4}},
+	}
+	if err := sconn.SetDeadline(time.Now().Add(10 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := sconn.Write([]byte("abcdef")); err != nil {
+		t.Fatal(err)
+	}
+	if time.Now().Sub(start) > time.Second {
+		t.Fatal("the delay did not honour the deadline")
+	}
+	if len(conn.writes) != 3 {
+		t.Fatal("unexpected number of writes")
+	}
+}
+
+// clientHello returns the ClientHello that crypto/tls sends.
+func clientHello(t *testing.T, sni string) []byte {
+	conn := &recordingConn{err: errors.New("stop here")}
+	tls.Client(conn, &tls.Config{ServerName: sni}).Handshake()
+	if len(conn.writes) < 1 {
+		t.Fatal("no ClientHello was written")
+	}
+	return []byte(conn.writes[0])
+}
+
+type recordingConn struct {
+	net.Conn
+	err    error
+	writes []string
+}
+
+func (c *recordingConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.writes = append(c.writes, string(b))
+	if c.err != nil {
+		return 0, c.err
+	}
+	return len(b), nil
+}
+
+type savingHandler struct {
+	events []*modelx.WriteSegmentationEvent
+}
+
+func (h *savingHandler) OnMeasurement(m modelx.Measurement) {
+	if m.WriteSegmentation != nil {
+		h.events = append(h.events, m.WriteSegmentation)
+	}
+}
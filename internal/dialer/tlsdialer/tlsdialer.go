@@ -8,14 +8,20 @@ import (
 	"time"
 
 	"github.com/ooni/netx/internal/dialer/connx"
+	"github.com/ooni/netx/internal/dialer/segmenter"
 	"github.com/ooni/netx/internal/errwrapper"
+	"github.com/ooni/netx/internal/tlsx"
+	"github.com/ooni/netx/internal/transactionid"
 	"github.com/ooni/netx/modelx"
+	utls "github.com/refraction-networking/utls"
 )
 
 // TLSDialer is the TLS dialer
 type TLSDialer struct {
-	ConnectTimeout      time.Duration // default: 30 second
-	TLSHandshakeTimeout time.Duration // default: 10 second
+	ClientHelloID       *utls.ClientHelloID // default: nil, i.e. crypto/tls
+	ConnectTimeout      time.Duration       // default: 30 second
+	KeyLogEvents        bool                // default: false
+	TLSHandshakeTimeout time.Duration       // default: 10 second
 	config              *tls.Config
 	dialer              modelx.Dialer
 	setDeadline         func(net.Conn, time.Time) error
@@ -54,44 +60,68 @@ func (d *TLSDialer) DialTLSContext(
 	if err != nil {
 		return nil, err
 	}
+	var connID int64
+	switch mconn := conn.(type) {
+	case *connx.MeasuringConn:
+		connID = mconn.ID
+	case *segmenter.Conn:
+		connID = mconn.ID
+	}
+	root := modelx.ContextMeasurementRootOrDefault(ctx)
+	txID := transactionid.ContextTransactionID(ctx)
 	config := d.config.Clone() // avoid polluting original config
 	if config.ServerName == "" {
 		config.ServerName = host
 	}
+	if d.KeyLogEvents {
+		config = tlsx.WithKeyLogEvents(config, root, connID, txID)
+	}
 	err = d.setDeadline(conn, time.Now().Add(d.TLSHandshakeTimeout))
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
-	tlsconn := tls.Client(conn, config)
-	var connID int64
-	if mconn, ok := conn.(*connx.MeasuringConn); ok {
-		connID = mconn.ID
+	tlsconn, err := d.newConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
 	}
-	root := modelx.ContextMeasurementRootOrDefault(ctx)
 	// Implementation note: when DialTLS is not set, the code in
 	// net/http will perform the handshake. Otherwise, if DialTLS
 	// is set, we will end up here. This code is still used when
 	// performing non-HTTP TLS-enabled dial operations.
 	root.Handler.OnMeasurement(modelx.Measurement{
 		TLSHandshakeStart: &modelx.TLSHandshakeStartEvent{
+			ClientHelloFingerprint: d.clientHelloFingerprint(),
 			ConnID:                 connID,
 			DurationSinceBeginning: time.Now().Sub(root.Beginning),
 			SNI:                    config.ServerName,
+			TransactionID:          txID,
 		},
 	})
 	err = tlsconn.Handshake()
 	err = errwrapper.SafeErrWrapperBuilder{
-		ConnID:    connID,
-		Error:     err,
-		Operation: "tls_handshake",
+		ConnID:        connID,
+		Error:         err,
+		Operation:     "tls_handshake",
+		TransactionID: txID,
 	}.MaybeBuild()
+	state := tlsx.NewConnectionState(
+		config, tlsx.ContextVerificationHook(ctx), config.ServerName,
+		tlsconn.ConnectionState(), err,
+		errwrapper.SafeErrWrapperBuilder{
+			ConnID:        connID,
+			Operation:     "tls_handshake",
+			TransactionID: txID,
+		},
+	)
 	root.Handler.OnMeasurement(modelx.Measurement{
 		TLSHandshakeDone: &modelx.TLSHandshakeDoneEvent{
 			ConnID:                 connID,
-			ConnectionState:        modelx.NewTLSConnectionState(tlsconn.ConnectionState()),
+			ConnectionState:        state,
 			Error:                  err,
 			DurationSinceBeginning: time.Now().Sub(root.Beginning),
+			TransactionID:          txID,
 		},
 	})
 	conn.SetDeadline(time.Time{}) // clear deadline
@@ -99,5 +129,32 @@ func (d *TLSDialer) DialTLSContext(
 		conn.Close()
 		return nil, err
 	}
+	if root.PlaintextHook != nil {
+		return &connx.PlaintextConn{
+			Conn: tlsconn,
+			Hook: root.PlaintextHook,
+			ID:   connID,
+		}, nil
+	}
 	return tlsconn, err
 }
+
+type tlsConn interface {
+	net.Conn
+	ConnectionState() tls.ConnectionState
+	Handshake() error
+}
+
+func (d *TLSDialer) newConn(conn net.Conn, config *tls.Config) (tlsConn, error) {
+	if d.ClientHelloID == nil {
+		return tls.Client(conn, config), nil
+	}
+	return newUTLSConn(conn, config, d.ClientHelloID)
+}
+
+func (d *TLSDialer) clientHelloFingerprint() (s string) {
+	if d.ClientHelloID != nil {
+		s = d.ClientHelloID.Str()
+	}
+	return
+}
@@ -0,0 +1,89 @@
+package tlsdialer
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+var clientHelloIDs = map[string]*utls.ClientHelloID{
+	"chrome":     &utls.HelloChrome_Auto,
+	"firefox":    &utls.HelloFirefox_Auto,
+	"ios":        &utls.HelloIOS_Auto,
+	"randomized": &utls.HelloRandomized,
+}
+
+// LookupClientHelloID returns the ClientHello fingerprint with the
+// given name. The empty name and "golang" mean that we should use
+// crypto/tls, which is indicated by returning a nil pointer.
+func LookupClientHelloID(name string) (*utls.ClientHelloID, error) {
+	if name == "" || name == "golang" {
+		return nil, nil
+	}
+	id, ok := clientHelloIDs[name]
+	if !ok {
+		return nil, errors.New("tlsdialer: unknown ClientHello fingerprint")
+	}
+	return id, nil
+}
+
+// utlsConn adapts an *utls.UConn to the crypto/tls API we use.
+type utlsConn struct {
+	*utls.UConn
+	serverName string
+}
+
+func newUTLSConn(
+	conn net.Conn, config *tls.Config, id *utls.ClientHelloID,
+) (*utlsConn, error) {
+	uconfig := &utls.Config{
+		InsecureSkipVerify:     config.InsecureSkipVerify,
+		KeyLogWriter:           config.KeyLogWriter,
+		MaxVersion:             config.MaxVersion,
+		MinVersion:             config.MinVersion,
+		NextProtos:             config.NextProtos,
+		RootCAs:                config.RootCAs,
+		ServerName:             config.ServerName,
+		SessionTicketsDisabled: config.SessionTicketsDisabled,
+		Time:                   config.Time,
+		VerifyPeerCertificate:  config.VerifyPeerCertificate,
+	}
+	uconn := utls.UClient(conn, uconfig, *id)
+	// The parroted ClientHello includes the ALPN protocols used by the
+	// browser. If the user has configured specific protocols, we must
+	// honour them, e.g., because we are using DNS over TLS. So we build
+	// the ClientHello and then we edit the ALPN extension, which is
+	// preserved by Handshake.
+	if len(config.NextProtos) > 0 {
+		if err := uconn.BuildHandshakeState(); err != nil {
+			return nil, err
+		}
+		for _, ext := range uconn.Extensions {
+			if alpn, ok := ext.(*utls.ALPNExtension); ok {
+				alpn.AlpnProtocols = config.NextProtos
+			}
+		}
+	}
+	return &utlsConn{UConn: uconn, serverName: config.ServerName}, nil
+}
+
+// ConnectionState returns the crypto/tls connection state.
+func (c *utlsConn) ConnectionState() tls.ConnectionState {
+	s := c.UConn.ConnectionState()
+	return tls.ConnectionState{
+		CipherSuite:                 s.CipherSuite,
+		DidResume:                   s.DidResume,
+		HandshakeComplete:           s.HandshakeComplete,
+		NegotiatedProtocol:          s.NegotiatedProtocol,
+		NegotiatedProtocolIsMutual:  s.NegotiatedProtocolIsMutual,
+		OCSPResponse:                s.OCSPResponse,
+		PeerCertificates:            s.PeerCertificates,
+		ServerName:                  c.serverName, // uTLS only sets it for servers
+		SignedCertificateTimestamps: s.SignedCertificateTimestamps,
+		TLSUnique:                   s.TLSUnique,
+		VerifiedChains:              s.VerifiedChains,
+		Version:                     s.Version,
+	}
+}
@@ -0,0 +1,92 @@
+package tlsdialer
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ooni/netx/internal/dialer/dialerbase"
+	"github.com/ooni/netx/modelx"
+	utls "github.com/refraction-networking/utls"
+)
+
+func TestUnitLookupClientHelloID(t *testing.T) {
+	for _, name := range []string{"", "golang"} {
+		id, err := LookupClientHelloID(name)
+		if err != nil || id != nil {
+			t.Fatal("expected nil ID and nil error")
+		}
+	}
+	id, err := LookupClientHelloID("chrome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != &utls.HelloChrome_Auto {
+		t.Fatal("unexpected ClientHelloID")
+	}
+	id, err = LookupClientHelloID("netscape")
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if id != nil {
+		t.Fatal("expected nil ID")
+	}
+}
+
+type savingHandler struct {
+	starts []*modelx.TLSHandshakeStartEvent
+	dones  []*modelx.TLSHandshakeDoneEvent
+}
+
+func (h *savingHandler) OnMeasurement(m modelx.Measurement) {
+	if m.TLSHandshakeStart != nil {
+		h.starts = append(h.starts, m.TLSHandshakeStart)
+	}
+	if m.TLSHandshakeDone != nil {
+		h.dones = append(h.dones, m.TLSHandshakeDone)
+	}
+}
+
+func TestIntegrationParrotClientHello(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {},
+	))
+	defer server.Close()
+	handler := new(savingHandler)
+	ctx := modelx.WithMeasurementRoot(context.Background(), &modelx.MeasurementRoot{
+		Beginning: time.Now(),
+		Handler:   handler,
+	})
+	dialer := New(
+		dialerbase.New(time.Now(), handler, new(net.Dialer), 17),
+		&tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"http/1.1"},
+		},
+	)
+	dialer.ClientHelloID = &utls.HelloFirefox_Auto
+	address := strings.TrimPrefix(server.URL, "https://")
+	conn, err := dialer.DialTLSContext(ctx, "tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if len(handler.starts) != 1 || len(handler.dones) != 1 {
+		t.Fatal("unexpected number of TLS events")
+	}
+	if !strings.HasPrefix(handler.starts[0].ClientHelloFingerprint, "Firefox-") {
+		t.Fatal("unexpected ClientHelloFingerprint")
+	}
+	state := handler.dones[0].ConnectionState
+	if state.NegotiatedProtocol != "http/1.1" {
+		t.Fatal("unexpected NegotiatedProtocol")
+	}
+	if len(state.PeerCertificates) < 1 {
+		t.Fatal("expected peer certificates")
+	}
+}
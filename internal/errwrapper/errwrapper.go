@@ -8,6 +8,8 @@ import (
 	"strings"
 
 	"github.com/ooni/netx/modelx"
+	"github.com/quic-go/quic-go"
+	"golang.org/x/net/http2"
 )
 
 // SafeErrWrapperBuilder contains a builder for modelx.ErrWrapper that
@@ -58,6 +60,13 @@ func toFailureString(err error) string {
 		return "dns_bogon_error" // not in MK
 	}
 
+	if errors.Is(err, modelx.ErrTLSPinning) {
+		return "ssl_pinning_error" // not in MK
+	}
+	if errors.Is(err, modelx.ErrTLSCustomVerification) {
+		return "ssl_custom_verification_error" // not in MK
+	}
+
 	var x509HostnameError x509.HostnameError
 	if errors.As(err, &x509HostnameError) {
 		// Test case: https://wrong.host.badssl.com/
@@ -75,6 +84,20 @@ func toFailureString(err error) string {
 		return "ssl_invalid_certificate"
 	}
 
+	var http2StreamError http2.StreamError
+	if errors.As(err, &http2StreamError) {
+		return "http2_stream_reset" // not in MK
+	}
+
+	var quicIdleTimeoutError *quic.IdleTimeoutError
+	if errors.As(err, &quicIdleTimeoutError) {
+		return "generic_timeout_error"
+	}
+	var quicHandshakeTimeoutError *quic.HandshakeTimeoutError
+	if errors.As(err, &quicHandshakeTimeoutError) {
+		return "generic_timeout_error"
+	}
+
 	s := err.Error()
 	if strings.HasSuffix(s, "EOF") {
 		return "eof_error"
@@ -115,6 +138,12 @@ func toOperationString(err error, operation string) string {
 		if errwrapper.Operation == "http_round_trip" {
 			return errwrapper.Operation
 		}
+		if errwrapper.Operation == "listen" {
+			return errwrapper.Operation
+		}
+		if errwrapper.Operation == "quic_handshake" {
+			return errwrapper.Operation
+		}
 		if errwrapper.Operation == "resolve" {
 			return errwrapper.Operation
 		}
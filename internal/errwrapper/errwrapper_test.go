@@ -4,12 +4,15 @@ import (
 	"context"
 	"crypto/x509"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"syscall"
 	"testing"
 
 	"github.com/ooni/netx/modelx"
+	"github.com/quic-go/quic-go"
+	"golang.org/x/net/http2"
 )
 
 func TestMaybeBuildFactory(t *testing.T) {
@@ -52,6 +55,17 @@ func TestToFailureString(t *testing.T) {
 			t.Fatal("unexpected result")
 		}
 	})
+	t.Run("for modelx.ErrTLSPinning", func(t *testing.T) {
+		if toFailureString(modelx.ErrTLSPinning) != "ssl_pinning_error" {
+			t.Fatal("unexpected result")
+		}
+	})
+	t.Run("for wrapped modelx.ErrTLSCustomVerification", func(t *testing.T) {
+		err := fmt.Errorf("%w: %s", modelx.ErrTLSCustomVerification, "antani")
+		if toFailureString(err) != "ssl_custom_verification_error" {
+			t.Fatal("unexpected result")
+		}
+	})
 	t.Run("for x509.HostnameError", func(t *testing.T) {
 		var err x509.HostnameError
 		if toFailureString(err) != "ssl_invalid_hostname" {
@@ -113,6 +127,22 @@ func TestToFailureString(t *testing.T) {
 			t.Fatal("unexpected results")
 		}
 	})
+	t.Run("for QUIC timeout errors", func(t *testing.T) {
+		if toFailureString(&quic.IdleTimeoutError{}) != "generic_timeout_error" {
+			t.Fatal("unexpected results")
+		}
+		if toFailureString(&quic.HandshakeTimeoutError{}) != "generic_timeout_error" {
+			t.Fatal("unexpected results")
+		}
+	})
+	t.Run("for HTTP/2 stream reset", func(t *testing.T) {
+		err := fmt.Errorf("wrapped: %w", http2.StreamError{
+			StreamID: 1, Code: http2.ErrCodeRefusedStream,
+		})
+		if toFailureString(err) != "http2_stream_reset" {
+			t.Fatal("unexpected results")
+		}
+	})
 	t.Run("for no such host", func(t *testing.T) {
 		if toFailureString(&net.DNSError{
 			Err: "no such host",
@@ -139,6 +169,22 @@ func TestUnitToOperationString(t *testing.T) {
 			t.Fatal("unexpected result")
 		}
 	})
+	t.Run("for listen", func(t *testing.T) {
+		// You're creating a datagram socket and it fails. You want
+		// to know that listen failed.
+		err := &modelx.ErrWrapper{Operation: "listen"}
+		if toOperationString(err, "quic_handshake") != "listen" {
+			t.Fatal("unexpected result")
+		}
+	})
+	t.Run("for quic_handshake", func(t *testing.T) {
+		// You're doing HTTP/3 and the QUIC handshake fails. You want
+		// to know about a QUIC handshake error.
+		err := &modelx.ErrWrapper{Operation: "quic_handshake"}
+		if toOperationString(err, "http_round_trip") != "quic_handshake" {
+			t.Fatal("unexpected result")
+		}
+	})
 	t.Run("for resolve", func(t *testing.T) {
 		// You're doing HTTP and the DNS fails. You want to
 		// know that resolve failed.
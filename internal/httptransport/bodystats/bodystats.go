@@ -0,0 +1,158 @@
+// Package bodystats computes statistics about the response bodies while
+// they are streamed, which is an alternative to emitting an event for
+// each read, as bodytracer does by default.
+package bodystats
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ooni/netx/modelx"
+)
+
+type intervalContextKey struct{}
+
+// WithInterval returns a copy of ctx telling the HTTP code to compute
+// body statistics sampling the progress every interval. A zero or
+// negative interval means that we should not compute statistics.
+func WithInterval(ctx context.Context, interval time.Duration) context.Context {
+	return context.WithValue(ctx, intervalContextKey{}, interval)
+}
+
+// ContextInterval returns the interval configured in ctx, if any,
+// otherwise zero, meaning that we should not compute statistics.
+func ContextInterval(ctx context.Context) time.Duration {
+	interval, _ := ctx.Value(intervalContextKey{}).(time.Duration)
+	return interval
+}
+
+// Collector collects the statistics of a single response body.
+type Collector struct {
+	beginning time.Time
+	complete  bool
+	err       error
+	firstByte time.Time
+	hash      hash.Hash
+	interval  time.Duration
+	last      time.Time
+	mu        sync.Mutex
+	samples   []modelx.HTTPBodySample
+	size      int64
+	start     time.Time
+}
+
+// NewCollector creates a new Collector. The beginning argument is
+// the "zero" time and the round trip starts when you call this function.
+func NewCollector(beginning time.Time, interval time.Duration) *Collector {
+	return &Collector{
+		beginning: beginning,
+		hash:      sha256.New(),
+		interval:  interval,
+		start:     time.Now(),
+	}
+}
+
+type collectorContextKey struct{}
+
+// WithCollector returns a copy of ctx with the collector set. A nil
+// collector hides the collector that ctx may already contain, which
+// is what we want for nested round trips, e.g., DoH.
+func WithCollector(ctx context.Context, collector *Collector) context.Context {
+	return context.WithValue(ctx, collectorContextKey{}, collector)
+}
+
+// ContextCollector returns the collector in ctx, if any, or nil.
+func ContextCollector(ctx context.Context) *Collector {
+	collector, _ := ctx.Value(collectorContextKey{}).(*Collector)
+	return collector
+}
+
+// FirstByte records that we have received the first response byte.
+func (c *Collector) FirstByte() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.firstByte.IsZero() {
+		c.firstByte = time.Now()
+	}
+}
+
+// Wrap wraps body such that reading from it updates the statistics. You
+// should wrap the body before anyone else reads from it. Because not all
+// transports tell us about the first response byte, when we do not
+// know it yet, we assume that we have just received it.
+func (c *Collector) Wrap(body io.ReadCloser) io.ReadCloser {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.firstByte.IsZero() {
+		c.firstByte = now
+	}
+	c.last = now
+	return &bodyWrapper{ReadCloser: body, collector: c}
+}
+
+type bodyWrapper struct {
+	io.ReadCloser
+	collector *Collector
+}
+
+func (bw *bodyWrapper) Read(b []byte) (n int, err error) {
+	n, err = bw.ReadCloser.Read(b)
+	bw.collector.update(b[:n], err)
+	return
+}
+
+func (c *Collector) update(data []byte, err error) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hash.Write(data)
+	c.size += int64(len(data))
+	switch {
+	case err == io.EOF:
+		if !c.complete {
+			c.complete = true
+			c.sample(now)
+		}
+	case err != nil:
+		if c.err == nil {
+			c.err = err
+		}
+	case now.Sub(c.last) >= c.interval:
+		c.sample(now)
+	}
+}
+
+func (c *Collector) sample(now time.Time) {
+	c.last = now
+	c.samples = append(c.samples, modelx.HTTPBodySample{
+		Bytes:                  c.size,
+		DurationSinceBeginning: now.Sub(c.beginning),
+	})
+}
+
+// Stats returns the statistics collected so far, or nil if
+// the collector is nil, which makes calling it always safe.
+func (c *Collector) Stats() *modelx.HTTPBodyStats {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := &modelx.HTTPBodyStats{
+		Complete: c.complete,
+		Error:    c.err,
+		SHA256:   hex.EncodeToString(c.hash.Sum(nil)),
+		Samples:  append([]modelx.HTTPBodySample(nil), c.samples...),
+		Size:     c.size,
+	}
+	if !c.firstByte.IsZero() {
+		stats.TimeToFirstByte = c.firstByte.Sub(c.start)
+	}
+	return stats
+}
@@ -0,0 +1,104 @@
+package bodystats
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+type slowReader struct {
+	chunks []string
+}
+
+func (r *slowReader) Read(b []byte) (int, error) {
+	if len(r.chunks) <= 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(5 * time.Millisecond)
+	n := copy(b, r.chunks[0])
+	r.chunks = r.chunks[1:]
+	return n, nil
+}
+
+func TestCollector(t *testing.T) {
+	collector := NewCollector(time.Now(), time.Millisecond)
+	collector.FirstByte()
+	body := collector.Wrap(ioutil.NopCloser(
+		&slowReader{chunks: []string{"abc", "def", "ghi"}}))
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body.Close()
+	stats := collector.Stats()
+	sum := sha256.Sum256(data)
+	if stats.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Fatal("unexpected SHA256")
+	}
+	if stats.Size != 9 || !stats.Complete || stats.Error != nil {
+		t.Fatal("unexpected stats", stats)
+	}
+	if len(stats.Samples) != 4 {
+		t.Fatal("unexpected number of samples", len(stats.Samples))
+	}
+	last := stats.Samples[len(stats.Samples)-1]
+	if last.Bytes != 9 {
+		t.Fatal("unexpected last sample", last)
+	}
+	if stats.TimeToFirstByte <= 0 {
+		t.Fatal("unexpected time to first byte")
+	}
+}
+
+func TestCollectorError(t *testing.T) {
+	expected := errors.New("mocked error")
+	collector := NewCollector(time.Now(), time.Hour)
+	body := collector.Wrap(ioutil.NopCloser(
+		io.MultiReader(strings.NewReader("abc"), &failingReader{expected})))
+	if _, err := ioutil.ReadAll(body); !errors.Is(err, expected) {
+		t.Fatal("not the error we expected", err)
+	}
+	stats := collector.Stats()
+	if stats.Complete || stats.Error != expected || stats.Size != 3 {
+		t.Fatal("unexpected stats", stats)
+	}
+	if len(stats.Samples) != 0 {
+		t.Fatal("unexpected samples", stats.Samples)
+	}
+}
+
+type failingReader struct {
+	err error
+}
+
+func (r *failingReader) Read(b []byte) (int, error) {
+	return 0, r.err
+}
+
+func TestNilCollector(t *testing.T) {
+	var collector *Collector
+	if collector.Stats() != nil {
+		t.Fatal("expected nil stats")
+	}
+}
+
+func TestContext(t *testing.T) {
+	ctx := context.Background()
+	if ContextInterval(ctx) != 0 || ContextCollector(ctx) != nil {
+		t.Fatal("unexpected values in empty context")
+	}
+	collector := NewCollector(time.Now(), time.Second)
+	ctx = WithCollector(WithInterval(ctx, time.Second), collector)
+	if ContextInterval(ctx) != time.Second || ContextCollector(ctx) != collector {
+		t.Fatal("unexpected values in context")
+	}
+	if ContextCollector(WithCollector(ctx, nil)) != nil {
+		t.Fatal("nil collector does not hide previous collector")
+	}
+}
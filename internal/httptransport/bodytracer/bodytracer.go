@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/ooni/netx/internal/httptransport/bodystats"
 	"github.com/ooni/netx/internal/transactionid"
 	"github.com/ooni/netx/modelx"
 )
@@ -25,6 +26,15 @@ func New(roundTripper http.RoundTripper) *Transport {
 // RoundTrip executes a single HTTP transaction, returning
 // a Response for the provided Request.
 func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	root := modelx.ContextMeasurementRootOrDefault(req.Context())
+	// When we're computing body statistics, the code below us wraps
+	// the body with the collector before reading from it, and we emit
+	// the statistics rather than the HTTPResponseBodyPart events.
+	var collector *bodystats.Collector
+	if interval := bodystats.ContextInterval(req.Context()); interval > 0 {
+		collector = bodystats.NewCollector(root.Beginning, interval)
+	}
+	req = req.WithContext(bodystats.WithCollector(req.Context(), collector))
 	resp, err = t.roundTripper.RoundTrip(req)
 	if err != nil {
 		return
@@ -34,7 +44,8 @@ func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 	//  a zero-length body." (from the docs)
 	resp.Body = &bodyWrapper{
 		ReadCloser: resp.Body,
-		root:       modelx.ContextMeasurementRootOrDefault(req.Context()),
+		collector:  collector,
+		root:       root,
 		tid:        transactionid.ContextTransactionID(req.Context()),
 	}
 	return
@@ -53,12 +64,16 @@ func (t *Transport) CloseIdleConnections() {
 
 type bodyWrapper struct {
 	io.ReadCloser
-	root *modelx.MeasurementRoot
-	tid  int64
+	collector *bodystats.Collector
+	root      *modelx.MeasurementRoot
+	tid       int64
 }
 
 func (bw *bodyWrapper) Read(b []byte) (n int, err error) {
 	n, err = bw.ReadCloser.Read(b)
+	if bw.collector != nil {
+		return
+	}
 	bw.root.Handler.OnMeasurement(modelx.Measurement{
 		HTTPResponseBodyPart: &modelx.HTTPResponseBodyPartEvent{
 			// "Read reads up to len(p) bytes into p. It returns the number of
@@ -76,6 +91,7 @@ func (bw *bodyWrapper) Close() (err error) {
 	err = bw.ReadCloser.Close()
 	bw.root.Handler.OnMeasurement(modelx.Measurement{
 		HTTPResponseDone: &modelx.HTTPResponseDoneEvent{
+			BodyStats:              bw.collector.Stats(),
 			DurationSinceBeginning: time.Now().Sub(bw.root.Beginning),
 			TransactionID:          bw.tid,
 		},
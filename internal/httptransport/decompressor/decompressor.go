@@ -0,0 +1,144 @@
+// Package decompressor removes the content encoding of response bodies.
+// We need it because we disable the net/http transparent decompression
+// to observe the bytes that are actually sent on the wire.
+package decompressor
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// AcceptEncoding is the Accept-Encoding header we send when we're
+// decompressing and the request does not already contain it.
+const AcceptEncoding = "gzip, deflate, br"
+
+type contextKey struct{}
+
+// WithEnabled returns a copy of ctx telling the HTTP code
+// whether it should decompress the response bodies.
+func WithEnabled(ctx context.Context, enabled bool) context.Context {
+	return context.WithValue(ctx, contextKey{}, enabled)
+}
+
+// ContextEnabled returns whether ctx tells the HTTP code
+// that it should decompress the response bodies.
+func ContextEnabled(ctx context.Context) bool {
+	enabled, _ := ctx.Value(contextKey{}).(bool)
+	return enabled
+}
+
+// parse parses the value of the Content-Encoding header and returns the
+// encodings in the order in which they have been applied. It returns
+// false if we don't support at least one of them.
+func parse(contentEncoding string) ([]string, bool) {
+	var out []string
+	for _, entry := range strings.Split(contentEncoding, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch entry {
+		case "", "identity":
+		case "br", "deflate", "gzip", "x-gzip":
+			out = append(out, entry)
+		default:
+			return nil, false
+		}
+	}
+	return out, len(out) > 0
+}
+
+// Supported returns whether the Content-Encoding header value indicates
+// that the body is encoded and whether we know how to decode it.
+func Supported(contentEncoding string) bool {
+	_, ok := parse(contentEncoding)
+	return ok
+}
+
+// NewReader returns a reader that decodes r according to the value
+// of the Content-Encoding header. We only start decoding on the first
+// read, so that we don't block and we don't fail with empty bodies,
+// e.g., responses to HEAD requests. If we don't support the encoding,
+// the returned reader does not decode r.
+func NewReader(contentEncoding string, r io.Reader) io.Reader {
+	encodings, ok := parse(contentEncoding)
+	if !ok {
+		return r
+	}
+	return &reader{encodings: encodings, source: r}
+}
+
+type reader struct {
+	decoded   io.Reader
+	encodings []string
+	err       error
+	source    io.Reader
+}
+
+func (r *reader) Read(b []byte) (int, error) {
+	if r.decoded == nil && r.err == nil {
+		r.decoded, r.err = newDecoder(r.encodings, r.source)
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	return r.decoded.Read(b)
+}
+
+func newDecoder(encodings []string, r io.Reader) (io.Reader, error) {
+	// The encodings are listed in the order in which they have been
+	// applied, hence we need to remove them in the reverse order.
+	for i := len(encodings) - 1; i >= 0; i-- {
+		var err error
+		switch encodings[i] {
+		case "br":
+			r = brotli.NewReader(r)
+		case "deflate":
+			r, err = newDeflateReader(r)
+		default:
+			r, err = gzip.NewReader(r)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// newDeflateReader returns a reader for the deflate encoding, which
+// should use the zlib format, while some servers instead send raw
+// deflate data. So, we check whether there is a zlib header.
+func newDeflateReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(2)
+	if err != nil && len(header) <= 0 {
+		return nil, err
+	}
+	if len(header) == 2 && header[0]&0x0f == 8 &&
+		(uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+// NewBody is like NewReader but for a response body. Closing the
+// returned body closes the original body.
+func NewBody(contentEncoding string, body io.ReadCloser) io.ReadCloser {
+	return &bodyWrapper{
+		Reader: NewReader(contentEncoding, body),
+		closer: body,
+	}
+}
+
+type bodyWrapper struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (bw *bodyWrapper) Close() error {
+	return bw.closer.Close()
+}
@@ -0,0 +1,117 @@
+package decompressor
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+const plaintext = "Hello, world! Hello, world! Hello, world!"
+
+func encode(t *testing.T, encoding string, data []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "br":
+		w = brotli.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "rawdeflate":
+		var err error
+		if w, err = flate.NewWriter(&buf, flate.DefaultCompression); err != nil {
+			t.Fatal(err)
+		}
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	default:
+		t.Fatal("unknown encoding", encoding)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestNewReader(t *testing.T) {
+	var table = []struct {
+		header string
+		data   []byte
+	}{
+		{"gzip", encode(t, "gzip", []byte(plaintext))},
+		{"X-Gzip", encode(t, "gzip", []byte(plaintext))},
+		{"deflate", encode(t, "deflate", []byte(plaintext))},
+		{"deflate", encode(t, "rawdeflate", []byte(plaintext))},
+		{"br", encode(t, "br", []byte(plaintext))},
+		{"deflate, gzip", encode(t, "gzip", encode(t, "deflate", []byte(plaintext)))},
+		{"identity, br", encode(t, "br", []byte(plaintext))},
+	}
+	for _, entry := range table {
+		if !Supported(entry.header) {
+			t.Fatal("not supported", entry.header)
+		}
+		data, err := ioutil.ReadAll(NewReader(entry.header, bytes.NewReader(entry.data)))
+		if err != nil {
+			t.Fatal(entry.header, err)
+		}
+		if string(data) != plaintext {
+			t.Fatal("unexpected data", entry.header, string(data))
+		}
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	for _, header := range []string{"", "identity", "compress", "gzip, zstd"} {
+		if Supported(header) {
+			t.Fatal("should not be supported", header)
+		}
+		r := strings.NewReader(plaintext)
+		if NewReader(header, r) != r {
+			t.Fatal("expected the original reader", header)
+		}
+	}
+}
+
+func TestEmptyBody(t *testing.T) {
+	for _, header := range []string{"gzip", "deflate", "br"} {
+		data, err := ioutil.ReadAll(NewReader(header, bytes.NewReader(nil)))
+		if err != nil || len(data) != 0 {
+			t.Fatal("unexpected result", header, err, data)
+		}
+	}
+}
+
+func TestNewBody(t *testing.T) {
+	body := NewBody("gzip", ioutil.NopCloser(
+		bytes.NewReader(encode(t, "gzip", []byte(plaintext)))))
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := body.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != plaintext {
+		t.Fatal("unexpected data", string(data))
+	}
+}
+
+func TestContext(t *testing.T) {
+	ctx := context.Background()
+	if ContextEnabled(ctx) {
+		t.Fatal("should not be enabled")
+	}
+	if !ContextEnabled(WithEnabled(ctx, true)) {
+		t.Fatal("should be enabled")
+	}
+}
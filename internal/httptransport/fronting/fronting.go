@@ -0,0 +1,133 @@
+// Package fronting contains a round tripper that honours the
+// modelx.Fronting configured in the request context.
+package fronting
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/ooni/netx/internal/httptransport/h2transport"
+	"github.com/ooni/netx/modelx"
+)
+
+// Transport performs the requests whose context contains a Fronting
+// using a single use clone of the TCP transport. All the other requests
+// are performed using the next round tripper.
+type Transport struct {
+	next http.RoundTripper
+	pool *h2transport.Pool
+	tcp  *http.Transport
+}
+
+// New creates a new Transport. The pool is the HTTP/2 pool of tcp, if
+// any, and we use it to know whether we should emit frame events and
+// to speak HTTP/2 over the conns adopted by the dialer.
+func New(
+	tcp *http.Transport, pool *h2transport.Pool, next http.RoundTripper,
+) *Transport {
+	return &Transport{next: next, pool: pool, tcp: tcp}
+}
+
+// Address returns the address we should connect to when the address
+// configured in the Fronting is front and the original address, or the
+// host in the URL, is address. If front is empty, we return address. If
+// front does not contain a port, we use the one in address, if any.
+func Address(front, address string) string {
+	if front == "" {
+		return address
+	}
+	if _, _, err := net.SplitHostPort(front); err == nil {
+		return front
+	}
+	front = strings.Trim(front, "[]")
+	if _, port, err := net.SplitHostPort(address); err == nil && port != "" {
+		return net.JoinHostPort(front, port)
+	}
+	if strings.Contains(front, ":") {
+		return "[" + front + "]" // IPv6 address without port
+	}
+	return front
+}
+
+// Effective returns the effective values of fronting for req. The
+// config is the TLS config net/http is going to use, if known. We
+// only fill the SNI when the URL scheme is https.
+func Effective(
+	req *http.Request, fronting *modelx.Fronting, config *tls.Config,
+) *modelx.Fronting {
+	out := &modelx.Fronting{
+		Address: Address(fronting.Address, req.URL.Host),
+		Host:    fronting.Host,
+	}
+	if out.Host == "" {
+		out.Host = req.Host
+	}
+	if out.Host == "" {
+		out.Host = req.URL.Host
+	}
+	if req.URL.Scheme == "https" {
+		switch {
+		case fronting.SNI != "":
+			out.SNI = fronting.SNI
+		case config != nil && config.ServerName != "":
+			out.SNI = config.ServerName
+		default:
+			out.SNI = req.URL.Hostname()
+		}
+	}
+	return out
+}
+
+// TLSClientConfig returns the TLS config used for handshakes.
+func (t *Transport) TLSClientConfig() *tls.Config {
+	return t.tcp.TLSClientConfig
+}
+
+// RoundTrip executes a single HTTP transaction, returning
+// a Response for the provided Request. Note that we always use
+// HTTP over TCP when the request context contains a Fronting.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	fronting := modelx.ContextFronting(req.Context())
+	if fronting == nil {
+		return h2transport.RoundTrip(t.pool, t.next, req)
+	}
+	effective := Effective(req, fronting, t.tcp.TLSClientConfig)
+	// The connections are keyed by the host in the URL, which will be
+	// the front address, while they also depend on the SNI. So, we do
+	// not share connections with other requests. Also, the clone would
+	// otherwise upgrade to HTTP/2 using the pool of the original.
+	txp := t.tcp.Clone()
+	txp.DisableKeepAlives = true
+	txp.TLSNextProto = nil
+	if txp.TLSClientConfig == nil {
+		txp.TLSClientConfig = &tls.Config{}
+	}
+	txp.TLSClientConfig.ServerName = effective.SNI
+	pool, _ := h2transport.Configure(txp)
+	if pool != nil && t.pool != nil && t.pool.FrameEvents() {
+		pool.EnableFrameEvents()
+	}
+	// The effective Fronting in the context tells the dialer which
+	// SNI to use when net/http is not performing the TLS handshake.
+	orig := req
+	req = req.Clone(modelx.WithFronting(req.Context(), effective))
+	req.URL.Host = effective.Address
+	req.Host = effective.Host
+	resp, err := h2transport.RoundTrip(pool, txp, req)
+	if resp != nil {
+		resp.Request = orig
+	}
+	return resp, err
+}
+
+// CloseIdleConnections closes the idle connections.
+func (t *Transport) CloseIdleConnections() {
+	type closeIdler interface {
+		CloseIdleConnections()
+	}
+	if tr, ok := t.next.(closeIdler); ok {
+		tr.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,64 @@
+package fronting
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+
+	"github.com/ooni/netx/modelx"
+)
+
+func TestAddress(t *testing.T) {
+	var table = []struct {
+		front   string
+		address string
+		expect  string
+	}{
+		{"", "www.example.com:443", "www.example.com:443"},
+		{"1.1.1.1", "www.example.com:443", "1.1.1.1:443"},
+		{"1.1.1.1:8443", "www.example.com:443", "1.1.1.1:8443"},
+		{"1.1.1.1", "www.example.com", "1.1.1.1"},
+		{"::1", "www.example.com:443", "[::1]:443"},
+		{"[::1]", "www.example.com", "[::1]"},
+		{"::1", "www.example.com", "[::1]"},
+	}
+	for _, entry := range table {
+		if got := Address(entry.front, entry.address); got != entry.expect {
+			t.Fatal("unexpected address", entry, got)
+		}
+	}
+}
+
+func TestEffective(t *testing.T) {
+	req, err := http.NewRequest("GET", "https://www.example.com:8443/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := Effective(req, &modelx.Fronting{Address: "1.1.1.1"}, nil)
+	expect := modelx.Fronting{
+		Address: "1.1.1.1:8443",
+		Host:    "www.example.com:8443",
+		SNI:     "www.example.com",
+	}
+	if *out != expect {
+		t.Fatal("unexpected result", *out)
+	}
+	config := &tls.Config{ServerName: "forced.example.com"}
+	out = Effective(req, &modelx.Fronting{Host: "a.example.com"}, config)
+	expect = modelx.Fronting{
+		Address: "www.example.com:8443",
+		Host:    "a.example.com",
+		SNI:     "forced.example.com",
+	}
+	if *out != expect {
+		t.Fatal("unexpected result", *out)
+	}
+	out = Effective(req, &modelx.Fronting{SNI: "b.example.com"}, config)
+	if out.SNI != "b.example.com" {
+		t.Fatal("unexpected SNI", out.SNI)
+	}
+	req.URL.Scheme = "http"
+	if out = Effective(req, &modelx.Fronting{SNI: "b.example.com"}, nil); out.SNI != "" {
+		t.Fatal("unexpected SNI", out.SNI)
+	}
+}
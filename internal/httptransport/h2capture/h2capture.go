@@ -0,0 +1,488 @@
+// Package h2capture contains a net.Conn that passively parses the
+// HTTP/2 frames flowing over it, which x/net/http2 does not expose.
+package h2capture
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ooni/netx/modelx"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// clientPreface is what the client sends before the first frame.
+const clientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// frameHeaderLen is the length of the header of each frame.
+const frameHeaderLen = 9
+
+// initialHeaderTableSize is the initial size of the HPACK dynamic
+// table, which is also what x/net/http2 advertises by default.
+const initialHeaderTableSize = 4096
+
+// maxPendingFrames is the maximum number of frame events we keep
+// while waiting to know to which transaction they belong.
+const maxPendingFrames = 256
+
+// Conn is a net.Conn that parses the HTTP/2 frames sent and received
+// by a client. It must wrap the connection since its very beginning,
+// i.e., before the client preface is sent. We decode the headers sent
+// by the server to know them in the order in which they were received.
+// When configured to do so, we also emit an event for each frame.
+type Conn struct {
+	net.Conn
+	bindings    map[uint32]binding
+	block       []byte
+	blockID     uint32
+	connID      int64
+	decoder     *hpack.Decoder
+	endStream   bool
+	failed      bool
+	frameEvents bool
+	lastBound   uint32
+	lastSent    uint32
+	mu          sync.Mutex
+	pending     []pendingFrame
+	promise     bool
+	reader      parser
+	root        *modelx.MeasurementRoot
+	streams     map[uint32]*stream
+	writer      parser
+}
+
+// binding binds a stream to the transaction using it.
+type binding struct {
+	root          *modelx.MeasurementRoot
+	transactionID int64
+}
+
+// pendingFrame is a frame event that we have not emitted yet.
+type pendingFrame struct {
+	event *modelx.HTTP2FrameEvent
+	when  time.Time
+}
+
+// stream contains what we know about a stream.
+type stream struct {
+	closed     bool
+	finished   bool
+	gotHeaders bool
+	headers    []modelx.HTTPHeaderField
+}
+
+// New creates a new Conn.
+func New(conn net.Conn) *Conn {
+	c := &Conn{
+		Conn:     conn,
+		bindings: make(map[uint32]binding),
+		decoder:  hpack.NewDecoder(initialHeaderTableSize, nil),
+		streams:  make(map[uint32]*stream),
+	}
+	c.reader.onFrame = c.onReadFrame
+	c.writer.onFrame = c.onWriteFrame
+	c.writer.skip = len(clientPreface)
+	return c
+}
+
+// Read reads data from the connection.
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	c.reader.feed(b[:n])
+	c.mu.Unlock()
+	return n, err
+}
+
+// Write writes data to the connection.
+func (c *Conn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.mu.Lock()
+	c.writer.feed(b[:n])
+	c.mu.Unlock()
+	return n, err
+}
+
+// EnableFrameEvents enables emitting an HTTP2Frame event for each frame,
+// using connID as the ConnID. Since we don't know the measurement root
+// of the connection, we use the root of the transactions using it and
+// we delay emitting events until we know it. Call this function before
+// using the connection.
+func (c *Conn) EnableFrameEvents(connID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connID, c.frameEvents = connID, true
+}
+
+// Bind binds the stream with the given ID to the transaction with the
+// given ID and measurement root. This allows us to emit the events of
+// the frames of such stream with the right TransactionID. Call this
+// function from the WroteHeaders hook, using LastStreamID.
+func (c *Conn) Bind(
+	streamID uint32, root *modelx.MeasurementRoot, transactionID int64,
+) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.frameEvents || streamID == 0 {
+		return
+	}
+	c.root = root
+	c.bindings[streamID] = binding{root: root, transactionID: transactionID}
+	// Because x/net/http2 writes the HEADERS frames and calls the
+	// WroteHeaders hook while holding the write lock, we bind the
+	// streams in increasing order. So, a stream below the last bound
+	// stream that is not bound will never be bound.
+	if streamID > c.lastBound {
+		c.lastBound = streamID
+	}
+	c.flushPending()
+	if s, found := c.streams[streamID]; found && s.closed {
+		delete(c.bindings, streamID)
+	}
+}
+
+// ConnectionState returns the TLS connection state, which allows
+// x/net/http2 to fill the TLS field of the response.
+func (c *Conn) ConnectionState() tls.ConnectionState {
+	type connectionStater interface {
+		ConnectionState() tls.ConnectionState
+	}
+	if cs, ok := c.Conn.(connectionStater); ok {
+		return cs.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
+// LastStreamID returns the ID of the stream of the HEADERS frame that
+// we have most recently written, or zero. Because x/net/http2 writes
+// the headers of a request and then calls the WroteHeaders hook while
+// holding the write lock, this tells the hook the stream ID.
+func (c *Conn) LastStreamID() uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastSent
+}
+
+// Headers returns the response headers received on the stream with
+// the given ID, in the order in which they were received, and forgets
+// about them. We skip informational responses and trailers. Returns
+// nil if we don't have them, e.g., because we failed to decode them.
+func (c *Conn) Headers(streamID uint32) []modelx.HTTPHeaderField {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.finish(streamID).headers
+}
+
+// Forget tells us that the transaction using the stream with the given
+// ID has finished without taking the headers, e.g., because the round
+// trip failed, such that we can forget about the stream once closed.
+func (c *Conn) Forget(streamID uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.finish(streamID)
+}
+
+// finish marks the stream as finished and returns it.
+func (c *Conn) finish(streamID uint32) *stream {
+	s := c.stream(streamID)
+	s.finished = true
+	c.maybeForget(streamID, s)
+	return s
+}
+
+// stream returns the stream with the given ID, creating it if needed.
+func (c *Conn) stream(streamID uint32) *stream {
+	s, found := c.streams[streamID]
+	if !found {
+		s = new(stream)
+		c.streams[streamID] = s
+	}
+	return s
+}
+
+// closeStream marks the stream as closed. We remember a closed stream
+// even if we have not seen its headers, until its transaction finishes.
+func (c *Conn) closeStream(streamID uint32) {
+	delete(c.bindings, streamID)
+	s := c.stream(streamID)
+	s.closed = true
+	c.maybeForget(streamID, s)
+}
+
+// maybeForget forgets about a stream once it has been closed and its
+// transaction has finished. We cannot forget about it before it has been
+// closed, otherwise we'd mistake the trailers for the headers.
+func (c *Conn) maybeForget(streamID uint32, s *stream) {
+	if s.closed && s.finished {
+		delete(c.streams, streamID)
+	}
+}
+
+func (c *Conn) onWriteFrame(fh http2.FrameHeader, payload []byte) {
+	c.maybeEmitFrame("write", fh, payload)
+	switch fh.Type {
+	case http2.FrameHeaders:
+		c.lastSent = fh.StreamID
+	case http2.FrameRSTStream:
+		c.closeStream(fh.StreamID)
+	}
+}
+
+func (c *Conn) onReadFrame(fh http2.FrameHeader, payload []byte) {
+	c.maybeEmitFrame("read", fh, payload)
+	if (fh.Type == http2.FrameData && fh.Flags.Has(http2.FlagDataEndStream)) ||
+		fh.Type == http2.FrameRSTStream {
+		c.closeStream(fh.StreamID)
+	}
+	if c.failed {
+		return
+	}
+	switch fh.Type {
+	case http2.FrameHeaders:
+		fragment, ok := headersFragment(fh, payload)
+		c.startBlock(fh, fragment, ok, false)
+	case http2.FramePushPromise:
+		// We need to decode these headers as well, otherwise our
+		// view of the HPACK dynamic table would be wrong.
+		fragment, ok := pushPromiseFragment(fh, payload)
+		c.startBlock(fh, fragment, ok, true)
+	case http2.FrameContinuation:
+		if c.blockID == 0 || fh.StreamID != c.blockID {
+			c.failed = true
+			return
+		}
+		c.block = append(c.block, payload...)
+		if fh.Flags.Has(http2.FlagContinuationEndHeaders) {
+			c.decodeBlock()
+		}
+	}
+}
+
+func (c *Conn) startBlock(
+	fh http2.FrameHeader, fragment []byte, ok, promise bool,
+) {
+	if !ok || c.blockID != 0 {
+		c.failed = true
+		return
+	}
+	c.block = append(c.block[:0], fragment...)
+	c.blockID, c.promise = fh.StreamID, promise
+	c.endStream = !promise && fh.Flags.Has(http2.FlagHeadersEndStream)
+	if fh.Flags.Has(http2.FlagHeadersEndHeaders) {
+		c.decodeBlock()
+	}
+}
+
+func (c *Conn) decodeBlock() {
+	streamID, promise := c.blockID, c.promise
+	c.blockID = 0
+	fields, err := c.decoder.DecodeFull(c.block)
+	if err != nil {
+		// We cannot recover from this error, because we don't
+		// know anymore the state of the dynamic table.
+		c.failed = true
+		return
+	}
+	if promise || isInformational(fields) {
+		return
+	}
+	s := c.stream(streamID)
+	if c.endStream {
+		defer c.closeStream(streamID)
+	}
+	if s.gotHeaders {
+		return // these are trailers
+	}
+	var out []modelx.HTTPHeaderField
+	for _, field := range fields {
+		out = append(out, modelx.HTTPHeaderField{
+			Key:   field.Name,
+			Value: field.Value,
+		})
+	}
+	s.headers, s.gotHeaders = out, true
+}
+
+func isInformational(fields []hpack.HeaderField) bool {
+	for _, field := range fields {
+		if field.Name == ":status" {
+			return len(field.Value) == 3 && field.Value[0] == '1'
+		}
+	}
+	return false
+}
+
+func (c *Conn) maybeEmitFrame(
+	operation string, fh http2.FrameHeader, payload []byte,
+) {
+	if !c.frameEvents {
+		return
+	}
+	event := newFrameEvent(operation, fh, payload)
+	event.ConnID = c.connID
+	c.pending = append(c.pending, pendingFrame{event: event, when: time.Now()})
+	c.flushPending()
+	if len(c.pending) > maxPendingFrames {
+		c.pending = c.pending[1:] // we cannot wait forever
+	}
+}
+
+// flushPending emits the pending frame events for which we know the
+// transaction, if any, and the measurement root.
+func (c *Conn) flushPending() {
+	var out []pendingFrame
+	for _, entry := range c.pending {
+		streamID := entry.event.StreamID
+		if c.root == nil || streamID > c.lastBound {
+			out = append(out, entry)
+			continue
+		}
+		root := c.root
+		if b, found := c.bindings[streamID]; found {
+			root, entry.event.TransactionID = b.root, b.transactionID
+		}
+		entry.event.DurationSinceBeginning = entry.when.Sub(root.Beginning)
+		root.Handler.OnMeasurement(modelx.Measurement{HTTP2Frame: entry.event})
+	}
+	c.pending = out
+}
+
+// newFrameEvent creates the event describing a frame.
+func newFrameEvent(
+	operation string, fh http2.FrameHeader, payload []byte,
+) *modelx.HTTP2FrameEvent {
+	event := &modelx.HTTP2FrameEvent{
+		Flags:     uint8(fh.Flags),
+		Length:    fh.Length,
+		Operation: operation,
+		StreamID:  fh.StreamID,
+		Type:      fh.Type.String(),
+	}
+	switch fh.Type {
+	case http2.FrameSettings:
+		for ; len(payload) >= 6; payload = payload[6:] {
+			event.Settings = append(event.Settings, modelx.HTTP2Setting{
+				ID:    http2.SettingID(binary.BigEndian.Uint16(payload)).String(),
+				Value: binary.BigEndian.Uint32(payload[2:]),
+			})
+		}
+	case http2.FrameGoAway:
+		if len(payload) >= 8 {
+			event.LastStreamID = binary.BigEndian.Uint32(payload) & (1<<31 - 1)
+			event.ErrCode = http2.ErrCode(binary.BigEndian.Uint32(payload[4:])).String()
+		}
+	case http2.FrameRSTStream:
+		if len(payload) >= 4 {
+			event.ErrCode = http2.ErrCode(binary.BigEndian.Uint32(payload)).String()
+		}
+	case http2.FrameWindowUpdate:
+		if len(payload) >= 4 {
+			event.WindowIncrement = binary.BigEndian.Uint32(payload) & (1<<31 - 1)
+		}
+	case http2.FramePing:
+		if len(payload) >= 8 {
+			event.PingData = append([]byte(nil), payload[:8]...)
+		}
+	}
+	return event
+}
+
+// headersFragment returns the header block fragment inside the
+// payload of a HEADERS frame, removing padding and priority.
+func headersFragment(fh http2.FrameHeader, payload []byte) ([]byte, bool) {
+	var padding int
+	if fh.Flags.Has(http2.FlagHeadersPadded) {
+		if len(payload) < 1 {
+			return nil, false
+		}
+		padding, payload = int(payload[0]), payload[1:]
+	}
+	if fh.Flags.Has(http2.FlagHeadersPriority) {
+		if len(payload) < 5 {
+			return nil, false
+		}
+		payload = payload[5:]
+	}
+	if padding > len(payload) {
+		return nil, false
+	}
+	return payload[:len(payload)-padding], true
+}
+
+// pushPromiseFragment is like headersFragment for PUSH_PROMISE.
+func pushPromiseFragment(fh http2.FrameHeader, payload []byte) ([]byte, bool) {
+	var padding int
+	if fh.Flags.Has(http2.FlagPushPromisePadded) {
+		if len(payload) < 1 {
+			return nil, false
+		}
+		padding, payload = int(payload[0]), payload[1:]
+	}
+	if len(payload) < 4 {
+		return nil, false
+	}
+	payload = payload[4:]
+	if padding > len(payload) {
+		return nil, false
+	}
+	return payload[:len(payload)-padding], true
+}
+
+// parser splits a stream of bytes into frames. It buffers the data
+// until it has a whole frame, then it calls onFrame. The payload
+// passed to onFrame is only valid until onFrame returns. We don't
+// buffer the payload of DATA frames, which we don't need.
+type parser struct {
+	fh      http2.FrameHeader
+	header  []byte
+	inFrame bool
+	onFrame func(fh http2.FrameHeader, payload []byte)
+	payload []byte
+	read    int
+	skip    int
+}
+
+func (p *parser) feed(data []byte) {
+	for len(data) > 0 {
+		if p.skip > 0 {
+			count := minInt(p.skip, len(data))
+			p.skip, data = p.skip-count, data[count:]
+			continue
+		}
+		if !p.inFrame {
+			count := minInt(frameHeaderLen-len(p.header), len(data))
+			p.header, data = append(p.header, data[:count]...), data[count:]
+			if len(p.header) < frameHeaderLen {
+				return
+			}
+			p.fh = http2.FrameHeader{
+				Length: uint32(p.header[0])<<16 |
+					uint32(p.header[1])<<8 | uint32(p.header[2]),
+				Type:     http2.FrameType(p.header[3]),
+				Flags:    http2.Flags(p.header[4]),
+				StreamID: binary.BigEndian.Uint32(p.header[5:]) & (1<<31 - 1),
+			}
+			p.header, p.payload, p.read, p.inFrame = p.header[:0], p.payload[:0], 0, true
+		}
+		count := minInt(int(p.fh.Length)-p.read, len(data))
+		if p.fh.Type != http2.FrameData {
+			p.payload = append(p.payload, data[:count]...)
+		}
+		p.read, data = p.read+count, data[count:]
+		if p.read < int(p.fh.Length) {
+			return
+		}
+		p.inFrame = false
+		p.onFrame(p.fh, p.payload)
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,211 @@
+package h2capture
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ooni/netx/modelx"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+type fakeConn struct {
+	net.Conn
+	reader *bytes.Reader
+}
+
+func (c *fakeConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *fakeConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func encode(t *testing.T, encoder *hpack.Encoder, buf *bytes.Buffer, kv ...string) []byte {
+	buf.Reset()
+	for idx := 0; idx < len(kv); idx += 2 {
+		if err := encoder.WriteField(hpack.HeaderField{
+			Name: kv[idx], Value: kv[idx+1],
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return append([]byte(nil), buf.Bytes()...)
+}
+
+func TestHeaders(t *testing.T) {
+	var hbuf, wire bytes.Buffer
+	encoder := hpack.NewEncoder(&hbuf)
+	framer := http2.NewFramer(&wire, nil)
+	framer.WriteSettings()
+	// informational response, to be skipped
+	framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: encode(t, encoder, &hbuf, ":status", "103", "link", "x"),
+		EndHeaders:    true,
+	})
+	// final response split across HEADERS and CONTINUATION
+	block := encode(t, encoder, &hbuf, ":status", "200", "x-b", "1", "x-a", "2", "x-b", "3")
+	framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: block[:3],
+		PadLength:     4,
+	})
+	framer.WriteContinuation(1, true, block[3:])
+	framer.WriteData(1, false, []byte("hello"))
+	// trailers, to be skipped
+	framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: encode(t, encoder, &hbuf, "x-trailer", "y"),
+		EndHeaders:    true,
+		EndStream:     true,
+	})
+	// another stream reusing the dynamic table
+	framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      3,
+		BlockFragment: encode(t, encoder, &hbuf, ":status", "200", "x-b", "1"),
+		EndHeaders:    true,
+		EndStream:     true,
+	})
+	conn := New(&fakeConn{reader: bytes.NewReader(wire.Bytes())})
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Fatal(err)
+	}
+	check := func(streamID uint32, expect ...string) {
+		headers := conn.Headers(streamID)
+		if len(headers)*2 != len(expect) {
+			t.Fatal("unexpected number of headers", headers)
+		}
+		for idx, field := range headers {
+			if field.Key != expect[2*idx] || field.Value != expect[2*idx+1] {
+				t.Fatal("unexpected header", field)
+			}
+		}
+	}
+	check(1, ":status", "200", "x-b", "1", "x-a", "2", "x-b", "3")
+	check(3, ":status", "200", "x-b", "1")
+	if len(conn.streams) != 0 {
+		t.Fatal("expected to have forgotten all streams")
+	}
+}
+
+func TestForgetAfterFailure(t *testing.T) {
+	var hbuf, wire bytes.Buffer
+	encoder := hpack.NewEncoder(&hbuf)
+	framer := http2.NewFramer(&wire, nil)
+	framer.WriteSettings()
+	// the server resets the stream before sending the headers
+	framer.WriteRSTStream(1, http2.ErrCodeRefusedStream)
+	// the server resets the stream after sending the headers
+	framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      3,
+		BlockFragment: encode(t, encoder, &hbuf, ":status", "200"),
+		EndHeaders:    true,
+	})
+	framer.WriteRSTStream(3, http2.ErrCodeInternal)
+	// the stream is still open when the round trip fails
+	framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      5,
+		BlockFragment: encode(t, encoder, &hbuf, ":status", "200"),
+		EndHeaders:    true,
+	})
+	conn := New(&fakeConn{reader: bytes.NewReader(wire.Bytes())})
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Fatal(err)
+	}
+	// the round trips fail, so nobody takes the headers
+	for _, streamID := range []uint32{1, 3, 5} {
+		conn.Forget(streamID)
+	}
+	if len(conn.streams) != 1 {
+		t.Fatal("expected to only remember the open stream")
+	}
+	// the client resets the open stream
+	var out bytes.Buffer
+	out.WriteString(clientPreface)
+	http2.NewFramer(&out, nil).WriteRSTStream(5, http2.ErrCodeCancel)
+	conn.Write(out.Bytes())
+	if len(conn.streams) != 0 {
+		t.Fatal("expected to have forgotten all streams")
+	}
+}
+
+func TestLastStreamID(t *testing.T) {
+	var wire bytes.Buffer
+	wire.WriteString(clientPreface)
+	framer := http2.NewFramer(&wire, nil)
+	framer.WriteSettings()
+	framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      5,
+		BlockFragment: []byte{0x82},
+		EndHeaders:    true,
+	})
+	framer.WriteWindowUpdate(0, 1024)
+	conn := New(&fakeConn{})
+	data := wire.Bytes()
+	// write one byte at a time to exercise the parser
+	for idx := range data {
+		conn.Write(data[idx : idx+1])
+	}
+	if conn.LastStreamID() != 5 {
+		t.Fatal("unexpected stream ID", conn.LastStreamID())
+	}
+}
+
+type savingHandler struct {
+	frames []*modelx.HTTP2FrameEvent
+}
+
+func (h *savingHandler) OnMeasurement(m modelx.Measurement) {
+	if m.HTTP2Frame != nil {
+		h.frames = append(h.frames, m.HTTP2Frame)
+	}
+}
+
+func TestFrameEvents(t *testing.T) {
+	var input, output bytes.Buffer
+	framer := http2.NewFramer(&input, nil)
+	framer.WriteSettings(http2.Setting{ID: http2.SettingMaxConcurrentStreams, Val: 100})
+	framer.WriteRSTStream(1, http2.ErrCodeRefusedStream)
+	conn := New(&fakeConn{reader: bytes.NewReader(input.Bytes())})
+	conn.EnableFrameEvents(17)
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Fatal(err)
+	}
+	output.WriteString(clientPreface)
+	framer = http2.NewFramer(&output, nil)
+	framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: []byte{0x82},
+		EndHeaders:    true,
+	})
+	conn.Write(output.Bytes())
+	handler := new(savingHandler)
+	root := &modelx.MeasurementRoot{Beginning: time.Now(), Handler: handler}
+	if len(handler.frames) != 0 {
+		t.Fatal("expected no events before binding")
+	}
+	conn.Bind(conn.LastStreamID(), root, 7)
+	if len(handler.frames) != 3 {
+		t.Fatal("unexpected number of events", len(handler.frames))
+	}
+	settings, reset, headers := handler.frames[0], handler.frames[1], handler.frames[2]
+	if settings.Type != "SETTINGS" || settings.ConnID != 17 ||
+		settings.TransactionID != 0 || len(settings.Settings) != 1 ||
+		settings.Settings[0].ID != "MAX_CONCURRENT_STREAMS" ||
+		settings.Settings[0].Value != 100 {
+		t.Fatal("unexpected SETTINGS event", settings)
+	}
+	if reset.Type != "RST_STREAM" || reset.ErrCode != "REFUSED_STREAM" ||
+		reset.TransactionID != 7 || reset.Operation != "read" {
+		t.Fatal("unexpected RST_STREAM event", reset)
+	}
+	if headers.Type != "HEADERS" || headers.TransactionID != 7 ||
+		headers.Operation != "write" {
+		t.Fatal("unexpected HEADERS event", headers)
+	}
+}
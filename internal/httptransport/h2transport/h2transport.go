@@ -0,0 +1,242 @@
+// Package h2transport configures a http.Transport to use HTTP/2 such
+// that the connections upgraded to HTTP/2 are wrapped by h2capture.
+//
+// This is needed because http2.ConfigureTransports creates the HTTP/2
+// client connections using the *tls.Conn returned by net/http, hence
+// we cannot observe the frames. So, we replace the upgrade function
+// and the connection pool with our own, while reusing the HTTP/2
+// transport configured by http2.ConfigureTransports.
+//
+// Because net/http only upgrades a *tls.Conn to HTTP/2, the dialer
+// must call Adopt when it returns other connections that negotiated
+// h2, e.g. the uTLS ones, and RoundTrip retries the request using
+// the connection that has been adopted.
+package h2transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/ooni/netx/internal/connid"
+	"github.com/ooni/netx/internal/httptransport/h2capture"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/idna"
+)
+
+// Pool is the pool of HTTP/2 client connections.
+type Pool struct {
+	conns       map[string][]*http2.ClientConn
+	frameEvents bool
+	mu          sync.Mutex
+	t2          *http2.Transport
+}
+
+// Configure is like http2.ConfigureTransports except that it wraps
+// the connections upgraded to HTTP/2 using h2capture.New. It returns
+// error if t1 has already been configured to use HTTP/2.
+func Configure(t1 *http.Transport) (*Pool, error) {
+	t2, err := http2.ConfigureTransports(t1)
+	if err != nil {
+		return nil, err
+	}
+	pool := &Pool{
+		conns: make(map[string][]*http2.ClientConn),
+		t2:    t2,
+	}
+	t2.ConnPool = pool
+	t1.TLSNextProto["h2"] = pool.upgrade
+	return pool, nil
+}
+
+// EnableFrameEvents enables emitting frame events for the connections
+// that will be upgraded to HTTP/2 from now on.
+func (p *Pool) EnableFrameEvents() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.frameEvents = true
+}
+
+// FrameEvents returns whether we're emitting frame events.
+func (p *Pool) FrameEvents() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.frameEvents
+}
+
+type erringRoundTripper struct {
+	err error
+}
+
+// RoundTripErr tells net/http that upgrading failed with err.
+func (rt erringRoundTripper) RoundTripErr() error {
+	return rt.err
+}
+
+func (rt erringRoundTripper) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, rt.err
+}
+
+// upgrade is called by net/http when it has negotiated h2.
+func (p *Pool) upgrade(authority string, conn *tls.Conn) http.RoundTripper {
+	if err := p.add(authority, conn); err != nil {
+		go conn.Close()
+		return erringRoundTripper{err: err}
+	}
+	return p.t2
+}
+
+// add wraps conn using h2capture and adds it to the pool.
+func (p *Pool) add(authority string, conn net.Conn) error {
+	wrapper := h2capture.New(conn)
+	p.mu.Lock()
+	if p.frameEvents {
+		wrapper.EnableFrameEvents(connid.Lookup(conn))
+	}
+	p.mu.Unlock()
+	cc, err := p.t2.NewClientConn(wrapper)
+	if err != nil {
+		return err
+	}
+	key := authorityAddr(authority)
+	p.mu.Lock()
+	p.conns[key] = append(p.conns[key], cc)
+	p.mu.Unlock()
+	return nil
+}
+
+// errAdopted tells RoundTrip that the dialer has adopted the conn.
+var errAdopted = errors.New("h2transport: conn adopted by the pool")
+
+type poolKey struct{}
+
+// Adopt adds conn, which negotiated h2 with address but is not a
+// *tls.Conn, to the pool used by RoundTrip, which is in ctx. Adopt
+// always returns an error, which the dialer should return to net/http,
+// telling RoundTrip to retry. It closes conn on failure.
+func Adopt(ctx context.Context, address string, conn net.Conn) error {
+	pool, _ := ctx.Value(poolKey{}).(*Pool)
+	if pool == nil {
+		conn.Close()
+		return errors.New("h2transport: no pool for adopting the conn")
+	}
+	if err := pool.add(address, conn); err != nil {
+		conn.Close()
+		return err
+	}
+	return errAdopted
+}
+
+// RoundTrip performs req using rt, which is, or is using, the transport
+// configured by pool. When the dialer has adopted the conn, net/http
+// fails, hence we retry once and net/http uses the adopted conn.
+func RoundTrip(
+	pool *Pool, rt http.RoundTripper, req *http.Request,
+) (*http.Response, error) {
+	if pool == nil {
+		return rt.RoundTrip(req)
+	}
+	orig := req
+	req = req.WithContext(context.WithValue(req.Context(), poolKey{}, pool))
+	resp, err := rt.RoundTrip(req)
+	if !errors.Is(err, errAdopted) {
+		return withRequest(resp, orig), err
+	}
+	// Like net/http, we need GetBody, because it has closed the body.
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, err
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+	resp, err = rt.RoundTrip(req)
+	return withRequest(resp, orig), err
+}
+
+func withRequest(resp *http.Response, req *http.Request) *http.Response {
+	if resp != nil {
+		resp.Request = req
+	}
+	return resp
+}
+
+// GetClientConn implements http2.ClientConnPool.GetClientConn. Like
+// the pool used by http2.ConfigureTransports, we never dial, rather
+// we tell net/http to dial and later upgrade the connection.
+func (p *Pool) GetClientConn(req *http.Request, addr string) (*http2.ClientConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, cc := range p.conns[addr] {
+		if cc.ReserveNewRequest() {
+			return cc, nil
+		}
+	}
+	return nil, http2.ErrNoCachedConn
+}
+
+// MarkDead implements http2.ClientConnPool.MarkDead.
+func (p *Pool) MarkDead(cc *http2.ClientConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, conns := range p.conns {
+		var out []*http2.ClientConn
+		for _, entry := range conns {
+			if entry != cc {
+				out = append(out, entry)
+			}
+		}
+		if len(out) > 0 {
+			p.conns[key] = out
+		} else {
+			delete(p.conns, key)
+		}
+	}
+}
+
+// CloseIdleConnections closes the idle connections. We need to do
+// that explicitly, because net/http cannot close them for us.
+func (p *Pool) CloseIdleConnections() {
+	var idle []*http2.ClientConn
+	p.mu.Lock()
+	for _, conns := range p.conns {
+		for _, cc := range conns {
+			state := cc.State()
+			if state.StreamsActive <= 0 && state.StreamsReserved <= 0 &&
+				state.StreamsPending <= 0 {
+				idle = append(idle, cc)
+			}
+		}
+	}
+	p.mu.Unlock()
+	for _, cc := range idle {
+		cc.Close() // eventually calls MarkDead
+	}
+}
+
+// authorityAddr is like the namesake function of x/net/http2, which
+// computes the key used to call GetClientConn for https URLs.
+func authorityAddr(authority string) string {
+	host, port, err := net.SplitHostPort(authority)
+	if err != nil {
+		host, port = authority, ""
+	}
+	if port == "" {
+		port = "443"
+	}
+	if ascii, err := idna.ToASCII(host); err == nil {
+		host = ascii
+	}
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host + ":" + port
+	}
+	return net.JoinHostPort(host, port)
+}
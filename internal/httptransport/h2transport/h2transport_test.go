@@ -0,0 +1,96 @@
+package h2transport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestConfigureTwice(t *testing.T) {
+	txp := &http.Transport{}
+	pool, err := Configure(txp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pool == nil || txp.TLSNextProto["h2"] == nil {
+		t.Fatal("transport not configured")
+	}
+	if _, err := Configure(txp); err == nil {
+		t.Fatal("expected an error here")
+	}
+}
+
+func TestAuthorityAddr(t *testing.T) {
+	for input, expect := range map[string]string{
+		"example.com":     "example.com:443",
+		"example.com:853": "example.com:853",
+		"[::1]":           "[::1]:443",
+		"[::1]:8443":      "[::1]:8443",
+	} {
+		if output := authorityAddr(input); output != expect {
+			t.Fatal("unexpected output", output, "for", input)
+		}
+	}
+}
+
+func TestAdoptWithoutPool(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	if err := Adopt(context.Background(), "example.com:443", conn); err == nil {
+		t.Fatal("expected an error here")
+	}
+	if _, err := conn.Write([]byte("x")); err == nil {
+		t.Fatal("conn not closed")
+	}
+}
+
+type adoptingRoundTripper struct {
+	count int
+}
+
+func (rt *adoptingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.count++
+	if req.Context().Value(poolKey{}) == nil {
+		return nil, errors.New("no pool in context")
+	}
+	if req.Body != nil {
+		req.Body.Close() // like net/http does
+	}
+	if rt.count > 1 {
+		return &http.Response{StatusCode: 200}, nil
+	}
+	return nil, errAdopted
+}
+
+func TestRoundTripRetries(t *testing.T) {
+	pool, err := Configure(&http.Transport{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", "https://example.com/", strings.NewReader("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := new(adoptingRoundTripper)
+	resp, err := RoundTrip(pool, rt, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rt.count != 2 || resp.Request != req {
+		t.Fatal("unexpected count or request", rt.count, resp.Request)
+	}
+	// Without GetBody, we cannot retry because the body is gone.
+	req.GetBody = nil
+	req.Body = io.NopCloser(strings.NewReader("x"))
+	rt = new(adoptingRoundTripper)
+	if _, err := RoundTrip(pool, rt, req); !errors.Is(err, errAdopted) {
+		t.Fatal("not the error we expected", err)
+	}
+	if rt.count != 1 {
+		t.Fatal("unexpected count", rt.count)
+	}
+}
@@ -0,0 +1,137 @@
+// Package headercapture contains a net.Conn that captures the raw
+// headers of HTTP/1.x responses, which net/http does not expose.
+package headercapture
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/ooni/netx/modelx"
+)
+
+// maxHeaderSize is the maximum size of the headers we capture,
+// which is large enough to fit what net/http accepts by default.
+const maxHeaderSize = 10 << 20
+
+// Conn is a net.Conn that captures the headers of the next response
+// after you call Arm. It is only meaningful to use it when net/http
+// speaks cleartext HTTP/1.x with Conn, which is the case for http://
+// URLs and for https:// URLs when we perform the TLS handshake.
+type Conn struct {
+	net.Conn
+	armed bool
+	buf   []byte
+	last  []byte
+	mu    sync.Mutex
+}
+
+// New creates a new Conn.
+func New(conn net.Conn) *Conn {
+	return &Conn{Conn: conn}
+}
+
+// Arm starts capturing the headers of the next response. You should
+// call this function before sending the request. We skip informational
+// responses, e.g. 100 Continue, and capture the final response headers.
+func (c *Conn) Arm() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.armed, c.buf, c.last = true, nil, nil
+}
+
+// Headers returns the headers of the response captured after the
+// most recent call to Arm, in the order in which they were received
+// and with their original casing, or nil if we don't have them.
+func (c *Conn) Headers() []modelx.HTTPHeaderField {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return parseHeaders(c.last)
+}
+
+// Read reads data from the connection.
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	c.capture(b[:n])
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *Conn) capture(data []byte) {
+	if !c.armed || len(data) <= 0 {
+		return
+	}
+	c.buf = append(c.buf, data...)
+	for {
+		end := headerEnd(c.buf)
+		if end < 0 {
+			if len(c.buf) > maxHeaderSize {
+				c.armed, c.buf = false, nil
+			}
+			return
+		}
+		c.last = append([]byte(nil), c.buf[:end]...)
+		if !isInformational(c.last) {
+			c.armed, c.buf = false, nil
+			return
+		}
+		c.buf = c.buf[end:]
+	}
+}
+
+// headerEnd returns the index just after the empty line terminating
+// the headers, or -1. Like net/http, we accept LF-only line endings.
+func headerEnd(data []byte) int {
+	end := -1
+	if idx := bytes.Index(data, []byte("\n\n")); idx >= 0 {
+		end = idx + 2
+	}
+	if idx := bytes.Index(data, []byte("\n\r\n")); idx >= 0 && (end < 0 || idx+3 < end) {
+		end = idx + 3
+	}
+	return end
+}
+
+// isInformational returns whether the status code is 1xx. Note that we
+// consider 101 Switching Protocols to be the final response.
+func isInformational(header []byte) bool {
+	line := string(header)
+	if idx := strings.IndexByte(line, '\n'); idx >= 0 {
+		line = line[:idx]
+	}
+	fields := strings.Fields(line)
+	return len(fields) >= 2 && len(fields[1]) == 3 &&
+		fields[1][0] == '1' && fields[1] != "101"
+}
+
+// parseHeaders parses the header lines following the status line. We
+// preserve the original casing and we remove the whitespace around
+// the value. Continuation lines are joined to the previous value
+// using a single space, as net/http does. Lines not containing any
+// colon become fields with an empty value.
+func parseHeaders(header []byte) (out []modelx.HTTPHeaderField) {
+	lines := strings.Split(string(header), "\n")
+	if len(lines) <= 1 {
+		return nil
+	}
+	for _, line := range lines[1:] {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(out) > 0 {
+			out[len(out)-1].Value += " " + strings.TrimSpace(line)
+			continue
+		}
+		var field modelx.HTTPHeaderField
+		if idx := strings.IndexByte(line, ':'); idx >= 0 {
+			field.Key, field.Value = line[:idx], strings.TrimSpace(line[idx+1:])
+		} else {
+			field.Key = line
+		}
+		out = append(out, field)
+	}
+	return
+}
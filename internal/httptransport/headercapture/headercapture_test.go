@@ -0,0 +1,62 @@
+package headercapture
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+type fakeConn struct {
+	net.Conn
+	reader *bytes.Reader
+}
+
+func (c *fakeConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func TestCapture(t *testing.T) {
+	data := "HTTP/1.1 100 Continue\r\n\r\n" +
+		"HTTP/1.1 200 Ok\r\nX-ODD-casing:  a \r\nSet-Cookie: b\r\n" +
+		"Folded: c\r\n d\r\nset-cookie: e\r\n\r\nbody"
+	conn := New(&fakeConn{reader: bytes.NewReader([]byte(data))})
+	if conn.Headers() != nil {
+		t.Fatal("expected no headers before reading")
+	}
+	conn.Arm()
+	buf := make([]byte, 7) // force reading in small chunks
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			break
+		}
+	}
+	headers := conn.Headers()
+	expect := []string{"X-ODD-casing", "a", "Set-Cookie", "b", "Folded", "c d", "set-cookie", "e"}
+	if len(headers)*2 != len(expect) {
+		t.Fatal("unexpected number of headers", headers)
+	}
+	for idx, field := range headers {
+		if field.Key != expect[2*idx] || field.Value != expect[2*idx+1] {
+			t.Fatal("unexpected header", field)
+		}
+	}
+}
+
+func TestNotArmed(t *testing.T) {
+	data := "HTTP/1.1 200 Ok\r\nX-Foo: a\r\n\r\n"
+	conn := New(&fakeConn{reader: bytes.NewReader([]byte(data))})
+	buf := make([]byte, 128)
+	conn.Read(buf)
+	if conn.Headers() != nil {
+		t.Fatal("expected no headers when not armed")
+	}
+}
+
+func TestHeaderEndWithLF(t *testing.T) {
+	if end := headerEnd([]byte("HTTP/1.0 200 Ok\nX: y\n\nbody")); end != 22 {
+		t.Fatal("unexpected end", end)
+	}
+	if end := headerEnd([]byte("HTTP/1.0 200 Ok\r\nX: y\r\n")); end != -1 {
+		t.Fatal("unexpected end", end)
+	}
+}
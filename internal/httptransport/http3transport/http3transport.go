@@ -0,0 +1,205 @@
+// Package http3transport contains a round tripper that routes
+// requests either to HTTP/3 or to the TCP based transport.
+package http3transport
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// Mode controls when we use HTTP/3.
+type Mode int
+
+const (
+	// ModeDisabled means we never use HTTP/3.
+	ModeDisabled = Mode(iota)
+
+	// ModeForce means we always use HTTP/3 for https requests.
+	ModeForce
+
+	// ModeAltSvc means we use HTTP/3 for https requests only after
+	// the origin has advertised it using the Alt-Svc header.
+	ModeAltSvc
+)
+
+// DialFunc is the function used to dial QUIC connections.
+type DialFunc func(
+	ctx context.Context, address string, tlsConfig *tls.Config,
+	quicConfig *quic.Config,
+) (quic.EarlyConnection, error)
+
+type altSvcEntry struct {
+	authority string
+	expires   time.Time
+}
+
+// Transport routes requests either to HTTP/3 or to HTTP over TCP.
+type Transport struct {
+	// HTTP3 is the HTTP/3 transport.
+	HTTP3 *http3.Transport
+
+	// TCP is the transport using TCP.
+	TCP *http.Transport
+
+	altsvc map[string]altSvcEntry
+	mode   Mode
+	mu     sync.Mutex
+	now    func() time.Time
+}
+
+// New creates a new Transport that uses dial for QUIC connections. You
+// should set the TLSClientConfig of HTTP3 before using the transport.
+func New(tcp *http.Transport, dial DialFunc) *Transport {
+	t := &Transport{
+		TCP:    tcp,
+		altsvc: make(map[string]altSvcEntry),
+		now:    time.Now,
+	}
+	t.HTTP3 = &http3.Transport{
+		Dial: func(
+			ctx context.Context, address string, tlsConfig *tls.Config,
+			quicConfig *quic.Config,
+		) (quic.EarlyConnection, error) {
+			return dial(ctx, t.dialAddress(address), tlsConfig, quicConfig)
+		},
+	}
+	return t
+}
+
+// SetMode sets the mode. Changing mode forgets the Alt-Svc cache.
+func (t *Transport) SetMode(mode Mode) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.mode = mode
+	t.altsvc = make(map[string]altSvcEntry)
+}
+
+// TLSClientConfig returns the TLS config used for handshakes.
+func (t *Transport) TLSClientConfig() *tls.Config {
+	return t.TCP.TLSClientConfig
+}
+
+// RoundTrip executes a single HTTP transaction, returning
+// a Response for the provided Request. Note that, when we're
+// using HTTP/3, we are not going to use any configured proxy.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "https" {
+		return t.TCP.RoundTrip(req)
+	}
+	origin := authority(req.URL.Host)
+	t.mu.Lock()
+	mode := t.mode
+	entry, found := t.altsvc[origin]
+	if found && !t.now().Before(entry.expires) {
+		delete(t.altsvc, origin)
+		found = false
+	}
+	t.mu.Unlock()
+	switch {
+	case mode == ModeForce:
+		return t.HTTP3.RoundTrip(req)
+	case mode == ModeAltSvc && found:
+		resp, err := t.HTTP3.RoundTrip(req)
+		if err != nil {
+			// We do not fallback to TCP, so that the caller sees the
+			// HTTP/3 failure. The next request will use TCP.
+			t.forget(origin)
+		}
+		return resp, err
+	}
+	resp, err := t.TCP.RoundTrip(req)
+	if err == nil && mode == ModeAltSvc {
+		t.learn(origin, resp.Header.Values("Alt-Svc"))
+	}
+	return resp, err
+}
+
+// dialAddress maps the address of the origin to the address we
+// should dial, which may differ because of Alt-Svc.
+func (t *Transport) dialAddress(address string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if entry, found := t.altsvc[address]; found {
+		return entry.authority
+	}
+	return address
+}
+
+func (t *Transport) forget(origin string) {
+	t.mu.Lock()
+	delete(t.altsvc, origin)
+	t.mu.Unlock()
+}
+
+func (t *Transport) learn(origin string, values []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, value := range values {
+		if strings.TrimSpace(value) == "clear" {
+			delete(t.altsvc, origin)
+			return
+		}
+		if entry, ok := parseAltSvc(origin, value, t.now()); ok {
+			t.altsvc[origin] = entry
+			return
+		}
+	}
+}
+
+// parseAltSvc parses an Alt-Svc header value as described by
+// RFC7838 and returns the first h3 alternative, if any.
+func parseAltSvc(origin, value string, now time.Time) (altSvcEntry, bool) {
+	for _, alternative := range strings.Split(value, ",") {
+		params := strings.Split(alternative, ";")
+		protoAuthority := strings.SplitN(strings.TrimSpace(params[0]), "=", 2)
+		if len(protoAuthority) != 2 || protoAuthority[0] != "h3" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(strings.Trim(protoAuthority[1], `"`))
+		if err != nil || port == "" {
+			continue
+		}
+		if host == "" {
+			host, _, _ = net.SplitHostPort(origin)
+		}
+		maxAge := 24 * time.Hour
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) != 2 || kv[0] != "ma" {
+				continue
+			}
+			if seconds, err := strconv.ParseInt(kv[1], 10, 64); err == nil {
+				maxAge = time.Duration(seconds) * time.Second
+			}
+		}
+		return altSvcEntry{
+			authority: net.JoinHostPort(host, port),
+			expires:   now.Add(maxAge),
+		}, true
+	}
+	return altSvcEntry{}, false
+}
+
+// authority returns the authority of an https URL host,
+// which is the host followed by the port.
+func authority(host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), "443")
+}
+
+// CloseIdleConnections closes the idle connections.
+func (t *Transport) CloseIdleConnections() {
+	t.TCP.CloseIdleConnections()
+	t.HTTP3.CloseIdleConnections()
+}
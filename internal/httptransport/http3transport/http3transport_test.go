@@ -0,0 +1,123 @@
+package http3transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+func TestUnitParseAltSvc(t *testing.T) {
+	now := time.Now()
+	entry, ok := parseAltSvc(
+		"www.example.com:443", `h3-29=":443"; ma=60, h3=":8443"; ma=3600`, now)
+	if !ok {
+		t.Fatal("expected to find an h3 alternative")
+	}
+	if entry.authority != "www.example.com:8443" {
+		t.Fatal("unexpected authority", entry.authority)
+	}
+	if !entry.expires.Equal(now.Add(time.Hour)) {
+		t.Fatal("unexpected expiry")
+	}
+	entry, ok = parseAltSvc("www.example.com:443", `h3="alt.example.com:443"`, now)
+	if !ok || entry.authority != "alt.example.com:443" {
+		t.Fatal("unexpected result with explicit host")
+	}
+	if !entry.expires.Equal(now.Add(24 * time.Hour)) {
+		t.Fatal("unexpected default expiry")
+	}
+	if _, ok := parseAltSvc("www.example.com:443", `h2=":443"`, now); ok {
+		t.Fatal("expected no h3 alternative")
+	}
+	if _, ok := parseAltSvc("www.example.com:443", `h3=":"`, now); ok {
+		t.Fatal("expected a port to be required")
+	}
+}
+
+func TestUnitAuthority(t *testing.T) {
+	if authority("www.example.com") != "www.example.com:443" {
+		t.Fatal("unexpected result for host without port")
+	}
+	if authority("[::1]") != "[::1]:443" {
+		t.Fatal("unexpected result for IPv6 host without port")
+	}
+	if authority("www.example.com:8443") != "www.example.com:8443" {
+		t.Fatal("unexpected result for host with port")
+	}
+}
+
+func TestUnitLearnAndClear(t *testing.T) {
+	txp := New(new(http.Transport), nil)
+	txp.learn("www.example.com:443", []string{`h3=":8443"`})
+	if txp.dialAddress("www.example.com:443") != "www.example.com:8443" {
+		t.Fatal("the advertisement has not been learned")
+	}
+	txp.learn("www.example.com:443", []string{"clear"})
+	if txp.dialAddress("www.example.com:443") != "www.example.com:443" {
+		t.Fatal("the advertisement has not been cleared")
+	}
+}
+
+func TestIntegrationAltSvcFailure(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Alt-Svc", `h3=":443"; ma=1`)
+		},
+	))
+	defer server.Close()
+	var dialed string
+	txp := New(server.Client().Transport.(*http.Transport), func(
+		ctx context.Context, address string, tlsConfig *tls.Config,
+		quicConfig *quic.Config,
+	) (quic.EarlyConnection, error) {
+		dialed = address
+		return nil, errors.New("mocked error")
+	})
+	txp.SetMode(ModeAltSvc)
+	fakenow := time.Now()
+	txp.now = func() time.Time { return fakenow }
+	defer txp.CloseIdleConnections()
+	get := func() (*http.Response, error) {
+		req, err := http.NewRequest("GET", server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return txp.RoundTrip(req)
+	}
+	// First request: we use TCP and learn about h3
+	resp, err := get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	// Second request: we use h3, which fails
+	if _, err := get(); err == nil {
+		t.Fatal("expected an error here")
+	}
+	if dialed != "127.0.0.1:443" {
+		t.Fatal("unexpected dialed address", dialed)
+	}
+	// Third request: we're back to TCP
+	resp, err = get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	// Fourth request: the advertisement has expired
+	fakenow = fakenow.Add(2 * time.Second)
+	dialed = ""
+	resp, err = get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if dialed != "" {
+		t.Fatal("we should not have used h3")
+	}
+}
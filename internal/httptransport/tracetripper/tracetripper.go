@@ -6,8 +6,10 @@ import (
 	"crypto/tls"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptrace"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -15,6 +17,12 @@ import (
 	"github.com/ooni/netx/internal/connid"
 	"github.com/ooni/netx/internal/dialid"
 	"github.com/ooni/netx/internal/errwrapper"
+	"github.com/ooni/netx/internal/httptransport/bodystats"
+	"github.com/ooni/netx/internal/httptransport/decompressor"
+	"github.com/ooni/netx/internal/httptransport/fronting"
+	"github.com/ooni/netx/internal/httptransport/h2capture"
+	"github.com/ooni/netx/internal/httptransport/headercapture"
+	"github.com/ooni/netx/internal/tlsx"
 	"github.com/ooni/netx/internal/transactionid"
 	"github.com/ooni/netx/modelx"
 )
@@ -70,32 +78,107 @@ func readSnap(
 	return
 }
 
+// headersCapturer captures the response headers in the order in which
+// they were received using the connection used by net/http, provided
+// that such connection allows us to do that.
+type headersCapturer struct {
+	h1conn   *headercapture.Conn
+	h2conn   *h2capture.Conn
+	mu       sync.Mutex
+	streamID uint32
+}
+
+func (hc *headersCapturer) gotConn(conn net.Conn) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.h1conn, hc.h2conn, hc.streamID = nil, nil, 0
+	switch conn := conn.(type) {
+	case *headercapture.Conn:
+		conn.Arm()
+		hc.h1conn = conn
+	case *h2capture.Conn:
+		hc.h2conn = conn
+	}
+}
+
+func (hc *headersCapturer) wroteHeaders(
+	root *modelx.MeasurementRoot, transactionID int64,
+) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if hc.h2conn != nil {
+		hc.streamID = hc.h2conn.LastStreamID()
+		hc.h2conn.Bind(hc.streamID, root, transactionID)
+	}
+}
+
+func (hc *headersCapturer) responseHeaders(
+	resp *http.Response,
+) []modelx.HTTPHeaderField {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	switch {
+	case resp.ProtoMajor == 1 && hc.h1conn != nil:
+		return hc.h1conn.Headers()
+	case resp.ProtoMajor == 2 && hc.h2conn != nil && hc.streamID != 0:
+		return hc.h2conn.Headers(hc.streamID)
+	}
+	return nil
+}
+
+// forget tells the connection that the transaction has finished
+// without taking the headers, e.g., because the round trip failed.
+func (hc *headersCapturer) forget() {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if hc.h2conn != nil && hc.streamID != 0 {
+		hc.h2conn.Forget(hc.streamID)
+	}
+}
+
 // RoundTrip executes a single HTTP transaction, returning
 // a Response for the provided Request.
 func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	root := modelx.ContextMeasurementRootOrDefault(req.Context())
 
 	tid := transactionid.ContextTransactionID(req.Context())
+	parentID := transactionid.ContextParentTransactionID(req.Context())
+	var effective *modelx.Fronting
+	if f := modelx.ContextFronting(req.Context()); f != nil {
+		effective = fronting.Effective(req, f, t.tlsConfig())
+	}
 	root.Handler.OnMeasurement(modelx.Measurement{
 		HTTPRoundTripStart: &modelx.HTTPRoundTripStartEvent{
 			DialID:                 dialid.ContextDialID(req.Context()),
 			DurationSinceBeginning: time.Now().Sub(root.Beginning),
+			Fronting:               effective,
 			Method:                 req.Method,
+			ParentTransactionID:    parentID,
 			TransactionID:          tid,
 			URL:                    req.URL.String(),
 		},
 	})
 
 	var (
-		err              error
-		majorOp          = "http_round_trip"
-		majorOpMu        sync.Mutex
-		requestBody      []byte
-		requestHeaders   = http.Header{}
-		requestHeadersMu sync.Mutex
-		snapSize         = modelx.ComputeBodySnapSize(root.MaxBodySnapSize)
+		capturer           headersCapturer
+		err                error
+		majorOp            = "http_round_trip"
+		majorOpMu          sync.Mutex
+		requestBody        []byte
+		requestHeaders     = http.Header{}
+		requestHeadersList []modelx.HTTPHeaderField
+		requestHeadersMu   sync.Mutex
+		snapSize           = modelx.ComputeBodySnapSize(root.MaxBodySnapSize)
 	)
 
+	// When decompressing, tell the server we accept compressed bodies,
+	// unless the request already says which encodings it accepts.
+	decompress := decompressor.ContextEnabled(req.Context())
+	if decompress && req.Header.Get("Accept-Encoding") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Accept-Encoding", decompressor.AcceptEncoding)
+	}
+
 	// Save a snapshot of the request body
 	if req.Body != nil {
 		requestBody, err = readSnap(&req.Body, snapSize, t.readAll)
@@ -104,6 +187,18 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 		}
 	}
 
+	// Arrange for knowing the ConnID of the connections dialed on behalf
+	// of this request, since net/http will perform the TLS handshake
+	// on them without telling us which connection it is using.
+	ctx, recorder := connid.WithRecorder(req.Context())
+	req = req.WithContext(ctx)
+	collector := bodystats.ContextCollector(req.Context())
+	sni := t.serverName(req)
+	if effective != nil {
+		sni = effective.SNI
+	}
+	hook := tlsx.ContextVerificationHook(req.Context())
+
 	// Prepare a tracer for delivering events
 	tracer := &httptrace.ClientTrace{
 		TLSHandshakeStart: func() {
@@ -114,7 +209,9 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 			// configured in the http.Transport
 			root.Handler.OnMeasurement(modelx.Measurement{
 				TLSHandshakeStart: &modelx.TLSHandshakeStartEvent{
+					ConnID:                 recorder.ConnID(),
 					DurationSinceBeginning: time.Now().Sub(root.Beginning),
+					SNI:                    sni,
 					TransactionID:          tid,
 				},
 			})
@@ -122,17 +219,28 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
 			// Wrapping the error even if we're not returning it because it may
 			// less confusing to users to see the wrapped name
+			connID := recorder.ConnID()
 			err = errwrapper.SafeErrWrapperBuilder{
+				ConnID:        connID,
 				Error:         err,
 				Operation:     "tls_handshake",
 				TransactionID: tid,
 			}.MaybeBuild()
 			durationSinceBeginning := time.Now().Sub(root.Beginning)
+			connState := tlsx.NewConnectionState(
+				t.tlsConfig(), hook, sni, state, err,
+				errwrapper.SafeErrWrapperBuilder{
+					ConnID:        connID,
+					Operation:     "tls_handshake",
+					TransactionID: tid,
+				},
+			)
 			// Event emitted by net/http when DialTLS is not
 			// configured in the http.Transport
 			root.Handler.OnMeasurement(modelx.Measurement{
 				TLSHandshakeDone: &modelx.TLSHandshakeDoneEvent{
-					ConnectionState:        modelx.NewTLSConnectionState(state),
+					ConnID:                 connID,
+					ConnectionState:        connState,
 					Error:                  err,
 					DurationSinceBeginning: durationSinceBeginning,
 					TransactionID:          tid,
@@ -143,14 +251,20 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 			majorOpMu.Lock()
 			majorOp = "http_round_trip"
 			majorOpMu.Unlock()
+			capturer.gotConn(info.Conn)
+			// net/http may retry on another connection, in which case
+			// the headers will be written again.
+			requestHeadersMu.Lock()
+			requestHeadersList = nil
+			requestHeadersMu.Unlock()
 			root.Handler.OnMeasurement(modelx.Measurement{
 				HTTPConnectionReady: &modelx.HTTPConnectionReadyEvent{
-					ConnID: connid.Compute(
-						info.Conn.LocalAddr().Network(),
-						info.Conn.LocalAddr().String(),
-					),
+					ConnID:                 connid.Lookup(info.Conn),
 					DurationSinceBeginning: time.Now().Sub(root.Beginning),
+					IdleTime:               info.IdleTime,
+					Reused:                 info.Reused,
 					TransactionID:          tid,
+					WasIdle:                info.WasIdle,
 				},
 			})
 		},
@@ -161,6 +275,8 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 			// perform normalization of header names!
 			for _, value := range values {
 				requestHeaders.Add(key, value)
+				requestHeadersList = append(requestHeadersList,
+					modelx.HTTPHeaderField{Key: key, Value: value})
 			}
 			requestHeadersMu.Unlock()
 			root.Handler.OnMeasurement(modelx.Measurement{
@@ -173,6 +289,7 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 			})
 		},
 		WroteHeaders: func() {
+			capturer.wroteHeaders(root, tid)
 			root.Handler.OnMeasurement(modelx.Measurement{
 				HTTPRequestHeadersDone: &modelx.HTTPRequestHeadersDoneEvent{
 					DurationSinceBeginning: time.Now().Sub(root.Beginning),
@@ -200,6 +317,9 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 			})
 		},
 		GotFirstResponseByte: func() {
+			if collector != nil {
+				collector.FirstByte()
+			}
 			root.Handler.OnMeasurement(modelx.Measurement{
 				HTTPResponseStart: &modelx.HTTPResponseStartEvent{
 					DurationSinceBeginning: time.Now().Sub(root.Beginning),
@@ -235,17 +355,28 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	event := &modelx.HTTPRoundTripDoneEvent{
 		DurationSinceBeginning: time.Now().Sub(root.Beginning),
 		Error:                  err,
+		Fronting:               effective,
 		RequestBodySnap:        requestBody,
+		RequestCookies:         req.Cookies(),
 		RequestHeaders:         requestHeaders,   // [*]
 		RequestMethod:          req.Method,       // [*]
 		RequestURL:             req.URL.String(), // [*]
 		MaxBodySnapSize:        snapSize,
+		ParentTransactionID:    parentID,
 		TransactionID:          tid,
 	}
+	requestHeadersMu.Lock()
+	event.RequestHeadersList = requestHeadersList
+	requestHeadersMu.Unlock()
 	if resp != nil {
+		event.ResponseCookies = resp.Cookies()
 		event.ResponseHeaders = resp.Header
+		event.ResponseHeadersList = capturer.responseHeaders(resp)
 		event.ResponseStatusCode = int64(resp.StatusCode)
 		event.ResponseProto = resp.Proto
+		if collector != nil {
+			resp.Body = collector.Wrap(resp.Body)
+		}
 		// Save a snapshot of the response body
 		var data []byte
 		data, err = readSnap(&resp.Body, snapSize, t.readAll)
@@ -254,7 +385,12 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 			resp = nil // this is how net/http likes it
 		} else {
 			event.ResponseBodySnap = data
+			if decompress {
+				event.ResponseBodyDecodedSnap = maybeDecompress(resp, data, snapSize)
+			}
 		}
+	} else {
+		capturer.forget()
 	}
 	root.Handler.OnMeasurement(modelx.Measurement{
 		HTTPRoundTripDone: event,
@@ -262,6 +398,53 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	return resp, err
 }
 
+// maybeDecompress arranges for resp.Body to be decompressed, when the
+// content encoding is supported, like net/http does. It also returns
+// the decompressed version of data, the snapshot of the wire body.
+func maybeDecompress(resp *http.Response, data []byte, snapSize int64) []byte {
+	encoding := strings.Join(resp.Header.Values("Content-Encoding"), ",")
+	if !decompressor.Supported(encoding) {
+		return nil
+	}
+	// The snapshot may be truncated, hence we ignore the error
+	decoded, _ := ioutil.ReadAll(io.LimitReader(
+		decompressor.NewReader(encoding, bytes.NewReader(data)), snapSize))
+	resp.Body = decompressor.NewBody(encoding, resp.Body)
+	// The event references the original headers, so make a copy
+	resp.Header = resp.Header.Clone()
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return decoded
+}
+
+// tlsConfig returns the TLS config that net/http is going to use
+// when performing TLS handshakes, or nil if we don't know it.
+func (t *Transport) tlsConfig() *tls.Config {
+	type tlsConfigurer interface {
+		TLSClientConfig() *tls.Config
+	}
+	switch txp := t.roundTripper.(type) {
+	case *http.Transport:
+		return txp.TLSClientConfig
+	case tlsConfigurer:
+		return txp.TLSClientConfig()
+	}
+	return nil
+}
+
+// serverName returns the SNI that net/http is going to use when
+// performing the TLS handshake for req. That is the ServerName
+// configured in the *http.Transport, if any, otherwise the hostname
+// of the URL, which is also used when we're using a proxy.
+func (t *Transport) serverName(req *http.Request) string {
+	if config := t.tlsConfig(); config != nil && config.ServerName != "" {
+		return config.ServerName
+	}
+	return req.URL.Hostname()
+}
+
 // CloseIdleConnections closes the idle connections.
 func (t *Transport) CloseIdleConnections() {
 	// Adapted from net/http code
@@ -22,9 +22,22 @@ func New(roundTripper http.RoundTripper) *Transport {
 // RoundTrip executes a single HTTP transaction, returning
 // a Response for the provided Request.
 func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
-	return t.roundTripper.RoundTrip(req.WithContext(
-		transactionid.WithTransactionID(req.Context()),
-	))
+	// When following redirects, net/http sets req.Response to the
+	// response that caused the redirect. We always set the parent ID,
+	// possibly to zero, because DoH requests inherit the context.
+	var parentID int64
+	if req.Response != nil && req.Response.Request != nil {
+		parentID = transactionid.ContextTransactionID(
+			req.Response.Request.Context())
+	}
+	ctx := transactionid.WithTransactionID(req.Context())
+	ctx = transactionid.WithParentTransactionID(ctx, parentID)
+	req = req.WithContext(ctx)
+	resp, err := t.roundTripper.RoundTrip(req)
+	if resp != nil && resp.Request == nil {
+		resp.Request = req // allow redirects to find the parent ID
+	}
+	return resp, err
 }
 
 // CloseIdleConnections closes the idle connections.
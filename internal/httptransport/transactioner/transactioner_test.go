@@ -3,6 +3,8 @@ package transactioner
 import (
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
 
 	"github.com/ooni/netx/internal/transactionid"
@@ -55,3 +57,47 @@ func TestIntegrationFailure(t *testing.T) {
 	}
 	client.CloseIdleConnections()
 }
+
+type parentSaver struct {
+	mu      sync.Mutex
+	parents []int64
+	ids     []int64
+}
+
+func (ps *parentSaver) RoundTrip(req *http.Request) (*http.Response, error) {
+	ps.mu.Lock()
+	ps.ids = append(ps.ids, transactionid.ContextTransactionID(req.Context()))
+	ps.parents = append(ps.parents,
+		transactionid.ContextParentTransactionID(req.Context()))
+	ps.mu.Unlock()
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if resp != nil {
+		resp.Request = nil // make sure we fill it
+	}
+	return resp, err
+}
+
+func TestIntegrationParentTransactionID(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/" {
+				http.Redirect(w, r, "/final", http.StatusFound)
+			}
+		},
+	))
+	defer server.Close()
+	saver := new(parentSaver)
+	client := &http.Client{Transport: New(saver)}
+	defer client.CloseIdleConnections()
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(saver.ids) != 2 {
+		t.Fatal("expected two transactions")
+	}
+	if saver.parents[0] != 0 || saver.parents[1] != saver.ids[0] {
+		t.Fatal("unexpected parent transaction IDs")
+	}
+}
@@ -3,9 +3,13 @@ package internal
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
 	"errors"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -16,21 +20,38 @@ import (
 
 	"github.com/ooni/netx/handlers"
 	"github.com/ooni/netx/internal/dialer"
+	"github.com/ooni/netx/internal/dialer/binddialer"
+	"github.com/ooni/netx/internal/dialer/dnsdialer"
+	"github.com/ooni/netx/internal/dialer/segmenter"
+	"github.com/ooni/netx/internal/dialer/tlsdialer"
 	"github.com/ooni/netx/internal/errwrapper"
 	"github.com/ooni/netx/internal/httptransport"
+	"github.com/ooni/netx/internal/httptransport/bodystats"
+	"github.com/ooni/netx/internal/httptransport/decompressor"
+	"github.com/ooni/netx/internal/httptransport/fronting"
+	"github.com/ooni/netx/internal/httptransport/h2transport"
+	"github.com/ooni/netx/internal/httptransport/headercapture"
+	"github.com/ooni/netx/internal/httptransport/http3transport"
 	"github.com/ooni/netx/internal/resolver"
 	"github.com/ooni/netx/internal/resolver/chainresolver"
+	"github.com/ooni/netx/internal/tlsx"
 	"github.com/ooni/netx/modelx"
-	"golang.org/x/net/http2"
+	"github.com/quic-go/quic-go"
+	utls "github.com/refraction-networking/utls"
 )
 
 // Dialer defines the dialer API. We implement the most basic form
 // of DNS, but more advanced resolutions are possible.
 type Dialer struct {
-	Beginning time.Time
-	Handler   modelx.Handler
-	Resolver  modelx.DNSResolver
-	TLSConfig *tls.Config
+	Beginning        time.Time
+	ClientHelloID    *utls.ClientHelloID
+	Handler          modelx.Handler
+	KeyLogEvents     bool
+	NetDialer        *binddialer.Dialer
+	Resolver         modelx.DNSResolver
+	Segmentation     *segmenter.Plan
+	TLSConfig        *tls.Config
+	VerificationHook tlsx.VerificationHook
 }
 
 // NewDialer creates a new Dialer.
@@ -40,6 +61,7 @@ func NewDialer(
 	return &Dialer{
 		Beginning: beginning,
 		Handler:   handler,
+		NetDialer: binddialer.New(),
 		Resolver:  resolver.NewResolverSystem(),
 		TLSConfig: new(tls.Config),
 	}
@@ -67,10 +89,54 @@ func maybeWithMeasurementRoot(
 func (d *Dialer) DialContext(
 	ctx context.Context, network, address string,
 ) (conn net.Conn, err error) {
+	address, _ = maybeFront(ctx, address, nil)
+	return d.dialContext(ctx, network, address)
+}
+
+func (d *Dialer) dialContext(
+	ctx context.Context, network, address string,
+) (net.Conn, error) {
 	ctx = maybeWithMeasurementRoot(ctx, d.Beginning, d.Handler)
-	return dialer.New(
-		d.Resolver, new(net.Dialer),
-	).DialContext(ctx, network, address)
+	ctx = withoutFronting(ctx)
+	return d.newDNSDialer().DialContext(ctx, network, address)
+}
+
+// maybeFront applies the modelx.Fronting in ctx, if any, to the address
+// we should dial and to the TLS config, when not nil. Without an explicit
+// SNI, we use the hostname in the original address.
+func maybeFront(
+	ctx context.Context, address string, config *tls.Config,
+) (string, *tls.Config) {
+	f := modelx.ContextFronting(ctx)
+	if f == nil {
+		return address, config
+	}
+	if config != nil {
+		sni := f.SNI
+		if sni == "" && config.ServerName == "" {
+			sni, _, _ = net.SplitHostPort(address)
+		}
+		if sni != "" {
+			config = config.Clone()
+			config.ServerName = sni
+		}
+	}
+	return fronting.Address(f.Address, address), config
+}
+
+// withoutFronting clears the modelx.Fronting in ctx, if any, once we
+// have applied it, such that it does not affect the resolvers.
+func withoutFronting(ctx context.Context) context.Context {
+	if modelx.ContextFronting(ctx) == nil {
+		return ctx
+	}
+	return modelx.WithFronting(ctx, &modelx.Fronting{})
+}
+
+func (d *Dialer) newDNSDialer() *dnsdialer.Dialer {
+	dnsDialer := dialer.New(d.Resolver, d.NetDialer)
+	dnsDialer.Segmentation = d.Segmentation
+	return dnsDialer
 }
 
 // DialTLS is like Dial, but creates TLS connections.
@@ -83,21 +149,124 @@ func (d *Dialer) DialTLS(network, address string) (net.Conn, error) {
 func (d *Dialer) DialTLSContext(
 	ctx context.Context, network, address string,
 ) (net.Conn, error) {
+	address, config := maybeFront(ctx, address, d.TLSConfig)
+	return d.dialTLSContext(ctx, network, address, config)
+}
+
+func (d *Dialer) dialTLSContext(
+	ctx context.Context, network, address string, config *tls.Config,
+) (net.Conn, error) {
+	ctx = maybeWithMeasurementRoot(ctx, d.Beginning, d.Handler)
+	ctx = d.maybeWithVerificationHook(ctx)
+	ctx = withoutFronting(ctx)
+	tlsDialer := dialer.NewTLS(d.newDNSDialer(), config)
+	tlsDialer.ClientHelloID = d.ClientHelloID
+	tlsDialer.KeyLogEvents = d.KeyLogEvents
+	return tlsDialer.DialTLSContext(ctx, network, address)
+}
+
+// DialQUIC creates a QUIC connection. We use the configured TLS
+// settings, and we default to the "h3" ALPN when none is configured.
+func (d *Dialer) DialQUIC(address string) (quic.EarlyConnection, error) {
+	return d.DialQUICContext(context.Background(), address)
+}
+
+// DialQUICContext is like DialQUIC, but with context
+func (d *Dialer) DialQUICContext(
+	ctx context.Context, address string,
+) (quic.EarlyConnection, error) {
+	address, config := maybeFront(ctx, address, d.TLSConfig)
+	config = config.Clone()
+	if len(config.NextProtos) <= 0 {
+		config.NextProtos = []string{"h3"}
+	}
+	return d.dialQUICContext(ctx, address, config, nil)
+}
+
+func (d *Dialer) dialQUICContext(
+	ctx context.Context, address string, config *tls.Config,
+	quicConfig *quic.Config,
+) (quic.EarlyConnection, error) {
+	ctx = maybeWithMeasurementRoot(ctx, d.Beginning, d.Handler)
+	ctx = d.maybeWithVerificationHook(ctx)
+	ctx = withoutFronting(ctx)
+	quicDialer := dialer.NewQUIC(d.Resolver, config, quicConfig)
+	quicDialer.KeyLogEvents = d.KeyLogEvents
+	quicDialer.ListenPacket = d.NetDialer.ListenPacket
+	return quicDialer.DialQUICContext(ctx, address)
+}
+
+// ListenPacket creates a datagram socket. See net.ListenPacket docs.
+func (d *Dialer) ListenPacket(network, address string) (net.PacketConn, error) {
+	return d.ListenPacketContext(context.Background(), network, address)
+}
+
+// ListenPacketContext is like ListenPacket, but with context
+func (d *Dialer) ListenPacketContext(
+	ctx context.Context, network, address string,
+) (net.PacketConn, error) {
 	ctx = maybeWithMeasurementRoot(ctx, d.Beginning, d.Handler)
-	return dialer.NewTLS(
-		dialer.New(d.Resolver, new(net.Dialer)),
-		d.TLSConfig,
-	).DialTLSContext(ctx, network, address)
+	return dialer.NewPacketListener(d.NetDialer).ListenPacket(ctx, network, address)
 }
 
 // SetCABundle configures the dialer to use a specific CA bundle.
 func (d *Dialer) SetCABundle(path string) error {
-	cert, err := ioutil.ReadFile(path)
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return err
 	}
+	_, err = d.SetCABundleFromPEM(data, false)
+	return err
+}
+
+// SetCABundleFromPEM configures the dialer to use the CA bundle in
+// data, optionally appending it to the system roots. It returns the
+// number of certificates loaded from data.
+func (d *Dialer) SetCABundleFromPEM(
+	data []byte, appendToSystemRoots bool,
+) (int, error) {
 	pool := x509.NewCertPool()
-	pool.AppendCertsFromPEM(cert)
+	if appendToSystemRoots {
+		var err error
+		if pool, err = x509.SystemCertPool(); err != nil {
+			return 0, err
+		}
+	}
+	count := appendCertsFromPEM(pool, data)
+	if count < 1 {
+		return 0, errors.New("netx: no certificates found in CA bundle")
+	}
+	d.TLSConfig.RootCAs = pool
+	return count, nil
+}
+
+// appendCertsFromPEM is like x509.CertPool.AppendCertsFromPEM
+// except that it returns the number of certificates added.
+func appendCertsFromPEM(pool *x509.CertPool, data []byte) (count int) {
+	for len(data) > 0 {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" || len(block.Headers) != 0 {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		pool.AddCert(cert)
+		count++
+	}
+	return
+}
+
+// SetCAPool configures the dialer to use a specific CA pool.
+func (d *Dialer) SetCAPool(pool *x509.CertPool) error {
+	if pool == nil {
+		return errors.New("netx: nil CA pool")
+	}
 	d.TLSConfig.RootCAs = pool
 	return nil
 }
@@ -114,15 +283,181 @@ func (d *Dialer) ForceSkipVerify() error {
 	return nil
 }
 
+// SetTLSVersions sets the minimum and maximum TLS versions.
+func (d *Dialer) SetTLSVersions(min, max uint16) error {
+	if !isValidTLSVersion(min) || !isValidTLSVersion(max) {
+		return errors.New("netx: invalid TLS version")
+	}
+	if min != 0 && max != 0 && min > max {
+		return errors.New("netx: minimum TLS version above maximum")
+	}
+	d.TLSConfig.MinVersion = min
+	d.TLSConfig.MaxVersion = max
+	return nil
+}
+
+func isValidTLSVersion(version uint16) bool {
+	return version == 0 || (version >= tls.VersionTLS10 && version <= tls.VersionTLS13)
+}
+
+// SetCipherSuites sets the TLS cipher suites.
+func (d *Dialer) SetCipherSuites(suites []uint16) error {
+	if len(suites) < 1 {
+		return errors.New("netx: empty cipher suites list")
+	}
+	d.TLSConfig.CipherSuites = suites
+	return nil
+}
+
+// SetALPN sets the ALPN protocols.
+func (d *Dialer) SetALPN(protos []string) error {
+	d.TLSConfig.NextProtos = protos
+	return nil
+}
+
+// SetCurvePreferences sets the TLS curve preferences.
+func (d *Dialer) SetCurvePreferences(curves []tls.CurveID) error {
+	if len(curves) < 1 {
+		return errors.New("netx: empty curve preferences list")
+	}
+	d.TLSConfig.CurvePreferences = curves
+	return nil
+}
+
+// ForceDisableSessionTickets disables TLS session tickets.
+func (d *Dialer) ForceDisableSessionTickets() error {
+	d.TLSConfig.SessionTicketsDisabled = true
+	return nil
+}
+
+// EnableSessionResumption enables TLS session resumption.
+func (d *Dialer) EnableSessionResumption(capacity int) error {
+	d.TLSConfig.ClientSessionCache = tls.NewLRUClientSessionCache(capacity)
+	return nil
+}
+
+// SetKeyLogWriter configures the writer for TLS key log lines.
+func (d *Dialer) SetKeyLogWriter(w io.Writer) error {
+	d.TLSConfig.KeyLogWriter = w
+	return nil
+}
+
+// EnableKeyLogEvents enables emitting TLS secrets as events.
+func (d *Dialer) EnableKeyLogEvents() error {
+	d.KeyLogEvents = true
+	return nil
+}
+
+func (d *Dialer) maybeWithVerificationHook(ctx context.Context) context.Context {
+	if d.VerificationHook == nil {
+		return ctx
+	}
+	return tlsx.WithVerificationHook(ctx, d.VerificationHook)
+}
+
+// SetPinnedSPKIHashes pins the base64 encoded SHA-256 hashes of the
+// SubjectPublicKeyInfo of the leaf or of an intermediate certificate.
+func (d *Dialer) SetPinnedSPKIHashes(pins []string) error {
+	var hashes [][]byte
+	for _, pin := range pins {
+		hash, err := base64.StdEncoding.DecodeString(
+			strings.TrimPrefix(pin, "sha256/"))
+		if err != nil {
+			return err
+		}
+		if len(hash) != sha256.Size {
+			return errors.New("netx: invalid SPKI hash length")
+		}
+		hashes = append(hashes, hash)
+	}
+	d.TLSConfig.VerifyPeerCertificate = nil
+	if len(hashes) > 0 {
+		d.TLSConfig.VerifyPeerCertificate = tlsx.NewPinVerifier(hashes)
+	}
+	return nil
+}
+
+// SetVerificationHook sets the custom verification hook.
+func (d *Dialer) SetVerificationHook(hook tlsx.VerificationHook) error {
+	d.VerificationHook = hook
+	return nil
+}
+
+// SetWriteSegmentation configures how to segment the first write.
+func (d *Dialer) SetWriteSegmentation(
+	offsets []int, splitSNI bool, delay time.Duration,
+) error {
+	if delay < 0 {
+		return errors.New("netx: negative segmentation delay")
+	}
+	for _, off := range offsets {
+		if off <= 0 {
+			return errors.New("netx: non-positive segmentation offset")
+		}
+	}
+	d.Segmentation = nil
+	if len(offsets) > 0 || splitSNI {
+		d.Segmentation = &segmenter.Plan{
+			Delay:    delay,
+			Offsets:  append([]int{}, offsets...),
+			SplitSNI: splitSNI,
+		}
+	}
+	return nil
+}
+
+// SetClientHelloFingerprint sets the ClientHello fingerprint to parrot.
+func (d *Dialer) SetClientHelloFingerprint(name string) error {
+	id, err := tlsdialer.LookupClientHelloID(name)
+	if err == nil {
+		d.ClientHelloID = id
+	}
+	return err
+}
+
+// SetLocalAddress binds the sockets to a specific local address.
+func (d *Dialer) SetLocalAddress(address string) error {
+	return d.NetDialer.SetLocalAddress(address)
+}
+
+// BindToDevice binds the sockets to a specific network interface.
+func (d *Dialer) BindToDevice(device string) error {
+	return d.NetDialer.BindToDevice(device)
+}
+
 // ConfigureDNS implements netx.Dialer.ConfigureDNS.
 func (d *Dialer) ConfigureDNS(network, address string) error {
-	r, err := NewResolver(d.Beginning, d.Handler, network, address)
+	r, err := d.NewResolver(network, address)
 	if err == nil {
 		d.Resolver = r
 	}
 	return err
 }
 
+// NewResolver implements netx.Dialer.NewResolver.
+func (d *Dialer) NewResolver(
+	network, address string,
+) (modelx.DNSResolver, error) {
+	return newResolver(d.Beginning, d.Handler, network, address, d.childConfigurator())
+}
+
+// childConfigurator returns the function to configure the dialers
+// used by resolvers, or nil when there are no key log settings to
+// inherit, such that DoH can use the shared client.
+func (d *Dialer) childConfigurator() func(*Dialer) {
+	if !d.KeyLogEvents && d.TLSConfig.KeyLogWriter == nil {
+		return nil
+	}
+	return d.configureChild
+}
+
+// configureChild configures a dialer used by a resolver such that
+// it inherits the TLS key log settings of this dialer.
+func (d *Dialer) configureChild(child *Dialer) {
+	child.KeyLogEvents = d.KeyLogEvents
+	child.TLSConfig.KeyLogWriter = d.TLSConfig.KeyLogWriter
+}
+
 // SetResolver implements netx.Dialer.SetResolver.
 func (d *Dialer) SetResolver(r modelx.DNSResolver) {
 	d.Resolver = r
@@ -133,8 +468,10 @@ var (
 	dohClientOnce   sync.Once
 )
 
-func newHTTPClientForDoH(beginning time.Time, handler modelx.Handler) *http.Client {
-	if handler == handlers.NoHandler {
+func newHTTPClientForDoH(
+	beginning time.Time, handler modelx.Handler, configure func(*Dialer),
+) *http.Client {
+	if handler == handlers.NoHandler && configure == nil {
 		// A bit of extra complexity for a good reason: if the user is not
 		// interested into setting a default handler, then it is fine to
 		// always return the same *http.Client for DoH. This means that we
@@ -153,15 +490,21 @@ func newHTTPClientForDoH(beginning time.Time, handler modelx.Handler) *http.Clie
 		})
 		return dohClientHandle
 	}
-	// Otherwise, if the user wants to have a default handler, we
-	// return a transport that does not leak connections.
+	// Otherwise, if the user wants to have a default handler, or
+	// wants to configure the dialer, we return a transport that does
+	// not leak connections.
+	dialer := NewDialer(beginning, handler)
 	transport := NewHTTPTransport(
 		beginning,
 		handler,
-		NewDialer(beginning, handler),
+		dialer,
 		true, // DisableKeepAlives
 		http.ProxyFromEnvironment,
 	)
+	if configure != nil {
+		// Must be after NewHTTPTransport, which replaces the TLSConfig
+		configure(dialer)
+	}
 	return &http.Client{Transport: transport}
 }
 
@@ -223,9 +566,26 @@ func (r *resolverWrapper) LookupNS(ctx context.Context, name string) ([]*net.NS,
 	return r.resolver.LookupNS(ctx, name)
 }
 
+func newChildDialer(
+	beginning time.Time, handler modelx.Handler, configure func(*Dialer),
+) *Dialer {
+	child := NewDialer(beginning, handler)
+	if configure != nil {
+		configure(child)
+	}
+	return child
+}
+
 // NewResolver returns a new resolver
 func NewResolver(
 	beginning time.Time, handler modelx.Handler, network, address string,
+) (modelx.DNSResolver, error) {
+	return newResolver(beginning, handler, network, address, nil)
+}
+
+func newResolver(
+	beginning time.Time, handler modelx.Handler, network, address string,
+	configure func(*Dialer),
 ) (modelx.DNSResolver, error) {
 	// Implementation note: system need to be dealt with
 	// separately because it doesn't have any transport.
@@ -235,7 +595,7 @@ func NewResolver(
 	}
 	if network == "doh" {
 		return newResolverWrapper(beginning, handler, resolver.NewResolverHTTPS(
-			newHTTPClientForDoH(beginning, handler), address,
+			newHTTPClientForDoH(beginning, handler, configure), address,
 		)), nil
 	}
 	if network == "dot" {
@@ -243,7 +603,7 @@ func NewResolver(
 		// dialer will ask us to resolve, we'll tell the dialer to dial, it
 		// will ask us to resolve, ...
 		return newResolverWrapper(beginning, handler, resolver.NewResolverTLS(
-			NewDialer(beginning, handler), withPort(address, "853"),
+			newChildDialer(beginning, handler, configure), withPort(address, "853"),
 		)), nil
 	}
 	if network == "tcp" {
@@ -264,10 +624,15 @@ func NewResolver(
 // HTTPTransport performs single HTTP transactions and emits
 // measurement events as they happen.
 type HTTPTransport struct {
-	Transport    *http.Transport
-	Handler      modelx.Handler
-	Beginning    time.Time
-	roundTripper http.RoundTripper
+	Transport         *http.Transport
+	Handler           modelx.Handler
+	Beginning         time.Time
+	bodyStatsInterval time.Duration
+	decompress        bool
+	dialer            *Dialer
+	h2pool            *h2transport.Pool
+	roundTripper      http.RoundTripper
+	router            *http3transport.Transport
 }
 
 // NewHTTPTransport creates a new Transport.
@@ -288,21 +653,39 @@ func NewHTTPTransport(
 		TLSHandshakeTimeout:   10 * time.Second,
 		DisableKeepAlives:     disableKeepAlives,
 	}
-	ooniTransport := httptransport.New(baseTransport)
 	// Configure h2 and make sure that the custom TLSConfig we use for dialing
 	// is actually compatible with upgrading to h2. (This mainly means we
 	// need to make sure we include "h2" in the NextProtos array.) Because
-	// http2.ConfigureTransport only returns error when we have already
-	// configured http2, it is safe to ignore the return value.
-	http2.ConfigureTransport(baseTransport)
-	// Since we're not going to use our dialer for TLS, the main purpose of
-	// the following line is to make sure ForseSpecificSNI has impact on the
-	// config we are going to use when doing TLS. The code is as such since
-	// we used to force net/http through using dialer.DialTLS.
+	// h2transport.Configure only returns error when we have already
+	// configured http2, it is safe to ignore the error.
+	h2pool, _ := h2transport.Configure(baseTransport)
+	router := http3transport.New(baseTransport, dialer.dialQUICContext)
+	ooniTransport := httptransport.New(
+		fronting.New(baseTransport, h2pool, router))
+	// Make sure that the dialer, which performs the TLS handshakes on
+	// behalf of net/http, uses the config that h2transport.Configure has
+	// just made compatible with h2, and that ForceSpecificSNI and the
+	// other TLS settings have impact on such config.
 	dialer.TLSConfig = baseTransport.TLSClientConfig
+	// The same reasoning applies to HTTP/3, which will clone this config
+	// and force the "h3" ALPN before each QUIC handshake.
+	router.HTTP3.TLSClientConfig = dialer.TLSConfig
 	// Arrange the configuration such that we always use `dialer` for dialing
-	// cleartext connections. The net/http code will dial TLS connections.
-	baseTransport.DialContext = dialer.DialContext
+	// cleartext connections. We wrap such connections to capture the raw
+	// response headers, which works as long as net/http speaks cleartext
+	// HTTP/1.x with them. We do not let the dialer apply the modelx.Fronting,
+	// because we may be dialing a proxy. The fronting round tripper takes
+	// care of it. Likewise, we use `dialer` for TLS, except when using a
+	// proxy, where net/http performs the TLS handshake. See configureDialTLS.
+	baseTransport.DialContext = func(
+		ctx context.Context, network, address string,
+	) (net.Conn, error) {
+		conn, err := dialer.dialContext(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		return headercapture.New(conn), nil
+	}
 	// Better for Cloudflare DNS and also better because we have less
 	// noisy events and we can better understand what happened.
 	baseTransport.MaxConnsPerHost = 1
@@ -311,12 +694,190 @@ func NewHTTPTransport(
 	// back the true headers, such as Content-Length. This change is
 	// functional to OONI's goal of observing the network.
 	baseTransport.DisableCompression = true
-	return &HTTPTransport{
+	transport := &HTTPTransport{
 		Transport:    baseTransport,
 		Handler:      handler,
 		Beginning:    beginning,
+		dialer:       dialer,
+		h2pool:       h2pool,
 		roundTripper: ooniTransport,
+		router:       router,
+	}
+	transport.configureDialTLS()
+	return transport
+}
+
+// ForceHTTP3 forces using HTTP/3 for all https requests.
+func (t *HTTPTransport) ForceHTTP3() error {
+	t.router.SetMode(http3transport.ModeForce)
+	return nil
+}
+
+// EnableHTTP3AltSvc enables using HTTP/3 for https requests
+// after the origin has advertised it using Alt-Svc.
+func (t *HTTPTransport) EnableHTTP3AltSvc() error {
+	t.router.SetMode(http3transport.ModeAltSvc)
+	return nil
+}
+
+// EnableHTTP2FrameEvents enables emitting HTTP/2 frames as events.
+func (t *HTTPTransport) EnableHTTP2FrameEvents() error {
+	if t.h2pool == nil {
+		return errors.New("netx: HTTP/2 is not configured")
+	}
+	t.h2pool.EnableFrameEvents()
+	return nil
+}
+
+// EnableBodyStats enables computing response body statistics, sampling
+// the download progress every interval, rather than emitting events.
+func (t *HTTPTransport) EnableBodyStats(interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("netx: body stats interval must be positive")
+	}
+	t.bodyStatsInterval = interval
+	return nil
+}
+
+// EnableDecompression enables decompressing the response bodies
+// while still saving the bytes received from the wire.
+func (t *HTTPTransport) EnableDecompression() error {
+	t.decompress = true
+	return nil
+}
+
+// SetMaxConnsPerHost sets the maximum number of connections per host,
+// where zero means no limit.
+func (t *HTTPTransport) SetMaxConnsPerHost(max int) error {
+	if max < 0 {
+		return errors.New("netx: negative max conns per host")
+	}
+	t.Transport.MaxConnsPerHost = max
+	return nil
+}
+
+// SetMaxIdleConns sets the maximum number of idle connections and
+// the maximum number of idle connections per host.
+func (t *HTTPTransport) SetMaxIdleConns(max, maxPerHost int) error {
+	if max < 0 || maxPerHost < 0 {
+		return errors.New("netx: negative max idle conns")
+	}
+	t.Transport.MaxIdleConns = max
+	t.Transport.MaxIdleConnsPerHost = maxPerHost
+	return nil
+}
+
+// SetIdleConnTimeout sets for how long an idle connection remains
+// in the pool, where zero means forever.
+func (t *HTTPTransport) SetIdleConnTimeout(timeout time.Duration) error {
+	if timeout < 0 {
+		return errors.New("netx: negative idle conn timeout")
+	}
+	t.Transport.IdleConnTimeout = timeout
+	return nil
+}
+
+// ForceNewConnections disables keep-alives, such that we use a new
+// connection for each transaction, and closes the idle connections.
+func (t *HTTPTransport) ForceNewConnections() error {
+	t.Transport.DisableKeepAlives = true
+	t.CloseIdleConnections()
+	return nil
+}
+
+// SetClientHelloFingerprint sets the ClientHello fingerprint to parrot
+// and arranges for using the dialer for TLS when needed.
+func (t *HTTPTransport) SetClientHelloFingerprint(name string) error {
+	if err := t.dialer.SetClientHelloFingerprint(name); err != nil {
+		return err
+	}
+	t.configureDialTLS()
+	return nil
+}
+
+// EnableKeyLogEvents enables emitting TLS secrets as events.
+func (t *HTTPTransport) EnableKeyLogEvents() error {
+	return t.dialer.EnableKeyLogEvents()
+}
+
+// configureDialTLS configures how the dialer performs the TLS handshakes
+// for net/http. Using the dialer rather than letting net/http perform
+// the handshake allows us to capture the raw HTTP/1.x headers, to emit
+// key log events and plaintext, and to parrot a ClientHello.
+func (t *HTTPTransport) configureDialTLS() {
+	t.Transport.DialTLS = nil
+	t.Transport.DialTLSContext = t.dialTLSContext
+	if t.dialer.ClientHelloID != nil {
+		t.Transport.DialTLSContext = t.dialTLS
+	}
+}
+
+func (t *HTTPTransport) dialTLS(
+	ctx context.Context, network, address string,
+) (net.Conn, error) {
+	// We clear NextProtos to offer the ALPN of the parroted browser. Since
+	// the connection is not a *tls.Conn, net/http will not use h2 even
+	// when negotiated, hence we let h2transport adopt the connection.
+	config := frontedConfig(ctx, t.dialer.TLSConfig).Clone()
+	config.NextProtos = nil
+	conn, err := t.dialer.dialTLSContext(ctx, network, address, config)
+	if err != nil {
+		return nil, err
+	}
+	if negotiatedProtocol(conn) == "h2" {
+		return nil, h2transport.Adopt(ctx, address, conn)
+	}
+	return headercapture.New(conn), nil
+}
+
+func (t *HTTPTransport) dialTLSContext(
+	ctx context.Context, network, address string,
+) (net.Conn, error) {
+	// Here we can use the configured ALPN, including h2, because
+	// net/http uses h2 when we return a *tls.Conn. This is not the
+	// case when there is a plaintext hook, which wraps the conn.
+	config := frontedConfig(ctx, t.dialer.TLSConfig)
+	root := modelx.ContextMeasurementRoot(ctx)
+	if root != nil && root.PlaintextHook != nil {
+		config = config.Clone()
+		config.NextProtos = []string{"http/1.1"}
+	}
+	conn, err := t.dialer.dialTLSContext(ctx, network, address, config)
+	if err != nil {
+		return nil, err
 	}
+	return maybeCaptureHeaders(conn), nil
+}
+
+// frontedConfig returns a config using the SNI in the modelx.Fronting
+// in ctx, if any, which is set by the fronting round tripper.
+func frontedConfig(ctx context.Context, config *tls.Config) *tls.Config {
+	if f := modelx.ContextFronting(ctx); f != nil && f.SNI != "" {
+		config = config.Clone()
+		config.ServerName = f.SNI
+	}
+	return config
+}
+
+// maybeCaptureHeaders wraps conn to capture the raw response headers
+// unless we've negotiated h2, since net/http only uses h2 with a
+// *tls.Conn. In such case, h2transport will capture the headers.
+func maybeCaptureHeaders(conn net.Conn) net.Conn {
+	if negotiatedProtocol(conn) == "h2" {
+		return conn
+	}
+	return headercapture.New(conn)
+}
+
+// negotiatedProtocol returns the ALPN protocol negotiated by conn.
+func negotiatedProtocol(conn net.Conn) string {
+	type connectionStater interface {
+		ConnectionState() tls.ConnectionState
+	}
+	if cs, ok := conn.(connectionStater); ok {
+		return cs.ConnectionState().NegotiatedProtocol
+	}
+	return ""
 }
 
 // RoundTrip executes a single HTTP transaction, returning
@@ -325,6 +886,11 @@ func (t *HTTPTransport) RoundTrip(
 	req *http.Request,
 ) (resp *http.Response, err error) {
 	ctx := maybeWithMeasurementRoot(req.Context(), t.Beginning, t.Handler)
+	ctx = t.dialer.maybeWithVerificationHook(ctx)
+	// Always set the following, such that the settings of the transport
+	// used by DoH do not depend on the settings of this transport.
+	ctx = bodystats.WithInterval(ctx, t.bodyStatsInterval)
+	ctx = decompressor.WithEnabled(ctx, t.decompress)
 	req = req.WithContext(ctx)
 	resp, err = t.roundTripper.RoundTrip(req)
 	// For safety wrap the error as "http_round_trip" but this
@@ -346,6 +912,10 @@ func (t *HTTPTransport) CloseIdleConnections() {
 	if tr, ok := t.roundTripper.(closeIdler); ok {
 		tr.CloseIdleConnections()
 	}
+	// net/http cannot close the idle h2 connections for us
+	if t.h2pool != nil {
+		t.h2pool.CloseIdleConnections()
+	}
 }
 
 // ChainResolvers chains a primary and a secondary resolver such that
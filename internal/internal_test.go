@@ -2,19 +2,24 @@ package internal
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"errors"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/ooni/netx/handlers"
 	"github.com/ooni/netx/internal/resolver/brokenresolver"
 	"github.com/ooni/netx/internal/resolver/systemresolver"
+	"github.com/ooni/netx/modelx"
 )
 
 func TestIntegrationDial(t *testing.T) {
@@ -107,6 +112,109 @@ func TestDialerSetCABundleNonexisting(t *testing.T) {
 	}
 }
 
+func TestDialerSetCABundleInvalid(t *testing.T) {
+	dialer := NewDialer(time.Now(), handlers.NoHandler)
+	err := dialer.SetCABundle("internal.go")
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if dialer.TLSConfig.RootCAs != nil {
+		t.Fatal("expected the roots not to be changed")
+	}
+}
+
+func TestDialerSetCABundleFromPEM(t *testing.T) {
+	data, err := ioutil.ReadFile("../testdata/cacert.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, appendToSystemRoots := range []bool{false, true} {
+		dialer := NewDialer(time.Now(), handlers.NoHandler)
+		count, err := dialer.SetCABundleFromPEM(data, appendToSystemRoots)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 2 {
+			t.Fatal("unexpected number of certificates", count)
+		}
+		subjects := len(dialer.TLSConfig.RootCAs.Subjects())
+		if !appendToSystemRoots && subjects != 2 {
+			t.Fatal("expected the bundle to replace the roots")
+		}
+		if appendToSystemRoots && subjects <= 2 {
+			t.Fatal("expected the bundle to be appended to the system roots")
+		}
+	}
+}
+
+func TestDialerSetCABundleFromPEMNoCerts(t *testing.T) {
+	dialer := NewDialer(time.Now(), handlers.NoHandler)
+	count, err := dialer.SetCABundleFromPEM([]byte("antani"), false)
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if count != 0 {
+		t.Fatal("expected zero certificates")
+	}
+}
+
+func TestIntegrationDialerSetCAPool(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {},
+	))
+	defer server.Close()
+	dialer := NewDialer(time.Now(), handlers.NoHandler)
+	if err := dialer.SetCAPool(nil); err == nil {
+		t.Fatal("expected an error here")
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	if err := dialer.SetCAPool(pool); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.DialTLS("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestDialerFronting(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {},
+	))
+	defer server.Close()
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer := NewDialer(time.Now(), handlers.NoHandler)
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	if err := dialer.SetCAPool(pool); err != nil {
+		t.Fatal(err)
+	}
+	for _, fronting := range []*modelx.Fronting{
+		{Address: "127.0.0.1"},
+		{Address: "127.0.0.1", SNI: "example.com"},
+	} {
+		address := "example.com:" + port
+		if fronting.SNI != "" {
+			address = "www.example.org.invalid:" + port
+		}
+		ctx := modelx.WithFronting(context.Background(), fronting)
+		conn, err := dialer.DialTLSContext(ctx, "tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state := conn.(*tls.Conn).ConnectionState()
+		conn.Close()
+		if state.ServerName != "example.com" {
+			t.Fatal("unexpected SNI", state.ServerName)
+		}
+	}
+}
+
 func TestDialerSetCABundleWAI(t *testing.T) {
 	dialer := NewDialer(time.Now(), handlers.NoHandler)
 	err := dialer.SetCABundle("../testdata/cacert.pem")
@@ -142,6 +250,242 @@ func TestDialerForceSpecificSNI(t *testing.T) {
 	}
 }
 
+type eventSaver struct {
+	mu     sync.Mutex
+	events []modelx.Measurement
+}
+
+func (h *eventSaver) OnMeasurement(m modelx.Measurement) {
+	h.mu.Lock()
+	h.events = append(h.events, m)
+	h.mu.Unlock()
+}
+
+func (h *eventSaver) connects() (out []*modelx.ConnectEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, ev := range h.events {
+		if ev.Connect != nil {
+			out = append(out, ev.Connect)
+		}
+	}
+	return
+}
+
+func TestIntegrationDialerSetLocalAddress(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	handler := new(eventSaver)
+	dialer := NewDialer(time.Now(), handler)
+	if err := dialer.SetLocalAddress("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	connects := handler.connects()
+	if len(connects) != 1 {
+		t.Fatal("unexpected number of connect events")
+	}
+	if connects[0].LocalAddress != conn.LocalAddr().String() {
+		t.Fatal("unexpected local address in connect event")
+	}
+	if connects[0].LocalPort != int64(conn.LocalAddr().(*net.TCPAddr).Port) {
+		t.Fatal("unexpected local port in connect event")
+	}
+}
+
+func TestIntegrationHTTPTransportConnID(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {},
+	))
+	defer server.Close()
+	handler := new(eventSaver)
+	dialer := NewDialer(time.Now(), handler)
+	transport := NewHTTPTransport(
+		time.Now(), handler, dialer, false, nil,
+	)
+	dialer.ForceSkipVerify()
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		// Make sure the next request uses another connection
+		transport.CloseIdleConnections()
+	}
+	connects := handler.connects()
+	if len(connects) != 2 {
+		t.Fatal("unexpected number of connect events")
+	}
+	if connects[0].ConnID == 0 || connects[0].ConnID == connects[1].ConnID {
+		t.Fatal("expected distinct, nonzero ConnIDs")
+	}
+	var ready []int64
+	for _, ev := range handler.events {
+		if ev.HTTPConnectionReady != nil {
+			ready = append(ready, ev.HTTPConnectionReady.ConnID)
+		}
+	}
+	if len(ready) != 2 {
+		t.Fatal("unexpected number of connection ready events")
+	}
+	for idx := range ready {
+		if ready[idx] != connects[idx].ConnID {
+			t.Fatal("ConnID mismatch")
+		}
+	}
+	var starts []*modelx.TLSHandshakeStartEvent
+	var dones []*modelx.TLSHandshakeDoneEvent
+	for _, ev := range handler.events {
+		if ev.TLSHandshakeStart != nil {
+			starts = append(starts, ev.TLSHandshakeStart)
+		}
+		if ev.TLSHandshakeDone != nil {
+			dones = append(dones, ev.TLSHandshakeDone)
+		}
+	}
+	if len(starts) != 2 || len(dones) != 2 {
+		t.Fatal("unexpected number of TLS handshake events")
+	}
+	for idx := range starts {
+		if starts[idx].ConnID != connects[idx].ConnID {
+			t.Fatal("TLSHandshakeStart ConnID mismatch")
+		}
+		if starts[idx].TransactionID != connects[idx].TransactionID {
+			t.Fatal("TLSHandshakeStart TransactionID mismatch")
+		}
+		if starts[idx].SNI != "127.0.0.1" {
+			t.Fatal("unexpected SNI")
+		}
+		if dones[idx].ConnID != connects[idx].ConnID {
+			t.Fatal("TLSHandshakeDone ConnID mismatch")
+		}
+		if dones[idx].TransactionID == 0 {
+			t.Fatal("TLSHandshakeDone without TransactionID")
+		}
+		if dones[idx].ConnectionState.VerificationError == nil {
+			t.Fatal("expected a verification error with ForceSkipVerify")
+		}
+	}
+}
+
+func TestIntegrationDialerSetLocalAddressQUIC(t *testing.T) {
+	pconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pconn.Close()
+	handler := new(eventSaver)
+	dialer := NewDialer(time.Now(), handler)
+	if err := dialer.SetLocalAddress("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	// The peer never answers, so we only care about the start event
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := dialer.DialQUICContext(ctx, pconn.LocalAddr().String()); err == nil {
+		t.Fatal("expected an error here")
+	}
+	var start *modelx.QUICHandshakeStartEvent
+	handler.mu.Lock()
+	for _, ev := range handler.events {
+		if ev.QUICHandshakeStart != nil {
+			start = ev.QUICHandshakeStart
+		}
+	}
+	handler.mu.Unlock()
+	if start == nil || !strings.HasPrefix(start.LocalAddress, "127.0.0.1:") {
+		t.Fatal("the QUIC socket is not bound to the local address")
+	}
+}
+
+func TestDialerSetLocalAddressInvalid(t *testing.T) {
+	dialer := NewDialer(time.Now(), handlers.NoHandler)
+	if err := dialer.SetLocalAddress("antani"); err == nil {
+		t.Fatal("expected an error here")
+	}
+}
+
+func TestIntegrationDialerTLSSettings(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {},
+	))
+	defer server.Close()
+	dialer := NewDialer(time.Now(), handlers.NoHandler)
+	dialer.ForceSkipVerify()
+	if err := dialer.SetTLSVersions(tls.VersionTLS12, tls.VersionTLS12); err != nil {
+		t.Fatal(err)
+	}
+	if err := dialer.SetALPN([]string{"http/1.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dialer.SetCipherSuites([]uint16{
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dialer.SetCurvePreferences([]tls.CurveID{tls.CurveP256}); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.DialTLS("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	state := conn.(*tls.Conn).ConnectionState()
+	if state.Version != tls.VersionTLS12 {
+		t.Fatal("unexpected TLS version")
+	}
+	if state.CipherSuite != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Fatal("unexpected cipher suite")
+	}
+	if state.NegotiatedProtocol != "http/1.1" {
+		t.Fatal("unexpected ALPN")
+	}
+}
+
+func TestDialerSetTLSVersionsInvalid(t *testing.T) {
+	dialer := NewDialer(time.Now(), handlers.NoHandler)
+	if err := dialer.SetTLSVersions(tls.VersionSSL30, 0); err == nil {
+		t.Fatal("expected an error here")
+	}
+	if err := dialer.SetTLSVersions(tls.VersionTLS13, tls.VersionTLS12); err == nil {
+		t.Fatal("expected an error here")
+	}
+}
+
+func TestDialerSetEmptyLists(t *testing.T) {
+	dialer := NewDialer(time.Now(), handlers.NoHandler)
+	if err := dialer.SetCipherSuites(nil); err == nil {
+		t.Fatal("expected an error here")
+	}
+	if err := dialer.SetCurvePreferences(nil); err == nil {
+		t.Fatal("expected an error here")
+	}
+}
+
+func TestDialerSessionSettings(t *testing.T) {
+	dialer := NewDialer(time.Now(), handlers.NoHandler)
+	dialer.ForceDisableSessionTickets()
+	dialer.EnableSessionResumption(0)
+	if !dialer.TLSConfig.SessionTicketsDisabled {
+		t.Fatal("expected session tickets to be disabled")
+	}
+	if dialer.TLSConfig.ClientSessionCache == nil {
+		t.Fatal("expected a client session cache")
+	}
+}
+
 func testresolverquick(t *testing.T, network, address string) {
 	resolver, err := NewResolver(time.Now(), handlers.NoHandler, network, address)
 	if err != nil {
@@ -386,18 +730,339 @@ func TestLookupNSWrapper(t *testing.T) {
 
 func TestUnitNewHTTPClientForDoH(t *testing.T) {
 	first := newHTTPClientForDoH(
-		time.Now(), handlers.NoHandler,
+		time.Now(), handlers.NoHandler, nil,
 	)
 	second := newHTTPClientForDoH(
-		time.Now(), handlers.NoHandler,
+		time.Now(), handlers.NoHandler, nil,
 	)
 	if first != second {
 		t.Fatal("expected to see same client here")
 	}
 	third := newHTTPClientForDoH(
-		time.Now(), handlers.StdoutHandler,
+		time.Now(), handlers.StdoutHandler, nil,
 	)
 	if first == third {
 		t.Fatal("expected to see different client here")
 	}
+	fourth := newHTTPClientForDoH(
+		time.Now(), handlers.NoHandler, func(*Dialer) {},
+	)
+	if first == fourth {
+		t.Fatal("expected to see different client here")
+	}
+}
+
+func TestUnitDialerChildConfigurator(t *testing.T) {
+	dialer := NewDialer(time.Now(), handlers.NoHandler)
+	if dialer.childConfigurator() != nil {
+		t.Fatal("expected nil configurator without key log settings")
+	}
+	if err := dialer.SetKeyLogWriter(new(lockedBuffer)); err != nil {
+		t.Fatal(err)
+	}
+	if dialer.childConfigurator() == nil {
+		t.Fatal("expected configurator with a key log writer")
+	}
+	dialer = NewDialer(time.Now(), handlers.NoHandler)
+	if err := dialer.EnableKeyLogEvents(); err != nil {
+		t.Fatal(err)
+	}
+	if dialer.childConfigurator() == nil {
+		t.Fatal("expected configurator with key log events")
+	}
+}
+
+func TestIntegrationHTTPTransportWriteSegmentation(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {},
+	))
+	defer server.Close()
+	handler := new(eventSaver)
+	dialer := NewDialer(time.Now(), handler)
+	transport := NewHTTPTransport(
+		time.Now(), handler, dialer, false, nil,
+	)
+	dialer.ForceSkipVerify()
+	dialer.ForceSpecificSNI("www.example.com")
+	if err := dialer.SetWriteSegmentation([]int{1}, true, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	connects := handler.connects()
+	if len(connects) != 1 {
+		t.Fatal("unexpected number of connect events")
+	}
+	var segmentations []*modelx.WriteSegmentationEvent
+	var writes []*modelx.WriteEvent
+	for _, ev := range handler.events {
+		if ev.WriteSegmentation != nil {
+			segmentations = append(segmentations, ev.WriteSegmentation)
+		}
+		if ev.Write != nil && len(segmentations) == 1 {
+			writes = append(writes, ev.Write)
+		}
+	}
+	if len(segmentations) != 1 {
+		t.Fatal("unexpected number of segmentation events")
+	}
+	segmentation := segmentations[0]
+	if segmentation.ConnID != connects[0].ConnID {
+		t.Fatal("ConnID mismatch")
+	}
+	if len(segmentation.Offsets) != 3 || segmentation.Offsets[0] != 1 {
+		t.Fatal("unexpected offsets", segmentation.Offsets)
+	}
+	if len(writes) < 4 {
+		t.Fatal("expected the first write to be split into four writes")
+	}
+	var total int64
+	for _, ev := range writes[:4] {
+		total += ev.NumBytes
+	}
+	if total != segmentation.NumBytes {
+		t.Fatal("unexpected number of bytes written")
+	}
+}
+
+func TestDialerSetWriteSegmentation(t *testing.T) {
+	dialer := NewDialer(time.Now(), handlers.NoHandler)
+	if err := dialer.SetWriteSegmentation([]int{0}, false, 0); err == nil {
+		t.Fatal("expected an error here")
+	}
+	if err := dialer.SetWriteSegmentation(nil, true, -1); err == nil {
+		t.Fatal("expected an error here")
+	}
+	if err := dialer.SetWriteSegmentation([]int{3}, false, 0); err != nil {
+		t.Fatal(err)
+	}
+	if dialer.Segmentation == nil {
+		t.Fatal("expected segmentation to be enabled")
+	}
+	if err := dialer.SetWriteSegmentation(nil, false, 0); err != nil {
+		t.Fatal(err)
+	}
+	if dialer.Segmentation != nil {
+		t.Fatal("expected segmentation to be disabled")
+	}
+}
+
+func TestIntegrationDialerSetPinnedSPKIHashes(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {},
+	))
+	defer server.Close()
+	hash := sha256.Sum256(server.Certificate().RawSubjectPublicKeyInfo)
+	good := "sha256/" + base64.StdEncoding.EncodeToString(hash[:])
+	other := sha256.Sum256([]byte("antani"))
+	bad := base64.StdEncoding.EncodeToString(other[:])
+	dialer := NewDialer(time.Now(), handlers.NoHandler)
+	dialer.ForceSkipVerify()
+	if err := dialer.SetPinnedSPKIHashes([]string{bad, good}); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.DialTLS("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if err := dialer.SetPinnedSPKIHashes([]string{bad}); err != nil {
+		t.Fatal(err)
+	}
+	conn, err = dialer.DialTLS("tcp", server.Listener.Addr().String())
+	if err == nil {
+		conn.Close()
+		t.Fatal("expected an error here")
+	}
+	var wrapper *modelx.ErrWrapper
+	if !errors.As(err, &wrapper) || wrapper.Failure != "ssl_pinning_error" {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+func TestDialerSetPinnedSPKIHashesInvalid(t *testing.T) {
+	dialer := NewDialer(time.Now(), handlers.NoHandler)
+	if err := dialer.SetPinnedSPKIHashes([]string{"@@@"}); err == nil {
+		t.Fatal("expected an error here")
+	}
+	if err := dialer.SetPinnedSPKIHashes([]string{"YW50YW5p"}); err == nil {
+		t.Fatal("expected an error here")
+	}
+	if dialer.TLSConfig.VerifyPeerCertificate != nil {
+		t.Fatal("expected pinning to be disabled")
+	}
+}
+
+func TestIntegrationHTTPTransportVerificationHook(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {},
+	))
+	defer server.Close()
+	handler := new(eventSaver)
+	dialer := NewDialer(time.Now(), handler)
+	transport := NewHTTPTransport(
+		time.Now(), handler, dialer, false, nil,
+	)
+	dialer.ForceSkipVerify()
+	dialer.SetVerificationHook(func(sni string, state tls.ConnectionState) error {
+		return errors.New("mocked error")
+	})
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	var dones []*modelx.TLSHandshakeDoneEvent
+	for _, ev := range handler.events {
+		if ev.TLSHandshakeDone != nil {
+			dones = append(dones, ev.TLSHandshakeDone)
+		}
+	}
+	if len(dones) != 1 {
+		t.Fatal("unexpected number of TLS handshake events")
+	}
+	var wrapper *modelx.ErrWrapper
+	err = dones[0].ConnectionState.CustomVerificationError
+	if !errors.As(err, &wrapper) {
+		t.Fatal("expected a wrapped custom verification error")
+	}
+	if wrapper.Failure != "ssl_custom_verification_error" {
+		t.Fatal("unexpected failure", wrapper.Failure)
+	}
+	if wrapper.TransactionID == 0 || wrapper.ConnID == 0 {
+		t.Fatal("expected nonzero TransactionID and ConnID")
+	}
+}
+
+func TestIntegrationDialTLSConnSnapAndPlaintextHook(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {},
+	))
+	defer server.Close()
+	saver := new(eventSaver)
+	var (
+		plaintext   []byte
+		plaintextMu sync.Mutex
+	)
+	ctx := modelx.WithMeasurementRoot(context.Background(), &modelx.MeasurementRoot{
+		Beginning:       time.Now(),
+		Handler:         saver,
+		MaxConnSnapSize: 1 << 10,
+		PlaintextHook: func(connID int64, operation string, data []byte) {
+			plaintextMu.Lock()
+			defer plaintextMu.Unlock()
+			if operation == "write" {
+				plaintext = append(plaintext, data...)
+			}
+		},
+	})
+	dialer := NewDialer(time.Now(), handlers.NoHandler)
+	dialer.ForceSkipVerify()
+	conn, err := dialer.DialTLSContext(ctx, "tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request := "GET / HTTP/1.0\r\n\r\n"
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Fatal(err)
+	}
+	plaintextMu.Lock()
+	if string(plaintext) != request {
+		t.Fatal("unexpected plaintext")
+	}
+	plaintextMu.Unlock()
+	saver.mu.Lock()
+	defer saver.mu.Unlock()
+	var written []byte
+	for _, ev := range saver.events {
+		if ev.Write != nil {
+			written = append(written, ev.Write.Data...)
+		}
+	}
+	// The first byte is the type of the first TLS record, which
+	// must be a handshake record containing the ClientHello.
+	if len(written) <= 0 || written[0] != 22 {
+		t.Fatal("expected to see the ciphertext")
+	}
+	if strings.Contains(string(written), request) {
+		t.Fatal("did not expect to see the plaintext")
+	}
+}
+
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestIntegrationResolverInheritsKeyLogSettings(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {},
+	))
+	defer server.Close()
+	for _, config := range []struct {
+		network string
+		address string
+	}{
+		{"doh", server.URL},
+		{"dot", server.Listener.Addr().String()},
+	} {
+		saver := new(eventSaver)
+		keylog := new(lockedBuffer)
+		dialer := NewDialer(time.Now(), saver)
+		if err := dialer.SetKeyLogWriter(keylog); err != nil {
+			t.Fatal(err)
+		}
+		if err := dialer.EnableKeyLogEvents(); err != nil {
+			t.Fatal(err)
+		}
+		if err := dialer.ConfigureDNS(config.network, config.address); err != nil {
+			t.Fatal(err)
+		}
+		// We expect the lookup to fail because the resolver does not
+		// trust the certificate, but TLSv1.3 logs the handshake secrets
+		// before verifying the certificate.
+		_, err := dialer.Resolver.LookupHost(context.Background(), "example.com")
+		if err == nil {
+			t.Fatal("expected an error here")
+		}
+		if !strings.Contains(keylog.String(), "CLIENT_HANDSHAKE_TRAFFIC_SECRET ") {
+			t.Fatal("expected to see the TLS secrets for", config.network)
+		}
+		var found bool
+		saver.mu.Lock()
+		for _, ev := range saver.events {
+			if ev.TLSKeyLog != nil && ev.TLSKeyLog.ConnID != 0 {
+				found = true
+			}
+		}
+		saver.mu.Unlock()
+		if !found {
+			t.Fatal("expected to see key log events for", config.network)
+		}
+	}
 }
@@ -0,0 +1,170 @@
+// Package tlsx contains crypto/tls extensions
+package tlsx
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/ooni/netx/internal/errwrapper"
+	"github.com/ooni/netx/modelx"
+)
+
+// ErrNoPeerCertificates indicates that the server did not
+// send us any certificate to verify.
+var ErrNoPeerCertificates = errors.New("tlsx: no peer certificates")
+
+// Verify verifies the certificate chain sent by the server using the
+// roots and the time configured in config and the provided serverName.
+// This is the same check that crypto/tls would perform when not using
+// InsecureSkipVerify. It returns the verified chains on success.
+func Verify(
+	config *tls.Config, serverName string, state tls.ConnectionState,
+) ([][]*x509.Certificate, error) {
+	if len(state.PeerCertificates) < 1 {
+		return nil, ErrNoPeerCertificates
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       serverName,
+		Intermediates: x509.NewCertPool(),
+		Roots:         config.RootCAs,
+	}
+	if config.Time != nil {
+		opts.CurrentTime = config.Time()
+	}
+	for _, cert := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	return state.PeerCertificates[0].Verify(opts)
+}
+
+// NewPinVerifier returns a function suitable for tls.Config's
+// VerifyPeerCertificate that fails with modelx.ErrTLSPinning unless
+// the SHA-256 of the SubjectPublicKeyInfo of at least one certificate
+// in the verified chains is in pins. We never look at the other
+// certificates sent by the server, since anyone can append a copy of
+// a public pinned certificate to an otherwise unrelated chain. When
+// InsecureSkipVerify is set, there are no verified chains, hence we
+// only check the leaf certificate sent by the server.
+func NewPinVerifier(
+	pins [][]byte,
+) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		var certs []*x509.Certificate
+		for _, chain := range verifiedChains {
+			certs = append(certs, chain...)
+		}
+		if len(verifiedChains) < 1 && len(rawCerts) > 0 {
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			certs = append(certs, cert)
+		}
+		for _, cert := range certs {
+			hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if bytes.Equal(hash[:], pin) {
+					return nil
+				}
+			}
+		}
+		return modelx.ErrTLSPinning
+	}
+}
+
+// VerificationHook is a custom verification function that runs after
+// a successful TLS handshake. Returning an error does not abort the
+// handshake but the error is recorded in the TLSHandshakeDone event.
+type VerificationHook func(serverName string, state tls.ConnectionState) error
+
+type contextkey struct{}
+
+// WithVerificationHook returns a copy of ctx using hook.
+func WithVerificationHook(ctx context.Context, hook VerificationHook) context.Context {
+	return context.WithValue(ctx, contextkey{}, hook)
+}
+
+// ContextVerificationHook returns the hook in ctx, or nil.
+func ContextVerificationHook(ctx context.Context) VerificationHook {
+	hook, _ := ctx.Value(contextkey{}).(VerificationHook)
+	return hook
+}
+
+// NewConnectionState creates a new modelx.TLSConnectionState. When
+// the handshake succeeded but we have been told to skip verification,
+// this function verifies the certificate chain and stores the result
+// in VerificationError, using builder to wrap the error. When the
+// handshake succeeded and hook is not nil, this function also runs
+// hook and stores the result in CustomVerificationError. The config
+// argument may be nil when we don't know the TLS config.
+func NewConnectionState(
+	config *tls.Config, hook VerificationHook, serverName string,
+	state tls.ConnectionState, handshakeErr error,
+	builder errwrapper.SafeErrWrapperBuilder,
+) modelx.TLSConnectionState {
+	out := modelx.NewTLSConnectionState(state)
+	if handshakeErr == nil && config != nil && config.InsecureSkipVerify {
+		chains, err := Verify(config, serverName, state)
+		out.VerifiedChains = modelx.SimplifyChains(state.PeerCertificates, chains)
+		builder.Error = err
+		out.VerificationError = builder.MaybeBuild()
+	}
+	if handshakeErr == nil && hook != nil {
+		if err := hook(serverName, state); err != nil {
+			builder.Error = fmt.Errorf("%w: %s", modelx.ErrTLSCustomVerification, err)
+			out.CustomVerificationError = builder.MaybeBuild()
+		}
+	}
+	return out
+}
+
+// KeyLogWriter is a tls.Config.KeyLogWriter for a single connection
+// that emits a TLSKeyLog event for each secret and also forwards the
+// secret to Next, if not nil. Note that crypto/tls writes each key
+// log line using a single call to Write.
+type KeyLogWriter struct {
+	ConnID        int64
+	Next          io.Writer
+	Root          *modelx.MeasurementRoot
+	TransactionID int64
+}
+
+// WithKeyLogEvents returns a copy of config whose KeyLogWriter is a
+// KeyLogWriter for the specified connection and transaction, which
+// forwards the secrets to the original KeyLogWriter, if any.
+func WithKeyLogEvents(
+	config *tls.Config, root *modelx.MeasurementRoot, connID, txID int64,
+) *tls.Config {
+	config = config.Clone()
+	config.KeyLogWriter = &KeyLogWriter{
+		ConnID:        connID,
+		Next:          config.KeyLogWriter,
+		Root:          root,
+		TransactionID: txID,
+	}
+	return config
+}
+
+// Write implements io.Writer.Write.
+func (w *KeyLogWriter) Write(b []byte) (int, error) {
+	w.Root.Handler.OnMeasurement(modelx.Measurement{
+		TLSKeyLog: &modelx.TLSKeyLogEvent{
+			ConnID:                 w.ConnID,
+			DurationSinceBeginning: time.Now().Sub(w.Root.Beginning),
+			Line:                   strings.TrimRight(string(b), "\r\n"),
+			TransactionID:          w.TransactionID,
+		},
+	})
+	if w.Next != nil {
+		return w.Next.Write(b)
+	}
+	return len(b), nil
+}
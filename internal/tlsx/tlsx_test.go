@@ -0,0 +1,255 @@
+package tlsx
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ooni/netx/internal/errwrapper"
+	"github.com/ooni/netx/modelx"
+)
+
+func dialTestServer(t *testing.T, server *httptest.Server) tls.ConnectionState {
+	conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState()
+}
+
+func newTestServer() *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {},
+	))
+}
+
+func TestIntegrationVerifySuccess(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+	state := dialTestServer(t, server)
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	chains, err := Verify(&tls.Config{RootCAs: pool}, "127.0.0.1", state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chains) < 1 {
+		t.Fatal("expected at least a verified chain")
+	}
+}
+
+func TestIntegrationNewConnectionStateVerificationError(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+	state := dialTestServer(t, server)
+	out := NewConnectionState(
+		&tls.Config{InsecureSkipVerify: true, RootCAs: x509.NewCertPool()},
+		nil, "127.0.0.1", state, nil,
+		errwrapper.SafeErrWrapperBuilder{ConnID: 17, Operation: "tls_handshake"},
+	)
+	var wrapper *modelx.ErrWrapper
+	if !errors.As(out.VerificationError, &wrapper) {
+		t.Fatal("expected a wrapped verification error")
+	}
+	if wrapper.Failure != "ssl_unknown_authority" || wrapper.ConnID != 17 {
+		t.Fatal("unexpected wrapped error")
+	}
+	if out.VerifiedChains != nil {
+		t.Fatal("expected no verified chains")
+	}
+}
+
+func TestIntegrationNewConnectionStateVerifiedChains(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+	state := dialTestServer(t, server)
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	out := NewConnectionState(
+		&tls.Config{InsecureSkipVerify: true, RootCAs: pool},
+		nil, "127.0.0.1", state, nil, errwrapper.SafeErrWrapperBuilder{},
+	)
+	if out.VerificationError != nil {
+		t.Fatal(out.VerificationError)
+	}
+	if len(out.VerifiedChains) < 1 || out.VerifiedChains[0][0] != 0 {
+		t.Fatal("unexpected verified chains")
+	}
+}
+
+func TestUnitNewConnectionStateWithoutSkipVerify(t *testing.T) {
+	out := NewConnectionState(
+		&tls.Config{}, nil, "127.0.0.1", tls.ConnectionState{}, nil,
+		errwrapper.SafeErrWrapperBuilder{},
+	)
+	if out.VerificationError != nil {
+		t.Fatal("expected no verification error")
+	}
+}
+
+func TestUnitVerifyNoPeerCertificates(t *testing.T) {
+	_, err := Verify(&tls.Config{}, "127.0.0.1", tls.ConnectionState{})
+	if !errors.Is(err, ErrNoPeerCertificates) {
+		t.Fatal("not the error we expected")
+	}
+}
+
+func TestIntegrationNewConnectionStateCustomVerification(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+	state := dialTestServer(t, server)
+	var called bool
+	hook := func(serverName string, state tls.ConnectionState) error {
+		called = serverName == "127.0.0.1" && len(state.PeerCertificates) > 0
+		return errors.New("mocked error")
+	}
+	out := NewConnectionState(
+		&tls.Config{}, hook, "127.0.0.1", state, nil,
+		errwrapper.SafeErrWrapperBuilder{ConnID: 17, Operation: "tls_handshake"},
+	)
+	if !called {
+		t.Fatal("hook not called or called with unexpected arguments")
+	}
+	var wrapper *modelx.ErrWrapper
+	if !errors.As(out.CustomVerificationError, &wrapper) {
+		t.Fatal("expected a wrapped custom verification error")
+	}
+	if wrapper.Failure != "ssl_custom_verification_error" || wrapper.ConnID != 17 {
+		t.Fatal("unexpected wrapped error")
+	}
+}
+
+func TestUnitNewConnectionStateHookAfterHandshakeFailure(t *testing.T) {
+	hook := func(serverName string, state tls.ConnectionState) error {
+		t.Fatal("should not be called")
+		return nil
+	}
+	out := NewConnectionState(
+		&tls.Config{}, hook, "127.0.0.1", tls.ConnectionState{},
+		errors.New("mocked error"), errwrapper.SafeErrWrapperBuilder{},
+	)
+	if out.CustomVerificationError != nil {
+		t.Fatal("expected no custom verification error")
+	}
+}
+
+func TestUnitContextVerificationHook(t *testing.T) {
+	if ContextVerificationHook(context.Background()) != nil {
+		t.Fatal("expected nil hook")
+	}
+	ctx := WithVerificationHook(context.Background(), func(
+		serverName string, state tls.ConnectionState) error {
+		return nil
+	})
+	if ContextVerificationHook(ctx) == nil {
+		t.Fatal("expected non-nil hook")
+	}
+}
+
+func TestIntegrationPinVerifier(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+	pin := sha256.Sum256(server.Certificate().RawSubjectPublicKeyInfo)
+	raw := [][]byte{server.Certificate().Raw}
+	if err := NewPinVerifier([][]byte{pin[:]})(raw, nil); err != nil {
+		t.Fatal(err)
+	}
+	other := sha256.Sum256([]byte("antani"))
+	err := NewPinVerifier([][]byte{other[:]})(raw, nil)
+	if !errors.Is(err, modelx.ErrTLSPinning) {
+		t.Fatal("not the error we expected")
+	}
+	if err := NewPinVerifier(nil)([][]byte{{0}}, nil); err == nil {
+		t.Fatal("expected a parse error here")
+	}
+}
+
+func TestUnitPinVerifierIgnoresUnverifiedCerts(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+	pin := sha256.Sum256(server.Certificate().RawSubjectPublicKeyInfo)
+	data, err := ioutil.ReadFile("../../testdata/cacert.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatal("cannot decode PEM")
+	}
+	unrelated, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := NewPinVerifier([][]byte{pin[:]})
+	raw := [][]byte{unrelated.Raw, server.Certificate().Raw}
+	if err := verifier(raw, nil); !errors.Is(err, modelx.ErrTLSPinning) {
+		t.Fatal("not the error we expected")
+	}
+	chains := [][]*x509.Certificate{{unrelated}}
+	if err := verifier(raw, chains); !errors.Is(err, modelx.ErrTLSPinning) {
+		t.Fatal("not the error we expected")
+	}
+	chains = [][]*x509.Certificate{{server.Certificate()}}
+	if err := verifier(raw, chains); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type keyLogSaver struct {
+	events []*modelx.TLSKeyLogEvent
+}
+
+func (h *keyLogSaver) OnMeasurement(m modelx.Measurement) {
+	if m.TLSKeyLog != nil {
+		h.events = append(h.events, m.TLSKeyLog)
+	}
+}
+
+func TestUnitWithKeyLogEvents(t *testing.T) {
+	saver := new(keyLogSaver)
+	next := new(bytes.Buffer)
+	orig := &tls.Config{KeyLogWriter: next}
+	config := WithKeyLogEvents(orig, &modelx.MeasurementRoot{
+		Beginning: time.Now(),
+		Handler:   saver,
+	}, 17, 4)
+	if orig.KeyLogWriter != next {
+		t.Fatal("the original config has been modified")
+	}
+	line := "CLIENT_RANDOM 0102 0304\n"
+	count, err := config.KeyLogWriter.Write([]byte(line))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(line) || next.String() != line {
+		t.Fatal("the line was not forwarded")
+	}
+	if len(saver.events) != 1 {
+		t.Fatal("expected a single event")
+	}
+	ev := saver.events[0]
+	if ev.ConnID != 17 || ev.TransactionID != 4 || ev.Line != "CLIENT_RANDOM 0102 0304" {
+		t.Fatal("unexpected event")
+	}
+	config = WithKeyLogEvents(new(tls.Config), &modelx.MeasurementRoot{
+		Handler: saver,
+	}, 18, 0)
+	if _, err := config.KeyLogWriter.Write([]byte(line)); err != nil {
+		t.Fatal(err)
+	}
+	if len(saver.events) != 2 {
+		t.Fatal("expected another event")
+	}
+}
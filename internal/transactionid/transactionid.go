@@ -22,3 +22,19 @@ func ContextTransactionID(ctx context.Context) int64 {
 	id, _ := ctx.Value(contextkey{}).(int64)
 	return id
 }
+
+type parentkey struct{}
+
+// WithParentTransactionID returns a copy of ctx with the ID of the
+// parent transaction, i.e., the transaction whose redirect caused the
+// current transaction, or zero if there is no such transaction.
+func WithParentTransactionID(ctx context.Context, parentID int64) context.Context {
+	return context.WithValue(ctx, parentkey{}, parentID)
+}
+
+// ContextParentTransactionID returns the ParentTransactionID of
+// the context, or zero
+func ContextParentTransactionID(ctx context.Context) int64 {
+	id, _ := ctx.Value(parentkey{}).(int64)
+	return id
+}
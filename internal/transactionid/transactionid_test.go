@@ -22,3 +22,18 @@ func TestIntegration(t *testing.T) {
 		t.Fatal("expected ID equal to 2")
 	}
 }
+
+func TestUnitParentTransactionID(t *testing.T) {
+	ctx := context.Background()
+	if ContextParentTransactionID(ctx) != 0 {
+		t.Fatal("unexpected ID for empty context")
+	}
+	ctx = WithParentTransactionID(ctx, 17)
+	if ContextParentTransactionID(ctx) != 17 {
+		t.Fatal("expected ID equal to 17")
+	}
+	ctx = WithParentTransactionID(ctx, 0)
+	if ContextParentTransactionID(ctx) != 0 {
+		t.Fatal("expected ID equal to 0")
+	}
+}
@@ -44,15 +44,40 @@ type Measurement struct {
 	Write   *WriteEvent   `json:",omitempty"`
 	Close   *CloseEvent   `json:",omitempty"`
 
+	// ListenPacket, ReadFrom and WriteTo are like Connect, Read
+	// and Write but for datagram sockets, e.g., UDP sockets. The
+	// UDP sockets used by QUIC do not emit ListenPacket.
+	ListenPacket *ListenPacketEvent `json:",omitempty"`
+	ReadFrom     *ReadFromEvent     `json:",omitempty"`
+	WriteTo      *WriteToEvent      `json:",omitempty"`
+
+	// WriteSegmentation is emitted before the first write on a
+	// connection, identified by ConnID, when we've been configured
+	// to split such write into several segments.
+	WriteSegmentation *WriteSegmentationEvent `json:",omitempty"`
+
 	// TLS events
 	//
-	// Identified by either ConnID or TransactionID. In the former case
-	// the TLS handshake is managed by net code, in the latter case it is
-	// instead managed by Golang's HTTP engine. It should not happen to
-	// have both ConnID and TransactionID different from zero.
+	// Identified by ConnID. When the TLS handshake is managed by
+	// Golang's HTTP engine, these events also have a TransactionID
+	// that binds them to the HTTP transaction that dialed the
+	// connection. The TransactionID is zero for explicit dials.
 	TLSHandshakeStart *TLSHandshakeStartEvent `json:",omitempty"`
 	TLSHandshakeDone  *TLSHandshakeDoneEvent  `json:",omitempty"`
 
+	// TLSKeyLog is emitted for each TLS secret when we've been
+	// configured to emit secrets as events. Since QUIC uses TLS, it is
+	// also emitted for QUIC connections, identified by ConnID.
+	TLSKeyLog *TLSKeyLogEvent `json:",omitempty"`
+
+	// QUIC events
+	//
+	// Identified by ConnID, which is the ID of the datagram socket
+	// used by the QUIC connection. Like TLS events, they also have a
+	// TransactionID when the handshake is managed by HTTP code.
+	QUICHandshakeStart *QUICHandshakeStartEvent `json:",omitempty"`
+	QUICHandshakeDone  *QUICHandshakeDoneEvent  `json:",omitempty"`
+
 	// HTTP roundtrip events
 	//
 	// A round trip starts when we need a connection to send a request
@@ -77,6 +102,12 @@ type Measurement struct {
 	HTTPResponseBodyPart *HTTPResponseBodyPartEvent `json:",omitempty"`
 	HTTPResponseDone     *HTTPResponseDoneEvent     `json:",omitempty"`
 
+	// HTTP2Frame is emitted for each HTTP/2 frame sent or received
+	// when we've been configured to emit frames as events. It is
+	// identified by ConnID and, for frames belonging to a stream,
+	// also by StreamID and TransactionID.
+	HTTP2Frame *HTTP2FrameEvent `json:",omitempty"`
+
 	// Extension events.
 	//
 	// The purpose of these events is to give us some flexibility to
@@ -107,9 +138,12 @@ type ErrWrapper struct {
 	// - `dns_nxdomain_error`: NXDOMAIN in DNS reply
 	// - `eof_error`: unexpected EOF on connection
 	// - `generic_timeout_error`: some timer has expired
+	// - `http2_stream_reset`: HTTP/2 stream reset with RST_STREAM
 	// - `ssl_invalid_hostname`: certificate not valid for SNI
 	// - `ssl_unknown_autority`: cannot find CA validating certificate
 	// - `ssl_invalid_certificate`: e.g. certificate expried
+	// - `ssl_pinning_error`: no certificate matches the pinned SPKI hashes
+	// - `ssl_custom_verification_error`: custom verification hook failed
 	// - `unknown_failure ...`: any other error
 	Failure string
 
@@ -118,7 +152,9 @@ type ErrWrapper struct {
 	//
 	// - `resolve`: resolving a domain name failed
 	// - `connect`: connecting to an IP failed
+	// - `listen`: creating a datagram socket failed
 	// - `tls_handshake`: TLS handshaking failed
+	// - `quic_handshake`: QUIC handshaking failed
 	// - `http_round_trip`: other errors during round trip
 	//
 	// Because a network connection doesn't necessarily know
@@ -127,7 +163,9 @@ type ErrWrapper struct {
 	//
 	// - `close`: CLOSE failed
 	// - `read`: READ failed
+	// - `read_from`: RECVFROM failed
 	// - `write`: WRITE failed
+	// - `write_to`: SENDTO failed
 	//
 	// If an ErrWrapper referring to a major operation is wrapping
 	// another ErrWrapper and such ErrWrapper already refers to
@@ -173,7 +211,9 @@ type CloseEvent struct {
 
 // ConnectEvent is emitted when the CONNECT syscall returns.
 type ConnectEvent struct {
-	// ConnID is the identifier of this connection.
+	// ConnID is the identifier of this connection. It is unique for
+	// the lifetime of the process, hence also within a MeasurementRoot,
+	// and it is zero if CONNECT failed.
 	ConnID int64
 
 	// DialID is the identifier of the dial operation as
@@ -187,6 +227,16 @@ type ConnectEvent struct {
 	// Error is the error returned by CONNECT.
 	Error error
 
+	// LocalAddress is the local address of the connection, or
+	// the empty string if CONNECT failed.
+	LocalAddress string `json:",omitempty"`
+
+	// LocalPort is the local port of the connection, or zero
+	// if CONNECT failed. We used to compute the ConnID from the
+	// local port, so this field allows to keep using the local
+	// port to join events with external data, e.g., pcaps.
+	LocalPort int64 `json:",omitempty"`
+
 	// Network is the network we're dialing for, e.g. "tcp"
 	Network string
 
@@ -259,6 +309,75 @@ type ExtensionEvent struct {
 	Value interface{}
 }
 
+// HTTPHeaderField is a single header field. We use a list of fields,
+// rather than http.Header, when we want to preserve the order in which
+// headers have been sent or received and their original casing.
+type HTTPHeaderField struct {
+	// Key is the header key
+	Key string
+
+	// Value is the header value
+	Value string
+}
+
+// HTTP2FrameEvent is emitted when we send or receive an HTTP/2
+// frame. We do not include the payload, except for the fields of
+// control frames that are useful to understand what happened.
+type HTTP2FrameEvent struct {
+	// ConnID is the identifier of the connection.
+	ConnID int64
+
+	// DurationSinceBeginning is the number of nanoseconds since
+	// the time configured as the "zero" time.
+	DurationSinceBeginning time.Duration
+
+	// ErrCode is the error code of RST_STREAM and GOAWAY frames,
+	// e.g., "REFUSED_STREAM".
+	ErrCode string `json:",omitempty"`
+
+	// Flags contains the frame flags.
+	Flags uint8
+
+	// LastStreamID is the last stream ID of a GOAWAY frame.
+	LastStreamID uint32 `json:",omitempty"`
+
+	// Length is the length of the frame payload.
+	Length uint32
+
+	// Operation is "read" for received frames and "write"
+	// for sent frames.
+	Operation string
+
+	// PingData contains the opaque data of a PING frame.
+	PingData []byte `json:",omitempty"`
+
+	// Settings contains the settings of a SETTINGS frame.
+	Settings []HTTP2Setting `json:",omitempty"`
+
+	// StreamID is the identifier of the stream, or zero for
+	// frames referring to the whole connection.
+	StreamID uint32
+
+	// TransactionID is the identifier of the transaction using
+	// the stream, or zero if we don't know it.
+	TransactionID int64 `json:",omitempty"`
+
+	// Type is the frame type, e.g., "SETTINGS".
+	Type string
+
+	// WindowIncrement is the increment of a WINDOW_UPDATE frame.
+	WindowIncrement uint32 `json:",omitempty"`
+}
+
+// HTTP2Setting is a setting inside an HTTP/2 SETTINGS frame.
+type HTTP2Setting struct {
+	// ID is the setting name, e.g., "MAX_CONCURRENT_STREAMS".
+	ID string
+
+	// Value is the setting value.
+	Value uint32
+}
+
 // HTTPRoundTripStartEvent is emitted when the HTTP transport
 // starts the HTTP "round trip". That is, when the transport
 // receives from the HTTP client a request to sent. The round
@@ -276,9 +395,19 @@ type HTTPRoundTripStartEvent struct {
 	// the time configured as the "zero" time.
 	DurationSinceBeginning time.Duration
 
+	// Fronting contains the effective address, Host header, and SNI
+	// used by this round trip, when the request context contains a
+	// Fronting, otherwise it is nil.
+	Fronting *Fronting `json:",omitempty"`
+
 	// Method is the request method
 	Method string
 
+	// ParentTransactionID is the identifier of the transaction whose
+	// redirect caused this round trip, or zero if this round trip
+	// has not been caused by a redirect.
+	ParentTransactionID int64 `json:",omitempty"`
+
 	// TransactionID is the identifier of this transaction
 	TransactionID int64
 
@@ -297,8 +426,21 @@ type HTTPConnectionReadyEvent struct {
 	// the time configured as the "zero" time.
 	DurationSinceBeginning time.Duration
 
+	// IdleTime is the amount of time the connection has been idle
+	// in the pool, if it was idle, otherwise it is zero.
+	IdleTime time.Duration `json:",omitempty"`
+
+	// Reused indicates whether this connection has already been
+	// used by previous transactions. When it is false, you should
+	// see the events of a new connection before this event.
+	Reused bool
+
 	// TransactionID is the identifier of this transaction
 	TransactionID int64
+
+	// WasIdle indicates whether the connection has been obtained
+	// from the pool of idle connections.
+	WasIdle bool
 }
 
 // HTTPRequestHeaderEvent is emitted when we have written a header,
@@ -402,17 +544,30 @@ type HTTPRoundTripDoneEvent struct {
 	// error was in sending the request or receiving the response.
 	Error error
 
+	// Fronting is like HTTPRoundTripStartEvent.Fronting.
+	Fronting *Fronting `json:",omitempty"`
+
 	// RequestBodySnap contains a snap of the request body. We'll
 	// not read more than SnapSize bytes of the body. Because typically
 	// you control the request bodies that you send, perhaps think
 	// about saving them using other means.
 	RequestBodySnap []byte
 
+	// RequestCookies contains the cookies we sent, e.g., because
+	// the client is using a cookie jar. They are also included in
+	// the RequestHeaders, but they're here for convenience.
+	RequestCookies []*http.Cookie `json:",omitempty"`
+
 	// RequestHeaders contain the original request headers. This is
 	// included here to make this event actionable without needing to
 	// join it with other events, as it's too important.
 	RequestHeaders http.Header
 
+	// RequestHeadersList contains the request headers in the order in
+	// which they have been written and with the casing used on the wire.
+	// With HTTP/2, names are lowercase and pseudo-headers are included.
+	RequestHeadersList []HTTPHeaderField `json:",omitempty"`
+
 	// RequestMethod is the original request method. This is here
 	// for the same reason of RequestHeaders.
 	RequestMethod string
@@ -424,12 +579,33 @@ type HTTPRoundTripDoneEvent struct {
 	// ResponseBodySnap is like RequestBodySnap but for the response. You
 	// can still save the whole body by just reading it, if this
 	// is something that you need to do. We're using the snaps here
-	// mainly to log small stuff like DoH and redirects.
+	// mainly to log small stuff like DoH and redirects. It always
+	// contains the bytes received from the wire, hence it may be
+	// compressed, even when we're decompressing bodies.
 	ResponseBodySnap []byte
 
+	// ResponseBodyDecodedSnap contains a snap of the response body
+	// after removing the gzip, deflate, or br content encoding, when
+	// we've been configured to decompress bodies. We'll not save more
+	// than MaxBodySnapSize decoded bytes. Because ResponseBodySnap is
+	// also bounded, this snap may be truncated even if it is shorter
+	// than MaxBodySnapSize.
+	ResponseBodyDecodedSnap []byte `json:",omitempty"`
+
+	// ResponseCookies contains the cookies set by the server using
+	// the Set-Cookie header, if error is nil.
+	ResponseCookies []*http.Cookie `json:",omitempty"`
+
 	// ResponseHeaders contains the response headers if error is nil.
 	ResponseHeaders http.Header
 
+	// ResponseHeadersList is like RequestHeadersList but contains the
+	// response headers as received. With HTTP/1.x we only have them when
+	// we see the cleartext, i.e., for http:// URLs and for https:// URLs
+	// unless we are using a proxy. With HTTP/2 we decode them from the
+	// HEADERS frames. Otherwise, it is empty.
+	ResponseHeadersList []HTTPHeaderField `json:",omitempty"`
+
 	// ResponseProto contains the response protocol
 	ResponseProto string
 
@@ -439,6 +615,12 @@ type HTTPRoundTripDoneEvent struct {
 	// MaxBodySnapSize is the maximum size of the bodies snapshot.
 	MaxBodySnapSize int64
 
+	// ParentTransactionID is the identifier of the transaction whose
+	// redirect caused this round trip, or zero if this round trip
+	// has not been caused by a redirect. This allows you to
+	// reconstruct redirect chains, where each hop is a transaction.
+	ParentTransactionID int64 `json:",omitempty"`
+
 	// TransactionID is the identifier of this transaction
 	TransactionID int64
 }
@@ -474,6 +656,11 @@ type HTTPResponseBodyPartEvent struct {
 // Note that you are not going to see this event if you do not
 // drain the response body, which you're supposed to do, tho.
 type HTTPResponseDoneEvent struct {
+	// BodyStats contains statistics about the response body. It is
+	// only set when we've been configured to compute them, in which
+	// case we do not emit HTTPResponseBodyPart events.
+	BodyStats *HTTPBodyStats `json:",omitempty"`
+
 	// DurationSinceBeginning is the number of nanoseconds since
 	// the time configured as the "zero" time.
 	DurationSinceBeginning time.Duration
@@ -482,11 +669,192 @@ type HTTPResponseDoneEvent struct {
 	TransactionID int64
 }
 
+// HTTPBodyStats contains statistics about a response body computed
+// while streaming it, which allow to fingerprint the body and to
+// measure throttling without storing the body.
+type HTTPBodyStats struct {
+	// Complete indicates whether we have read the body until EOF. If
+	// false, SHA256 and Size only refer to the part we have read.
+	Complete bool
+
+	// Error is the error that occurred while reading the body, if any,
+	// not including the io.EOF marking the end of the body.
+	Error error `json:",omitempty"`
+
+	// SHA256 is the hex encoded SHA-256 of the body.
+	SHA256 string
+
+	// Samples contains samples of the body download progress, taken
+	// at the configured interval and when the body is complete. You
+	// can compute the throughput using two consecutive samples.
+	Samples []HTTPBodySample `json:",omitempty"`
+
+	// Size is the number of body bytes we have read.
+	Size int64
+
+	// TimeToFirstByte is the time elapsed since the beginning of the
+	// round trip until we received the first byte of the response.
+	TimeToFirstByte time.Duration
+}
+
+// HTTPBodySample is a sample of a response body download progress.
+type HTTPBodySample struct {
+	// Bytes is the number of body bytes received so far.
+	Bytes int64
+
+	// DurationSinceBeginning is the number of nanoseconds since
+	// the time configured as the "zero" time.
+	DurationSinceBeginning time.Duration
+}
+
+// ListenPacketEvent is emitted when we create a datagram socket.
+type ListenPacketEvent struct {
+	// ConnID is the identifier of this socket. It is unique for the
+	// lifetime of the process and it is zero if we failed.
+	ConnID int64
+
+	// DurationSinceBeginning is the number of nanoseconds since
+	// the time configured as the "zero" time.
+	DurationSinceBeginning time.Duration
+
+	// Error is the error that occurred, if any.
+	Error error
+
+	// LocalAddress is the local address of the socket, or
+	// the empty string if we failed.
+	LocalAddress string `json:",omitempty"`
+
+	// Network is the network we're using, e.g. "udp".
+	Network string
+
+	// SyscallDuration is the number of nanoseconds we were
+	// blocked waiting for the syscall to return.
+	SyscallDuration time.Duration
+}
+
+// QUICHandshakeStartEvent is emitted when the QUIC handshake starts.
+type QUICHandshakeStartEvent struct {
+	// ConnID is the ID of the datagram socket used by QUIC.
+	ConnID int64
+
+	// DialID is the ID of the dial operation.
+	DialID int64 `json:",omitempty"`
+
+	// DurationSinceBeginning is the number of nanoseconds since
+	// the time configured as the "zero" time.
+	DurationSinceBeginning time.Duration
+
+	// LocalAddress is the local address of the datagram socket.
+	LocalAddress string `json:",omitempty"`
+
+	// NextProtos contains the ALPN protocols we are offering.
+	NextProtos []string
+
+	// RemoteAddress is the address of the QUIC endpoint.
+	RemoteAddress string
+
+	// SNI is the SNI we're using for the QUIC handshake.
+	SNI string
+
+	// TransactionID is the ID of the transaction that started
+	// this QUIC handshake, or zero for explicit dials.
+	TransactionID int64 `json:",omitempty"`
+}
+
+// QUICHandshakeDoneEvent is emitted when the QUIC handshake returns.
+type QUICHandshakeDoneEvent struct {
+	// ConnectionState is the TLS connection state. Depending on the
+	// error type, some fields may have little meaning.
+	ConnectionState TLSConnectionState
+
+	// ConnID is the ID of the datagram socket used by QUIC.
+	ConnID int64
+
+	// DialID is the ID of the dial operation.
+	DialID int64 `json:",omitempty"`
+
+	// DurationSinceBeginning is the number of nanoseconds since
+	// the time configured as the "zero" time.
+	DurationSinceBeginning time.Duration
+
+	// Error is the result of the QUIC handshake.
+	Error error
+
+	// TransactionID is the ID of the transaction that started
+	// this QUIC handshake, or zero for explicit dials.
+	TransactionID int64 `json:",omitempty"`
+
+	// TransportParameters contains the transport parameters sent
+	// by the server, if we have received them.
+	TransportParameters *QUICTransportParameters `json:",omitempty"`
+
+	// Version is the negotiated QUIC version (e.g. "v1"), which
+	// is only meaningful when the handshake succeeded.
+	Version string `json:",omitempty"`
+}
+
+// QUICTransportParameters contains the QUIC transport parameters
+// sent by a peer. See RFC9000 Section 18.2 for their meaning.
+type QUICTransportParameters struct {
+	// AckDelayExponent is the ack_delay_exponent.
+	AckDelayExponent uint8
+
+	// ActiveConnectionIDLimit is the active_connection_id_limit.
+	ActiveConnectionIDLimit uint64
+
+	// DisableActiveMigration is the disable_active_migration.
+	DisableActiveMigration bool
+
+	// InitialMaxData is the initial_max_data.
+	InitialMaxData int64
+
+	// InitialMaxStreamDataBidiLocal is the
+	// initial_max_stream_data_bidi_local.
+	InitialMaxStreamDataBidiLocal int64
+
+	// InitialMaxStreamDataBidiRemote is the
+	// initial_max_stream_data_bidi_remote.
+	InitialMaxStreamDataBidiRemote int64
+
+	// InitialMaxStreamDataUni is the initial_max_stream_data_uni.
+	InitialMaxStreamDataUni int64
+
+	// InitialMaxStreamsBidi is the initial_max_streams_bidi.
+	InitialMaxStreamsBidi int64
+
+	// InitialMaxStreamsUni is the initial_max_streams_uni.
+	InitialMaxStreamsUni int64
+
+	// InitialSourceConnectionID is the initial_source_connection_id.
+	InitialSourceConnectionID []byte
+
+	// MaxAckDelay is the max_ack_delay.
+	MaxAckDelay time.Duration
+
+	// MaxDatagramFrameSize is the max_datagram_frame_size
+	// defined by RFC9221, or -1 if not sent.
+	MaxDatagramFrameSize int64
+
+	// MaxIdleTimeout is the max_idle_timeout.
+	MaxIdleTimeout time.Duration
+
+	// MaxUDPPayloadSize is the max_udp_payload_size.
+	MaxUDPPayloadSize int64
+
+	// OriginalDestinationConnectionID is the
+	// original_destination_connection_id.
+	OriginalDestinationConnectionID []byte
+}
+
 // ReadEvent is emitted when the READ/RECV syscall returns.
 type ReadEvent struct {
 	// ConnID is the identifier of this connection.
 	ConnID int64
 
+	// Data contains the bytes received, if we've been configured
+	// to save them. See MeasurementRoot.MaxConnSnapSize.
+	Data []byte `json:",omitempty"`
+
 	// DurationSinceBeginning is the number of nanoseconds since
 	// the time configured as the "zero" time.
 	DurationSinceBeginning time.Duration
@@ -503,6 +871,34 @@ type ReadEvent struct {
 	SyscallDuration time.Duration
 }
 
+// ReadFromEvent is emitted when the RECVFROM syscall returns.
+type ReadFromEvent struct {
+	// ConnID is the identifier of this datagram socket.
+	ConnID int64
+
+	// Data contains the bytes received, if we've been configured
+	// to save them. See MeasurementRoot.MaxConnSnapSize.
+	Data []byte `json:",omitempty"`
+
+	// DurationSinceBeginning is the number of nanoseconds since
+	// the time configured as the "zero" time.
+	DurationSinceBeginning time.Duration
+
+	// Error is the error returned by RECVFROM.
+	Error error
+
+	// NumBytes is the size of the received datagram.
+	NumBytes int64
+
+	// RemoteAddress is the address of the peer that sent
+	// the datagram, or empty on error.
+	RemoteAddress string `json:",omitempty"`
+
+	// SyscallDuration is the number of nanoseconds we were
+	// blocked waiting for the syscall to return.
+	SyscallDuration time.Duration
+}
+
 // ResolveStartEvent is emitted when we start resolving a domain name.
 type ResolveStartEvent struct {
 	// DialID is the identifier of the dial operation as
@@ -574,19 +970,63 @@ type X509Certificate struct {
 
 // TLSConnectionState contains the TLS connection state.
 type TLSConnectionState struct {
-	CipherSuite        uint16
+	// CipherSuite is the negotiated cipher suite.
+	CipherSuite uint16
+
+	// CustomVerificationError is the verdict of the custom verification
+	// hook, if any, which runs after a successful TLS handshake without
+	// aborting it. This field is nil if there is no hook, if the hook
+	// has accepted the connection, or if the handshake failed.
+	CustomVerificationError error `json:",omitempty"`
+
+	// DidResume indicates whether we resumed a previous session.
+	DidResume bool
+
+	// NegotiatedProtocol is the protocol negotiated using ALPN.
 	NegotiatedProtocol string
-	PeerCertificates   []X509Certificate
-	Version            uint16
+
+	// OCSPResponse is the OCSP response stapled by the server, if any.
+	OCSPResponse []byte `json:",omitempty"`
+
+	// PeerCertificates contains the certificates sent by the server.
+	PeerCertificates []X509Certificate
+
+	// ServerName is the SNI we have sent to the server.
+	ServerName string `json:",omitempty"`
+
+	// SignedCertificateTimestamps contains the SCTs sent by
+	// the server using either TLS or OCSP, if any.
+	SignedCertificateTimestamps [][]byte `json:",omitempty"`
+
+	// VerificationError is the result of verifying the certificate
+	// chain when the TLS handshake succeeded because we have been
+	// told to skip verification. This allows to know whether there
+	// would have been a verification error without failing the
+	// handshake. Otherwise, this field is always nil.
+	VerificationError error `json:",omitempty"`
+
+	// VerifiedChains contains the verified certificate chains, if
+	// any. Each chain is a list of indexes into PeerCertificates. The
+	// -1 index means that the certificate has not been sent by the
+	// server, which typically happens for the root certificate.
+	VerifiedChains [][]int `json:",omitempty"`
+
+	// Version is the negotiated TLS version.
+	Version uint16
 }
 
 // NewTLSConnectionState creates a new TLSConnectionState.
 func NewTLSConnectionState(s tls.ConnectionState) TLSConnectionState {
 	return TLSConnectionState{
-		CipherSuite:        s.CipherSuite,
-		NegotiatedProtocol: s.NegotiatedProtocol,
-		PeerCertificates:   SimplifyCerts(s.PeerCertificates),
-		Version:            s.Version,
+		CipherSuite:                 s.CipherSuite,
+		DidResume:                   s.DidResume,
+		NegotiatedProtocol:          s.NegotiatedProtocol,
+		OCSPResponse:                s.OCSPResponse,
+		PeerCertificates:            SimplifyCerts(s.PeerCertificates),
+		ServerName:                  s.ServerName,
+		SignedCertificateTimestamps: s.SignedCertificateTimestamps,
+		VerifiedChains:              SimplifyChains(s.PeerCertificates, s.VerifiedChains),
+		Version:                     s.Version,
 	}
 }
 
@@ -600,19 +1040,44 @@ func SimplifyCerts(in []*x509.Certificate) (out []X509Certificate) {
 	return
 }
 
+// SimplifyChains simplifies the verified chains for archival by
+// replacing each certificate with its index inside peers, or with
+// -1 if the certificate is not part of peers.
+func SimplifyChains(peers []*x509.Certificate, chains [][]*x509.Certificate) (out [][]int) {
+	for _, chain := range chains {
+		var indexes []int
+		for _, cert := range chain {
+			index := -1
+			for idx, peer := range peers {
+				if cert.Equal(peer) {
+					index = idx
+					break
+				}
+			}
+			indexes = append(indexes, index)
+		}
+		out = append(out, indexes)
+	}
+	return
+}
+
 // TLSHandshakeStartEvent is emitted when the TLS handshake starts.
 type TLSHandshakeStartEvent struct {
+	// ClientHelloFingerprint is the name of the browser-like ClientHello
+	// fingerprint we are parroting, e.g. "Chrome-83". It is empty when
+	// we are using the crypto/tls ClientHello.
+	ClientHelloFingerprint string `json:",omitempty"`
+
 	// ConnID is the ID of the connection that started the TLS
-	// handshake, or zero if we don't know it. Typically, it is
-	// zero for connections managed by the HTTP transport, for
-	// which we know instead the TransactionID.
+	// handshake, or zero if we don't know it. This happens when
+	// net/http uses a connection not dialed by us.
 	ConnID int64 `json:",omitempty"`
 
 	// DurationSinceBeginning is the number of nanoseconds since
 	// the time configured as the "zero" time.
 	DurationSinceBeginning time.Duration
 
-	// SNI is the SNI used when we force a specific SNI.
+	// SNI is the SNI we're using for the TLS handshake.
 	SNI string
 
 	// TransactionID is the ID of the transaction that started
@@ -629,9 +1094,8 @@ type TLSHandshakeDoneEvent struct {
 	ConnectionState TLSConnectionState
 
 	// ConnID is the ID of the connection that started the TLS
-	// handshake, or zero if we don't know it. Typically, it is
-	// zero for connections managed by the HTTP transport, for
-	// which we know instead the TransactionID.
+	// handshake, or zero if we don't know it. This happens when
+	// net/http uses a connection not dialed by us.
 	ConnID int64
 
 	// DurationSinceBeginning is the number of nanoseconds since
@@ -648,11 +1112,33 @@ type TLSHandshakeDoneEvent struct {
 	TransactionID int64
 }
 
+// TLSKeyLogEvent contains a TLS secret of a connection.
+type TLSKeyLogEvent struct {
+	// ConnID is the ID of the connection using the secret.
+	ConnID int64
+
+	// DurationSinceBeginning is the number of nanoseconds since
+	// the time configured as the "zero" time.
+	DurationSinceBeginning time.Duration
+
+	// Line is the secret in the NSS key log format, i.e., the format
+	// used by SSLKEYLOGFILE, without the trailing newline.
+	Line string
+
+	// TransactionID is the ID of the transaction that dialed the
+	// connection, or zero if we don't know it.
+	TransactionID int64 `json:",omitempty"`
+}
+
 // WriteEvent is emitted when the WRITE/SEND syscall returns.
 type WriteEvent struct {
 	// ConnID is the identifier of this connection.
 	ConnID int64
 
+	// Data contains the bytes sent, if we've been configured
+	// to save them. See MeasurementRoot.MaxConnSnapSize.
+	Data []byte `json:",omitempty"`
+
 	// DurationSinceBeginning is the number of nanoseconds since
 	// the time configured as the "zero" time.
 	DurationSinceBeginning time.Duration
@@ -669,6 +1155,59 @@ type WriteEvent struct {
 	SyscallDuration time.Duration
 }
 
+// WriteSegmentationEvent is emitted when we are about to split the
+// first write on a connection into several WRITE/SEND syscalls, so
+// that the data is likely to span several TCP segments.
+type WriteSegmentationEvent struct {
+	// ConnID is the identifier of this connection.
+	ConnID int64
+
+	// Delay is the number of nanoseconds we wait between segments.
+	Delay time.Duration
+
+	// DurationSinceBeginning is the number of nanoseconds since
+	// the time configured as the "zero" time.
+	DurationSinceBeginning time.Duration
+
+	// NumBytes is the size of the first write.
+	NumBytes int64
+
+	// Offsets are the offsets within the first write at which
+	// we start a new segment. When empty, we don't split.
+	Offsets []int64
+
+	// TransactionID is the identifier of the HTTP transaction
+	// that caused this connection to be dialed, if any.
+	TransactionID int64 `json:",omitempty"`
+}
+
+// WriteToEvent is emitted when the SENDTO syscall returns.
+type WriteToEvent struct {
+	// ConnID is the identifier of this datagram socket.
+	ConnID int64
+
+	// Data contains the bytes sent, if we've been configured
+	// to save them. See MeasurementRoot.MaxConnSnapSize.
+	Data []byte `json:",omitempty"`
+
+	// DurationSinceBeginning is the number of nanoseconds since
+	// the time configured as the "zero" time.
+	DurationSinceBeginning time.Duration
+
+	// Error is the error returned by SENDTO.
+	Error error
+
+	// NumBytes is the number of bytes sent.
+	NumBytes int64
+
+	// RemoteAddress is the address of the peer.
+	RemoteAddress string
+
+	// SyscallDuration is the number of nanoseconds we were
+	// blocked waiting for the syscall to return.
+	SyscallDuration time.Duration
+}
+
 // Handler handles measurement events.
 type Handler interface {
 	// OnMeasurement is called when an event occurs. There will be no
@@ -729,6 +1268,15 @@ type TLSDialer interface {
 // to tell this library to return an error when a bogon is found.
 var ErrDNSBogon = errors.New("dns: detected bogon address")
 
+// ErrTLSPinning indicates that none of the certificates in the verified
+// chains matches the pinned SPKI hashes. When we skip verification, there
+// are no verified chains, and this means that the leaf does not match.
+var ErrTLSPinning = errors.New("tls: no certificate matches the pinned SPKI hashes")
+
+// ErrTLSCustomVerification indicates that the custom verification
+// hook has rejected the certificates sent by the server.
+var ErrTLSCustomVerification = errors.New("tls: custom verification failed")
+
 // MeasurementRoot is the measurement root.
 //
 // If you attach this to a context, we'll use it rather than using
@@ -762,6 +1310,24 @@ type MeasurementRoot struct {
 	// LookupHost allows to override the host lookup for all the request
 	// and dials that use this measurement root.
 	LookupHost func(ctx context.Context, hostname string) ([]string, error)
+
+	// MaxConnSnapSize enables saving the bytes read and written by
+	// the connections we create in the Data field of the Read, Write,
+	// ReadFrom, and WriteTo events. We save at most MaxConnSnapSize
+	// bytes for each direction of each connection. If this value is
+	// zero, the default, we don't save any byte. If it's negative,
+	// we save all the bytes. Because TLS runs on top of these
+	// connections, we save the ciphertext of TLS connections. See
+	// PlaintextHook for observing the plaintext.
+	MaxConnSnapSize int64
+
+	// PlaintextHook, if not nil, is called with the plaintext read
+	// from and written to the TLS connections created by our TLS dialer
+	// (e.g. netx.Dialer.DialTLS, DoT, httpx). It is not called for the
+	// TLS connections that net/http creates when using a proxy (see
+	// httpx.Transport.RoundTrip). The operation is either "read" or
+	// "write", and data is only valid during the call.
+	PlaintextHook func(connID int64, operation string, data []byte)
 }
 
 type measurementRootContextKey struct{}
@@ -807,6 +1373,52 @@ func WithMeasurementRoot(
 	)
 }
 
+// Fronting decouples, for a single HTTP request or dial, the address
+// we connect to, the TLS SNI, and the HTTP Host header. This is useful
+// to perform domain fronting, or to check whether a middlebox is using
+// the SNI or the Host header to block. Attach it to a context using
+// WithFronting. Note that http.Client uses the same context when
+// following redirects, hence the Fronting also applies to them.
+type Fronting struct {
+	// Address is the domain or IP address, optionally followed by a
+	// port, we should connect to. If empty, we use the host in the URL
+	// or the address passed to the dialer. If there is no port, we use
+	// the port in the URL or in the address passed to the dialer.
+	Address string `json:",omitempty"`
+
+	// Host is the Host header we should send. If empty, we use the
+	// host in the URL (or the request Host, if set). Dialers ignore it.
+	Host string `json:",omitempty"`
+
+	// SNI is the SNI we should use. If empty, we use the hostname in
+	// the URL or in the address passed to the dialer, unless the SNI
+	// has been forced using ForceSpecificSNI.
+	SNI string `json:",omitempty"`
+}
+
+type frontingContextKey struct{}
+
+// ContextFronting returns the Fronting configured in the provided
+// context, or a nil pointer, if not set. Because a zero Fronting does
+// not change anything, we also return nil in such case, which allows
+// to attach a zero Fronting to clear a previously attached one.
+func ContextFronting(ctx context.Context) *Fronting {
+	fronting, _ := ctx.Value(frontingContextKey{}).(*Fronting)
+	if fronting != nil && *fronting == (Fronting{}) {
+		return nil
+	}
+	return fronting
+}
+
+// WithFronting returns a copy of the context with the configured
+// Fronting set. Panics if the provided fronting is nil.
+func WithFronting(ctx context.Context, fronting *Fronting) context.Context {
+	if fronting == nil {
+		panic("nil fronting")
+	}
+	return context.WithValue(ctx, frontingContextKey{}, fronting)
+}
+
 func init() {
 	log.Printf("⚠️⚠️⚠️⚠️ netx is not maintained anymore!")
 	log.Printf("⚠️⚠️⚠️⚠️ please import github.com/ooni/probe-engine/netx instead!")
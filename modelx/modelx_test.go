@@ -3,6 +3,7 @@ package modelx
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"math"
 	"testing"
@@ -23,6 +24,25 @@ func TestNewTLSConnectionState(t *testing.T) {
 	}
 }
 
+func TestSimplifyChains(t *testing.T) {
+	peers := []*x509.Certificate{
+		&x509.Certificate{Raw: []byte("leaf")},
+		&x509.Certificate{Raw: []byte("intermediate")},
+	}
+	chains := [][]*x509.Certificate{
+		[]*x509.Certificate{
+			peers[0], peers[1], &x509.Certificate{Raw: []byte("root")},
+		},
+	}
+	out := SimplifyChains(peers, chains)
+	if len(out) != 1 || len(out[0]) != 3 {
+		t.Fatal("unexpected number of chains or certificates")
+	}
+	if out[0][0] != 0 || out[0][1] != 1 || out[0][2] != -1 {
+		t.Fatal("unexpected indexes")
+	}
+}
+
 func TestMeasurementRoot(t *testing.T) {
 	ctx := context.Background()
 	if ContextMeasurementRoot(ctx) != nil {
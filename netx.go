@@ -10,12 +10,16 @@ package netx
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
 	"net"
 	"time"
 
 	"github.com/ooni/netx/handlers"
 	"github.com/ooni/netx/internal"
 	"github.com/ooni/netx/modelx"
+	"github.com/quic-go/quic-go"
 )
 
 // Dialer performs measurements while dialing.
@@ -106,14 +110,53 @@ func (d *Dialer) DialTLSContext(
 	return d.dialer.DialTLSContext(ctx, network, address)
 }
 
+// DialQUIC creates a QUIC connection with address and completes the
+// QUIC handshake. We use the configured resolver and TLS settings,
+// including ForceSpecificSNI, SetCABundle and SetALPN. When no ALPN is
+// configured, we offer "h3". Each connection uses its own UDP socket,
+// which is closed when the connection is closed. Besides the usual
+// DNS events, you will see QUICHandshakeStart, QUICHandshakeDone, which
+// contains the negotiated QUIC version and the server's transport
+// parameters, and ReadFrom and WriteTo events for every datagram.
+func (d *Dialer) DialQUIC(address string) (quic.EarlyConnection, error) {
+	return d.DialQUICContext(context.Background(), address)
+}
+
+// DialQUICContext is like DialQUIC, but with context
+func (d *Dialer) DialQUICContext(
+	ctx context.Context, address string,
+) (quic.EarlyConnection, error) {
+	return d.dialer.DialQUICContext(ctx, address)
+}
+
+// ListenPacket creates a datagram socket bound to address. See the
+// net.ListenPacket docs. When address is empty, we bind to the address
+// configured with SetLocalAddress, if any, or to an ephemeral port. We
+// also honour BindToDevice. We emit a ListenPacket event when creating
+// the socket and, for every datagram, a ReadFrom or WriteTo event with
+// the peer address, the number of bytes and the syscall duration, as
+// well as a Close event when closing the socket. All these events have
+// the same ConnID. Errors are wrapped using modelx.ErrWrapper.
+func (d *Dialer) ListenPacket(network, address string) (net.PacketConn, error) {
+	return d.ListenPacketContext(context.Background(), network, address)
+}
+
+// ListenPacketContext is like ListenPacket, but with context
+func (d *Dialer) ListenPacketContext(
+	ctx context.Context, network, address string,
+) (net.PacketConn, error) {
+	return d.dialer.ListenPacketContext(ctx, network, address)
+}
+
 // NewResolver returns a new resolver using the same handler of this
 // Dialer. The arguments have the same meaning of ConfigureDNS. The
 // returned resolver will not be used by this Dialer, and will not use
-// this Dialer as well. The fact that it's a method of Dialer rather
-// than an independent method is an historical oddity. There is also a
+// this Dialer as well. However, DoT and DoH resolvers will use the TLS
+// key log settings of this Dialer at the moment of the call (see
+// SetKeyLogWriter and EnableKeyLogEvents). Otherwise, there is also a
 // standalone NewResolver factory and you should probably use it.
 func (d *Dialer) NewResolver(network, address string) (modelx.DNSResolver, error) {
-	return internal.NewResolver(d.dialer.Beginning, d.dialer.Handler, network, address)
+	return d.dialer.NewResolver(network, address)
 }
 
 // NewResolver is a standalone Dialer.NewResolver
@@ -128,11 +171,30 @@ func NewResolverWithoutHandler(network, address string) (modelx.DNSResolver, err
 
 // SetCABundle configures the dialer to use a specific CA bundle. This
 // function is not goroutine safe. Make sure you call it before starting
-// to use this specific dialer.
+// to use this specific dialer. It fails if the file does not contain
+// any valid PEM encoded certificate.
 func (d *Dialer) SetCABundle(path string) error {
 	return d.dialer.SetCABundle(path)
 }
 
+// SetCABundleFromPEM is like SetCABundle but reads the PEM encoded CA
+// bundle from data. This is useful to embedders that ship the bundle
+// along with their binary. When appendToSystemRoots is true, the bundle
+// is appended to a copy of the system roots, otherwise it replaces them.
+// It returns the number of certificates loaded from data, or an error
+// if data does not contain any valid certificate, in which case the
+// configured roots are not changed.
+func (d *Dialer) SetCABundleFromPEM(
+	data []byte, appendToSystemRoots bool,
+) (int, error) {
+	return d.dialer.SetCABundleFromPEM(data, appendToSystemRoots)
+}
+
+// SetCAPool is like SetCABundle but uses an existing pool.
+func (d *Dialer) SetCAPool(pool *x509.CertPool) error {
+	return d.dialer.SetCAPool(pool)
+}
+
 // ForceSpecificSNI forces using a specific SNI.
 func (d *Dialer) ForceSpecificSNI(sni string) error {
 	return d.dialer.ForceSpecificSNI(sni)
@@ -143,6 +205,150 @@ func (d *Dialer) ForceSkipVerify() error {
 	return d.dialer.ForceSkipVerify()
 }
 
+// SetTLSVersions forces the minimum and maximum TLS versions to use,
+// e.g., tls.VersionTLS12. Zero means using the crypto/tls default for
+// the corresponding bound. Setting both values to the same version
+// forces using exactly such version.
+func (d *Dialer) SetTLSVersions(min, max uint16) error {
+	return d.dialer.SetTLSVersions(min, max)
+}
+
+// SetCipherSuites forces the list of TLS cipher suites to offer. Note
+// that crypto/tls only offers the suites it implements and does not
+// allow to configure TLSv1.3 cipher suites.
+func (d *Dialer) SetCipherSuites(suites []uint16) error {
+	return d.dialer.SetCipherSuites(suites)
+}
+
+// SetALPN forces the list of ALPN protocols to offer. Passing an empty
+// list disables ALPN. When this dialer is used by an httpx.Transport,
+// you can pass []string{"http/1.1"} to force using HTTP/1.1 only.
+func (d *Dialer) SetALPN(protos []string) error {
+	return d.dialer.SetALPN(protos)
+}
+
+// SetCurvePreferences forces the list of elliptic curves to
+// offer, in order of preference.
+func (d *Dialer) SetCurvePreferences(curves []tls.CurveID) error {
+	return d.dialer.SetCurvePreferences(curves)
+}
+
+// ForceDisableSessionTickets forces not to offer TLS session tickets.
+func (d *Dialer) ForceDisableSessionTickets() error {
+	return d.dialer.ForceDisableSessionTickets()
+}
+
+// EnableSessionResumption enables TLS session resumption, using a
+// cache containing at most capacity sessions. If capacity is less than
+// one, we use a reasonable default capacity. By default, we do not
+// resume sessions, so we always perform a full TLS handshake.
+func (d *Dialer) EnableSessionResumption(capacity int) error {
+	return d.dialer.EnableSessionResumption(capacity)
+}
+
+// SetKeyLogWriter configures a writer that receives the TLS secrets
+// of each connection using the NSS key log format, i.e., the format
+// used by SSLKEYLOGFILE, which tools like Wireshark can use to decrypt
+// the traffic. This applies to TLS connections created by this dialer,
+// including the ones created by httpx, and to QUIC connections. Since
+// the writer may be used concurrently by several connections, it must
+// be goroutine safe. Saving the secrets of a connection weakens its
+// security, so only use this for debugging and measuring. DoT and DoH
+// resolvers created by ConfigureDNS and NewResolver after calling this
+// method will also use w.
+func (d *Dialer) SetKeyLogWriter(w io.Writer) error {
+	return d.dialer.SetKeyLogWriter(w)
+}
+
+// EnableKeyLogEvents is like SetKeyLogWriter, except that we emit the
+// TLS secrets as TLSKeyLog events tagged with the ConnID of the TLS or
+// QUIC connection using them. This can be used along with SetKeyLogWriter.
+// Because net/http does not tell us which connection is using a secret,
+// there will be no events for the TLS connections httpx uses with proxies.
+func (d *Dialer) EnableKeyLogEvents() error {
+	return d.dialer.EnableKeyLogEvents()
+}
+
+// SetPinnedSPKIHashes configures certificate pinning. Each pin is the
+// base64 encoded SHA-256 hash of the SubjectPublicKeyInfo of a certificate,
+// optionally prefixed by "sha256/", as in HPKP. The TLS handshake fails
+// unless at least one certificate in the verified chains matches one of
+// the pins. This check runs even when we have been told to skip verification,
+// in which case there are no verified chains and we only check the leaf
+// certificate sent by the server. A pinning failure is reported using
+// the `ssl_pinning_error` failure string. An empty list disables pinning.
+// This method uses tls.Config's VerifyPeerCertificate.
+func (d *Dialer) SetPinnedSPKIHashes(pins []string) error {
+	return d.dialer.SetPinnedSPKIHashes(pins)
+}
+
+// SetVerificationHook configures a custom verification function that
+// runs after each successful TLS handshake with the SNI and the connection
+// state. The hook cannot abort the handshake. Its verdict is recorded in the
+// CustomVerificationError field of the connection state included into the
+// TLSHandshakeDone event, using the `ssl_custom_verification_error` failure
+// string. Use a nil hook to disable this functionality.
+func (d *Dialer) SetVerificationHook(
+	hook func(serverName string, state tls.ConnectionState) error,
+) error {
+	return d.dialer.SetVerificationHook(hook)
+}
+
+// SetWriteSegmentation splits the first write on each TCP connection
+// into several writes, which, since Go disables Nagle's algorithm, will
+// most likely be sent as distinct TCP segments. This allows to study
+// whether DPI boxes reassemble the stream before looking for the SNI or
+// for the HTTP Host header. A new segment starts at each of the given
+// offsets and, when splitSNI is true, also at the beginning and in the
+// middle of the hostname found in the ClientHello SNI extension or in the
+// cleartext HTTP Host header. We wait delay between segments, but never
+// beyond the connection's write deadline. Passing no offsets and a false
+// splitSNI disables segmentation. Because the HTTP transport dials using
+// this dialer, segmentation also applies to HTTP. The plan applied to
+// each connection is recorded in the WriteSegmentation event and each
+// segment is recorded by its own Write event.
+func (d *Dialer) SetWriteSegmentation(
+	offsets []int, splitSNI bool, delay time.Duration,
+) error {
+	return d.dialer.SetWriteSegmentation(offsets, splitSNI, delay)
+}
+
+// SetClientHelloFingerprint forces DialTLS and DialTLSContext to send
+// a browser-like ClientHello, parroting its extensions, their ordering
+// and GREASE values. This allows to distinguish blocking based on the
+// TLS fingerprint from blocking based on the SNI. The available names
+// are "chrome", "firefox", "ios", and "randomized". The empty string or
+// "golang" restore the default, i.e. the crypto/tls ClientHello. When
+// parroting, the returned conn is not a *tls.Conn and some settings, such
+// as cipher suites, curves and session resumption, are ignored because
+// the ClientHello is fully determined by the fingerprint. The chosen
+// fingerprint is recorded in the TLSHandshakeStart event.
+func (d *Dialer) SetClientHelloFingerprint(name string) error {
+	return d.dialer.SetClientHelloFingerprint(name)
+}
+
+// SetLocalAddress forces the dialer to bind the sockets it creates to
+// a specific local address, such that we can choose which network path
+// a measurement takes on multi-homed devices. The address is either an
+// IP address (e.g. "10.0.0.1"), or an endpoint (e.g. "10.0.0.1:5555" or
+// "[::1]:5555"). Note that, when you bind to an IPv4 address, you cannot
+// connect to IPv6 endpoints and vice versa. Note also that binding to
+// a specific port prevents you from having more than one connection
+// open at the same time. This function is not goroutine safe. Make sure
+// you call it before starting to use this specific dialer.
+func (d *Dialer) SetLocalAddress(address string) error {
+	return d.dialer.SetLocalAddress(address)
+}
+
+// BindToDevice forces the dialer to bind the sockets it creates to a
+// specific network interface (e.g. "wlan0"). This is only supported on
+// Linux, where it typically requires the CAP_NET_RAW capability, and
+// returns an error on other platforms. This function is not goroutine
+// safe. Make sure you call it before starting to use this dialer.
+func (d *Dialer) BindToDevice(device string) error {
+	return d.dialer.BindToDevice(device)
+}
+
 // ChainResolvers chains a primary and a secondary resolver such that
 // we can fallback to the secondary if primary is broken.
 func ChainResolvers(primary, secondary modelx.DNSResolver) modelx.DNSResolver {
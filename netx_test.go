@@ -5,11 +5,16 @@ import (
 	"crypto/x509"
 	"errors"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
 
 	"github.com/ooni/netx"
 	"github.com/ooni/netx/handlers"
 	"github.com/ooni/netx/internal/resolver/brokenresolver"
+	"github.com/ooni/netx/modelx"
+	"github.com/quic-go/quic-go"
 )
 
 func TestIntegrationDialer(t *testing.T) {
@@ -153,3 +158,120 @@ func TestChainResolvers(t *testing.T) {
 	}
 	defer conn.Close()
 }
+
+type quicHandler struct {
+	mu   sync.Mutex
+	done []*modelx.QUICHandshakeDoneEvent
+}
+
+func (h *quicHandler) OnMeasurement(m modelx.Measurement) {
+	if m.QUICHandshakeDone != nil {
+		h.mu.Lock()
+		h.done = append(h.done, m.QUICHandshakeDone)
+		h.mu.Unlock()
+	}
+}
+
+func TestDialQUIC(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {},
+	))
+	defer server.Close()
+	config := server.TLS.Clone()
+	config.NextProtos = []string{"h3"}
+	listener, err := quic.ListenAddr("127.0.0.1:0", config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	handler := new(quicHandler)
+	dialer := netx.NewDialer(handler)
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	if err := dialer.SetCAPool(pool); err != nil {
+		t.Fatal(err)
+	}
+	// The httptest certificate is also valid for example.com
+	if err := dialer.ForceSpecificSNI("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.DialQUIC(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.CloseWithError(0, "")
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if len(handler.done) != 1 {
+		t.Fatal("unexpected number of QUICHandshakeDone events")
+	}
+	done := handler.done[0]
+	if done.ConnectionState.ServerName != "example.com" {
+		t.Fatal("unexpected SNI")
+	}
+	if done.ConnectionState.NegotiatedProtocol != "h3" {
+		t.Fatal("unexpected ALPN")
+	}
+	if done.Version != "v1" {
+		t.Fatal("unexpected QUIC version", done.Version)
+	}
+	if done.TransportParameters == nil {
+		t.Fatal("expected transport parameters")
+	}
+}
+
+type datagramHandler struct {
+	mu       sync.Mutex
+	readFrom []*modelx.ReadFromEvent
+	writeTo  []*modelx.WriteToEvent
+}
+
+func (h *datagramHandler) OnMeasurement(m modelx.Measurement) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if m.ReadFrom != nil {
+		h.readFrom = append(h.readFrom, m.ReadFrom)
+	}
+	if m.WriteTo != nil {
+		h.writeTo = append(h.writeTo, m.WriteTo)
+	}
+}
+
+func TestListenPacket(t *testing.T) {
+	handler := new(datagramHandler)
+	dialer := netx.NewDialer(handler)
+	if err := dialer.SetLocalAddress("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	pconn, err := dialer.ListenPacket("udp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pconn.Close()
+	// Send a datagram to ourselves so we see both events
+	if _, err := pconn.WriteTo([]byte("antani"), pconn.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buffer := make([]byte, 128)
+	count, addr, err := pconn.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 6 || addr.String() != pconn.LocalAddr().String() {
+		t.Fatal("unexpected datagram")
+	}
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if len(handler.readFrom) != 1 || len(handler.writeTo) != 1 {
+		t.Fatal("unexpected number of events")
+	}
+	if handler.readFrom[0].NumBytes != 6 || handler.writeTo[0].NumBytes != 6 {
+		t.Fatal("unexpected number of bytes")
+	}
+	if handler.readFrom[0].RemoteAddress != addr.String() {
+		t.Fatal("unexpected peer address")
+	}
+	if handler.readFrom[0].ConnID != handler.writeTo[0].ConnID {
+		t.Fatal("expected the same ConnID")
+	}
+}
@@ -0,0 +1,559 @@
+// Package har contains a handler that assembles the HTTP transactions
+// observed by netx into a HAR (HTTP Archive) 1.2 document.
+//
+// This is an experimental package and may change/disappear
+// at any time without any documentation.
+//
+// We build an entry for each transaction using the HTTP events and
+// we join them with the DNS, connect and TLS events of the connection
+// used by the transaction to compute the timings. When a transaction
+// reuses a connection, the dns, connect and ssl timings are -1, as
+// mandated by the specification. Because the bodies come from the
+// snaps included in the events, the content may be truncated, in
+// which case we set the response bodySize to -1 (i.e., unknown),
+// unless we know the size because body statistics are enabled.
+//
+// See http://www.softwareishard.com/blog/har-12-spec/.
+package har
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ooni/netx/modelx"
+)
+
+// HAR is the toplevel HAR object.
+type HAR struct {
+	Log Log `json:"log"`
+}
+
+// Log is the HAR log object.
+type Log struct {
+	Version string  `json:"version"`
+	Creator Creator `json:"creator"`
+	Entries []Entry `json:"entries"`
+}
+
+// Creator describes the application that created the log.
+type Creator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// Entry is a HAR entry, i.e., a HTTP transaction.
+type Entry struct {
+	StartedDateTime string   `json:"startedDateTime"`
+	Time            float64  `json:"time"`
+	Request         Request  `json:"request"`
+	Response        Response `json:"response"`
+	Cache           struct{} `json:"cache"`
+	Timings         Timings  `json:"timings"`
+	ServerIPAddress string   `json:"serverIPAddress,omitempty"`
+	Connection      string   `json:"connection,omitempty"`
+
+	// TransactionID is the netx transaction ID, which allows
+	// to join an entry with the original events.
+	TransactionID int64 `json:"_transactionID"`
+}
+
+// Request is a HAR request.
+type Request struct {
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []Cookie    `json:"cookies"`
+	Headers     []NameValue `json:"headers"`
+	QueryString []NameValue `json:"queryString"`
+	PostData    *PostData   `json:"postData,omitempty"`
+	HeadersSize int64       `json:"headersSize"`
+	BodySize    int64       `json:"bodySize"`
+}
+
+// Response is a HAR response.
+type Response struct {
+	Status      int64       `json:"status"`
+	StatusText  string      `json:"statusText"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []Cookie    `json:"cookies"`
+	Headers     []NameValue `json:"headers"`
+	Content     Content     `json:"content"`
+	RedirectURL string      `json:"redirectURL"`
+	HeadersSize int64       `json:"headersSize"`
+	BodySize    int64       `json:"bodySize"`
+
+	// Error is the error that occurred, if any. We use the same
+	// custom field used by browsers for failed requests.
+	Error string `json:"_error,omitempty"`
+}
+
+// Cookie is a HAR cookie.
+type Cookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Expires  string `json:"expires,omitempty"`
+	HTTPOnly bool   `json:"httpOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+}
+
+// NameValue is a HAR header or query string parameter.
+type NameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// PostData is the body of a HAR request.
+type PostData struct {
+	MimeType string      `json:"mimeType"`
+	Params   []NameValue `json:"params"`
+	Text     string      `json:"text"`
+}
+
+// Content is the body of a HAR response. When the body is
+// not valid UTF-8, the text is base64 encoded.
+type Content struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// Timings contains the timings of a HAR entry in milliseconds. A
+// value of -1 means that the timing does not apply. As mandated by
+// the specification, connect includes ssl.
+type Timings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// dial contains the events of a dial operation.
+type dial struct {
+	resolveStart *modelx.ResolveStartEvent
+	resolveDone  *modelx.ResolveDoneEvent
+}
+
+// conn contains the events of a connection.
+type conn struct {
+	dialID         int64
+	remoteAddress  string
+	start          time.Duration
+	connected      time.Duration
+	handshakeStart time.Duration
+	handshakeDone  time.Duration
+	transactionID  int64
+}
+
+// transaction contains the events of a HTTP transaction.
+type transaction struct {
+	start         *modelx.HTTPRoundTripStartEvent
+	ready         *modelx.HTTPConnectionReadyEvent
+	requestDone   *modelx.HTTPRequestDoneEvent
+	responseStart *modelx.HTTPResponseStartEvent
+	roundTripDone *modelx.HTTPRoundTripDoneEvent
+	responseDone  *modelx.HTTPResponseDoneEvent
+}
+
+// Handler is a modelx.Handler that collects the events required
+// to build a HAR document. You can call HAR or Write once all the
+// transactions you're interested into have completed.
+type Handler struct {
+	beginning    time.Time
+	conns        map[int64]*conn
+	dials        map[int64]*dial
+	mu           sync.Mutex
+	transactions map[int64]*transaction
+}
+
+// NewHandler creates a new Handler. The beginning must be the
+// Beginning of the MeasurementRoot, since we use it to compute the
+// startedDateTime of each entry.
+func NewHandler(beginning time.Time) *Handler {
+	return &Handler{
+		beginning:    beginning,
+		conns:        make(map[int64]*conn),
+		dials:        make(map[int64]*dial),
+		transactions: make(map[int64]*transaction),
+	}
+}
+
+// OnMeasurement handles a measurement event.
+func (h *Handler) OnMeasurement(m modelx.Measurement) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch {
+	case m.ResolveStart != nil:
+		h.dial(m.ResolveStart.DialID).resolveStart = m.ResolveStart
+	case m.ResolveDone != nil:
+		h.dial(m.ResolveDone.DialID).resolveDone = m.ResolveDone
+	case m.Connect != nil:
+		ev := m.Connect
+		if ev.Error != nil || ev.ConnID == 0 {
+			return
+		}
+		h.conns[ev.ConnID] = &conn{
+			dialID:        ev.DialID,
+			remoteAddress: ev.RemoteAddress,
+			start:         ev.DurationSinceBeginning - ev.SyscallDuration,
+			connected:     ev.DurationSinceBeginning,
+			transactionID: ev.TransactionID,
+		}
+	case m.TLSHandshakeStart != nil:
+		if c := h.conns[m.TLSHandshakeStart.ConnID]; c != nil {
+			c.handshakeStart = m.TLSHandshakeStart.DurationSinceBeginning
+		}
+	case m.TLSHandshakeDone != nil:
+		if c := h.conns[m.TLSHandshakeDone.ConnID]; c != nil {
+			c.handshakeDone = m.TLSHandshakeDone.DurationSinceBeginning
+		}
+	case m.QUICHandshakeStart != nil:
+		// With QUIC there is no connect, so the connection
+		// is established when the handshake completes.
+		ev := m.QUICHandshakeStart
+		h.conns[ev.ConnID] = &conn{
+			dialID:         ev.DialID,
+			remoteAddress:  ev.RemoteAddress,
+			start:          ev.DurationSinceBeginning,
+			handshakeStart: ev.DurationSinceBeginning,
+			transactionID:  ev.TransactionID,
+		}
+	case m.QUICHandshakeDone != nil:
+		if c := h.conns[m.QUICHandshakeDone.ConnID]; c != nil {
+			c.connected = m.QUICHandshakeDone.DurationSinceBeginning
+			c.handshakeDone = m.QUICHandshakeDone.DurationSinceBeginning
+		}
+	case m.HTTPRoundTripStart != nil:
+		h.transaction(m.HTTPRoundTripStart.TransactionID).start = m.HTTPRoundTripStart
+	case m.HTTPConnectionReady != nil:
+		h.transaction(m.HTTPConnectionReady.TransactionID).ready = m.HTTPConnectionReady
+	case m.HTTPRequestDone != nil:
+		h.transaction(m.HTTPRequestDone.TransactionID).requestDone = m.HTTPRequestDone
+	case m.HTTPResponseStart != nil:
+		h.transaction(m.HTTPResponseStart.TransactionID).responseStart = m.HTTPResponseStart
+	case m.HTTPRoundTripDone != nil:
+		h.transaction(m.HTTPRoundTripDone.TransactionID).roundTripDone = m.HTTPRoundTripDone
+	case m.HTTPResponseDone != nil:
+		h.transaction(m.HTTPResponseDone.TransactionID).responseDone = m.HTTPResponseDone
+	}
+}
+
+func (h *Handler) dial(id int64) *dial {
+	d := h.dials[id]
+	if d == nil {
+		d = &dial{}
+		h.dials[id] = d
+	}
+	return d
+}
+
+func (h *Handler) transaction(id int64) *transaction {
+	t := h.transactions[id]
+	if t == nil {
+		t = &transaction{}
+		h.transactions[id] = t
+	}
+	return t
+}
+
+// HAR returns the HAR document containing an entry for each
+// transaction that we've seen starting and finishing, sorted by
+// start time. The document only contains completed transactions.
+func (h *Handler) HAR() *HAR {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := &HAR{Log: Log{
+		Version: "1.2",
+		Creator: Creator{Name: "netx", Version: "0.1.0"},
+		Entries: []Entry{},
+	}}
+	var tids []int64
+	for tid, t := range h.transactions {
+		if t.start == nil || t.roundTripDone == nil {
+			continue
+		}
+		tids = append(tids, tid)
+	}
+	// Sort using the durations, since the formatted times do not
+	// sort lexicographically because RFC3339Nano trims zeros.
+	sort.Slice(tids, func(i, j int) bool {
+		si := h.transactions[tids[i]].start.DurationSinceBeginning
+		sj := h.transactions[tids[j]].start.DurationSinceBeginning
+		if si != sj {
+			return si < sj
+		}
+		return tids[i] < tids[j]
+	})
+	for _, tid := range tids {
+		out.Log.Entries = append(out.Log.Entries, h.newEntry(tid, h.transactions[tid]))
+	}
+	return out
+}
+
+// Write writes the HAR document into w.
+func (h *Handler) Write(w io.Writer) error {
+	data, err := json.MarshalIndent(h.HAR(), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// findConn returns the connection used by the transaction, if any. We
+// use the ConnID when we know it, otherwise the last connection
+// dialed on behalf of the transaction, e.g., with HTTP/3.
+func (h *Handler) findConn(tid int64, t *transaction) (int64, *conn) {
+	if t.ready != nil && t.ready.ConnID != 0 {
+		return t.ready.ConnID, h.conns[t.ready.ConnID]
+	}
+	var (
+		connID int64
+		found  *conn
+	)
+	for id, c := range h.conns {
+		if c.transactionID == tid && (found == nil || c.start > found.start) {
+			connID, found = id, c
+		}
+	}
+	return connID, found
+}
+
+func (h *Handler) newEntry(tid int64, t *transaction) Entry {
+	rtd := t.roundTripDone
+	connID, c := h.findConn(tid, t)
+	entry := Entry{
+		StartedDateTime: h.beginning.Add(
+			t.start.DurationSinceBeginning).Format(time.RFC3339Nano),
+		Request:       newRequest(rtd),
+		Response:      newResponse(rtd, t.responseDone),
+		Timings:       h.newTimings(t, c),
+		TransactionID: tid,
+	}
+	if connID != 0 {
+		entry.Connection = strconv.FormatInt(connID, 10)
+	}
+	if c != nil {
+		entry.ServerIPAddress = hostOnly(c.remoteAddress)
+	}
+	for _, value := range []float64{
+		entry.Timings.Blocked, entry.Timings.DNS, entry.Timings.Connect,
+		entry.Timings.Send, entry.Timings.Wait, entry.Timings.Receive,
+	} {
+		if value > 0 {
+			entry.Time += value
+		}
+	}
+	return entry
+}
+
+// newTimings computes the timings of the transaction. We consider the
+// time from when the dial resolved the domain to when the connection is
+// ready as connect time, so we also include failed connect attempts,
+// and what remains between the round trip start and the connection
+// ready, if anything, is the blocked time.
+func (h *Handler) newTimings(t *transaction, c *conn) Timings {
+	timings := Timings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1}
+	start := t.start.DurationSinceBeginning
+	end := t.roundTripDone.DurationSinceBeginning
+	if t.responseDone != nil {
+		end = t.responseDone.DurationSinceBeginning
+	}
+	ready := start
+	if t.ready != nil {
+		ready = t.ready.DurationSinceBeginning
+	}
+	var setup time.Duration
+	if c != nil && (t.ready == nil || !t.ready.Reused) {
+		connectStart := c.start
+		if d := h.dials[c.dialID]; d != nil && c.dialID != 0 &&
+			d.resolveStart != nil && d.resolveDone != nil {
+			timings.DNS = millis(d.resolveDone.DurationSinceBeginning -
+				d.resolveStart.DurationSinceBeginning)
+			setup += d.resolveDone.DurationSinceBeginning -
+				d.resolveStart.DurationSinceBeginning
+			connectStart = d.resolveDone.DurationSinceBeginning
+		}
+		connectEnd := c.connected
+		if c.handshakeDone > 0 {
+			timings.SSL = millis(c.handshakeDone - c.handshakeStart)
+			connectEnd = c.handshakeDone
+		}
+		timings.Connect = millis(connectEnd - connectStart)
+		setup += connectEnd - connectStart
+	}
+	if blocked := ready - start - setup; blocked > 0 {
+		timings.Blocked = millis(blocked)
+	}
+	requestDone := ready
+	if t.requestDone != nil {
+		requestDone = t.requestDone.DurationSinceBeginning
+		timings.Send = millis(requestDone - ready)
+	}
+	if t.responseStart != nil {
+		timings.Wait = millis(t.responseStart.DurationSinceBeginning - requestDone)
+		timings.Receive = millis(end - t.responseStart.DurationSinceBeginning)
+	}
+	return timings
+}
+
+// millis converts d to milliseconds, clamping negative values to
+// zero, which may happen because of how events are ordered.
+func millis(d time.Duration) float64 {
+	if d < 0 {
+		return 0
+	}
+	return float64(d) / float64(time.Millisecond)
+}
+
+func newRequest(rtd *modelx.HTTPRoundTripDoneEvent) Request {
+	req := Request{
+		Method:      rtd.RequestMethod,
+		URL:         rtd.RequestURL,
+		HTTPVersion: httpVersion(rtd.ResponseProto),
+		Cookies:     []Cookie{},
+		Headers:     newHeaders(rtd.RequestHeadersList, rtd.RequestHeaders),
+		QueryString: []NameValue{},
+		HeadersSize: -1,
+		BodySize:    int64(len(rtd.RequestBodySnap)),
+	}
+	for _, cookie := range rtd.RequestCookies {
+		req.Cookies = append(req.Cookies, newCookie(cookie))
+	}
+	if URL, err := url.Parse(rtd.RequestURL); err == nil {
+		req.QueryString = newNameValues(URL.Query())
+	}
+	if len(rtd.RequestBodySnap) > 0 {
+		req.PostData = &PostData{
+			MimeType: rtd.RequestHeaders.Get("Content-Type"),
+			Params:   []NameValue{},
+			Text:     string(rtd.RequestBodySnap),
+		}
+	}
+	return req
+}
+
+func newResponse(
+	rtd *modelx.HTTPRoundTripDoneEvent, rd *modelx.HTTPResponseDoneEvent,
+) Response {
+	resp := Response{
+		Status:      rtd.ResponseStatusCode,
+		StatusText:  http.StatusText(int(rtd.ResponseStatusCode)),
+		HTTPVersion: httpVersion(rtd.ResponseProto),
+		Cookies:     []Cookie{},
+		Headers:     newHeaders(rtd.ResponseHeadersList, rtd.ResponseHeaders),
+		RedirectURL: rtd.ResponseHeaders.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    -1,
+	}
+	if rtd.Error != nil {
+		resp.Error = rtd.Error.Error()
+		resp.Status = 0
+		resp.StatusText = ""
+	}
+	for _, cookie := range rtd.ResponseCookies {
+		resp.Cookies = append(resp.Cookies, newCookie(cookie))
+	}
+	body := rtd.ResponseBodySnap
+	if rtd.ResponseBodyDecodedSnap != nil {
+		body = rtd.ResponseBodyDecodedSnap
+	}
+	resp.Content = newContent(body, rtd.ResponseHeaders.Get("Content-Type"))
+	if rd != nil && rd.BodyStats != nil && rd.BodyStats.Complete {
+		resp.BodySize = rd.BodyStats.Size
+	} else if int64(len(rtd.ResponseBodySnap)) < rtd.MaxBodySnapSize {
+		resp.BodySize = int64(len(rtd.ResponseBodySnap))
+	}
+	if rtd.ResponseBodyDecodedSnap == nil && resp.BodySize >= 0 {
+		resp.Content.Size = resp.BodySize
+	}
+	return resp
+}
+
+func newContent(body []byte, mimeType string) Content {
+	content := Content{Size: int64(len(body)), MimeType: mimeType}
+	if utf8.Valid(body) {
+		content.Text = string(body)
+	} else {
+		content.Text = base64.StdEncoding.EncodeToString(body)
+		content.Encoding = "base64"
+	}
+	return content
+}
+
+// newHeaders prefers the headers as seen on the wire and otherwise
+// falls back to the headers map, sorting them by name.
+func newHeaders(list []modelx.HTTPHeaderField, headers http.Header) []NameValue {
+	if len(list) > 0 {
+		out := []NameValue{}
+		for _, field := range list {
+			out = append(out, NameValue{Name: field.Key, Value: field.Value})
+		}
+		return out
+	}
+	return newNameValues(headers)
+}
+
+func newNameValues(values map[string][]string) []NameValue {
+	var keys []string
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	out := []NameValue{}
+	for _, key := range keys {
+		for _, value := range values[key] {
+			out = append(out, NameValue{Name: key, Value: value})
+		}
+	}
+	return out
+}
+
+func newCookie(cookie *http.Cookie) Cookie {
+	out := Cookie{
+		Name:     cookie.Name,
+		Value:    cookie.Value,
+		Path:     cookie.Path,
+		Domain:   cookie.Domain,
+		HTTPOnly: cookie.HttpOnly,
+		Secure:   cookie.Secure,
+	}
+	if !cookie.Expires.IsZero() {
+		out.Expires = cookie.Expires.Format(time.RFC3339)
+	}
+	return out
+}
+
+// httpVersion returns the version using the names used by
+// browsers, e.g., "HTTP/1.1", "h2", and "h3".
+func httpVersion(proto string) string {
+	switch proto {
+	case "HTTP/2.0":
+		return "h2"
+	case "HTTP/3.0":
+		return "h3"
+	}
+	return proto
+}
+
+func hostOnly(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
+}
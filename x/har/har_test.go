@@ -0,0 +1,224 @@
+package har
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ooni/netx/handlers"
+	"github.com/ooni/netx/httpx"
+	"github.com/ooni/netx/modelx"
+)
+
+func ms(v int64) time.Duration {
+	return time.Duration(v) * time.Millisecond
+}
+
+func TestUnitTimings(t *testing.T) {
+	beginning := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	h := NewHandler(beginning)
+	for _, m := range []modelx.Measurement{
+		{HTTPRoundTripStart: &modelx.HTTPRoundTripStartEvent{
+			DurationSinceBeginning: ms(10), Method: "GET",
+			TransactionID: 1, URL: "https://www.example.com/?a=b",
+		}},
+		{ResolveStart: &modelx.ResolveStartEvent{
+			DialID: 7, DurationSinceBeginning: ms(11), TransactionID: 1,
+		}},
+		{ResolveDone: &modelx.ResolveDoneEvent{
+			DialID: 7, DurationSinceBeginning: ms(15), TransactionID: 1,
+		}},
+		{Connect: &modelx.ConnectEvent{
+			ConnID: 3, DialID: 7, DurationSinceBeginning: ms(25),
+			RemoteAddress: "93.184.216.34:443", SyscallDuration: ms(10),
+			TransactionID: 1,
+		}},
+		{TLSHandshakeStart: &modelx.TLSHandshakeStartEvent{
+			ConnID: 3, DurationSinceBeginning: ms(25), TransactionID: 1,
+		}},
+		{TLSHandshakeDone: &modelx.TLSHandshakeDoneEvent{
+			ConnID: 3, DurationSinceBeginning: ms(40), TransactionID: 1,
+		}},
+		{HTTPConnectionReady: &modelx.HTTPConnectionReadyEvent{
+			ConnID: 3, DurationSinceBeginning: ms(41), TransactionID: 1,
+		}},
+		{HTTPRequestDone: &modelx.HTTPRequestDoneEvent{
+			DurationSinceBeginning: ms(43), TransactionID: 1,
+		}},
+		{HTTPResponseStart: &modelx.HTTPResponseStartEvent{
+			DurationSinceBeginning: ms(63), TransactionID: 1,
+		}},
+		{HTTPRoundTripDone: &modelx.HTTPRoundTripDoneEvent{
+			DurationSinceBeginning: ms(64),
+			MaxBodySnapSize:        1 << 20,
+			RequestHeaders:         http.Header{"Accept": {"*/*"}},
+			RequestMethod:          "GET",
+			RequestURL:             "https://www.example.com/?a=b",
+			ResponseBodySnap:       []byte("\xff\xfe"),
+			ResponseHeaders: http.Header{
+				"Content-Type": {"application/octet-stream"},
+			},
+			ResponseProto:      "HTTP/2.0",
+			ResponseStatusCode: 200,
+			TransactionID:      1,
+		}},
+		{HTTPResponseDone: &modelx.HTTPResponseDoneEvent{
+			DurationSinceBeginning: ms(70), TransactionID: 1,
+		}},
+		// The second transaction reuses the connection and fails
+		{HTTPRoundTripStart: &modelx.HTTPRoundTripStartEvent{
+			DurationSinceBeginning: ms(80), Method: "GET",
+			TransactionID: 2, URL: "https://www.example.com/robots.txt",
+		}},
+		{HTTPConnectionReady: &modelx.HTTPConnectionReadyEvent{
+			ConnID: 3, DurationSinceBeginning: ms(81), Reused: true,
+			TransactionID: 2,
+		}},
+		{HTTPRequestDone: &modelx.HTTPRequestDoneEvent{
+			DurationSinceBeginning: ms(82), TransactionID: 2,
+		}},
+		{HTTPRoundTripDone: &modelx.HTTPRoundTripDoneEvent{
+			DurationSinceBeginning: ms(90),
+			Error:                  errors.New("generic_timeout_error"),
+			RequestMethod:          "GET",
+			RequestURL:             "https://www.example.com/robots.txt",
+			TransactionID:          2,
+		}},
+		// The third transaction has not completed yet
+		{HTTPRoundTripStart: &modelx.HTTPRoundTripStartEvent{
+			DurationSinceBeginning: ms(5), TransactionID: 3,
+		}},
+	} {
+		h.OnMeasurement(m)
+	}
+	out := h.HAR()
+	if out.Log.Version != "1.2" || len(out.Log.Entries) != 2 {
+		t.Fatal("unexpected log", out.Log)
+	}
+	first := out.Log.Entries[0]
+	if first.StartedDateTime != "2020-01-01T00:00:00.01Z" {
+		t.Fatal("unexpected startedDateTime", first.StartedDateTime)
+	}
+	expect := Timings{
+		Blocked: 2, DNS: 4, Connect: 25, Send: 2, Wait: 20, Receive: 7, SSL: 15,
+	}
+	if first.Timings != expect {
+		t.Fatal("unexpected timings", first.Timings)
+	}
+	if first.Time != 60 {
+		t.Fatal("unexpected time", first.Time)
+	}
+	if first.ServerIPAddress != "93.184.216.34" || first.Connection != "3" {
+		t.Fatal("unexpected connection", first)
+	}
+	if first.Request.HTTPVersion != "h2" || len(first.Request.QueryString) != 1 {
+		t.Fatal("unexpected request", first.Request)
+	}
+	if first.Response.Content.Encoding != "base64" || first.Response.BodySize != 2 {
+		t.Fatal("unexpected response", first.Response)
+	}
+	second := out.Log.Entries[1]
+	expect = Timings{
+		Blocked: 1, DNS: -1, Connect: -1, Send: 1, Wait: 0, Receive: 0, SSL: -1,
+	}
+	if second.Timings != expect {
+		t.Fatal("unexpected timings", second.Timings)
+	}
+	if second.Response.Status != 0 || second.Response.Error != "generic_timeout_error" {
+		t.Fatal("unexpected response", second.Response)
+	}
+}
+
+func TestUnitEntriesSortedByStartTime(t *testing.T) {
+	beginning := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	h := NewHandler(beginning)
+	// Formatted, 1.5s would come before 1s and 1.12s before 1.123s
+	for tid, start := range []time.Duration{
+		ms(1500), ms(1000), ms(1123), ms(1120),
+	} {
+		h.OnMeasurement(modelx.Measurement{
+			HTTPRoundTripStart: &modelx.HTTPRoundTripStartEvent{
+				DurationSinceBeginning: start, TransactionID: int64(tid + 1),
+			},
+		})
+		h.OnMeasurement(modelx.Measurement{
+			HTTPRoundTripDone: &modelx.HTTPRoundTripDoneEvent{
+				DurationSinceBeginning: start + ms(1), TransactionID: int64(tid + 1),
+			},
+		})
+	}
+	var tids []int64
+	for _, entry := range h.HAR().Log.Entries {
+		tids = append(tids, entry.TransactionID)
+	}
+	if !reflect.DeepEqual(tids, []int64{2, 4, 3, 1}) {
+		t.Fatal("unexpected order", tids)
+	}
+}
+
+func TestIntegrationHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("hello, world"))
+		},
+	))
+	defer server.Close()
+	beginning := time.Now()
+	handler := NewHandler(beginning)
+	client := httpx.NewClientWithoutProxy(handlers.NoHandler)
+	ctx := modelx.WithMeasurementRoot(context.Background(), &modelx.MeasurementRoot{
+		Beginning: beginning,
+		Handler:   handler,
+	})
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.HTTPClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ioutil.ReadAll(resp.Body); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	client.Transport.CloseIdleConnections()
+	buf := new(bytes.Buffer)
+	if err := handler.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	var out HAR
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Log.Entries) != 2 {
+		t.Fatal("unexpected number of entries")
+	}
+	first, second := out.Log.Entries[0], out.Log.Entries[1]
+	if first.Request.URL != server.URL || first.Response.Status != 200 {
+		t.Fatal("unexpected entry", first)
+	}
+	if first.Response.Content.Text != "hello, world" ||
+		first.Response.Content.MimeType != "text/plain" {
+		t.Fatal("unexpected content", first.Response.Content)
+	}
+	if first.Timings.Connect < 0 || second.Timings.Connect != -1 {
+		t.Fatal("unexpected connect timings", first.Timings, second.Timings)
+	}
+	if first.Connection == "" || first.Connection != second.Connection {
+		t.Fatal("unexpected connections", first.Connection, second.Connection)
+	}
+	if first.ServerIPAddress != "127.0.0.1" {
+		t.Fatal("unexpected server IP address", first.ServerIPAddress)
+	}
+}
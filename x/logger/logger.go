@@ -67,11 +67,27 @@ func (h *Handler) OnMeasurement(m modelx.Measurement) {
 			m.Connect.SyscallDuration,
 		)
 	}
+	if m.ListenPacket != nil {
+		h.logger.Debugf(
+			"[connID: %d] listen done: %s, %s",
+			m.ListenPacket.ConnID,
+			fmtError(m.ListenPacket.Error),
+			m.ListenPacket.LocalAddress,
+		)
+	}
+	if m.WriteSegmentation != nil {
+		h.logger.Debugf(
+			"[httpTxID: %d] write segmentation: %v (delay=%s)",
+			m.WriteSegmentation.TransactionID,
+			m.WriteSegmentation.Offsets,
+			m.WriteSegmentation.Delay,
+		)
+	}
 
 	// TLS
 	if m.TLSHandshakeStart != nil {
 		h.logger.Debugf(
-			"[httpTxID: %d] TLS handshake: (forceSNI='%s')",
+			"[httpTxID: %d] TLS handshake: (sni='%s')",
 			m.TLSHandshakeStart.TransactionID,
 			m.TLSHandshakeStart.SNI,
 		)
@@ -86,6 +102,25 @@ func (h *Handler) OnMeasurement(m modelx.Measurement) {
 		)
 	}
 
+	// QUIC
+	if m.QUICHandshakeStart != nil {
+		h.logger.Debugf(
+			"[httpTxID: %d] QUIC handshake: %s (sni='%s')",
+			m.QUICHandshakeStart.TransactionID,
+			m.QUICHandshakeStart.RemoteAddress,
+			m.QUICHandshakeStart.SNI,
+		)
+	}
+	if m.QUICHandshakeDone != nil {
+		h.logger.Debugf(
+			"[httpTxID: %d] QUIC done: %s, %s (alpn='%s')",
+			m.QUICHandshakeDone.TransactionID,
+			fmtError(m.QUICHandshakeDone.Error),
+			m.QUICHandshakeDone.Version,
+			m.QUICHandshakeDone.ConnectionState.NegotiatedProtocol,
+		)
+	}
+
 	// HTTP round trip
 	if m.HTTPRequestHeadersDone != nil {
 		proto := "HTTP/1.1"
@@ -157,6 +192,24 @@ func (h *Handler) OnMeasurement(m modelx.Measurement) {
 			"[httpTxID: %d] <", m.HTTPRoundTripDone.TransactionID)
 	}
 
+	// HTTP/2 frames
+	if m.HTTP2Frame != nil {
+		direction := "<"
+		if m.HTTP2Frame.Operation == "write" {
+			direction = ">"
+		}
+		h.logger.Debugf(
+			"[httpTxID: %d] %s %s stream=%d len=%d flags=%#x %s",
+			m.HTTP2Frame.TransactionID,
+			direction,
+			m.HTTP2Frame.Type,
+			m.HTTP2Frame.StreamID,
+			m.HTTP2Frame.Length,
+			m.HTTP2Frame.Flags,
+			m.HTTP2Frame.ErrCode,
+		)
+	}
+
 	// HTTP response body
 	if m.HTTPResponseBodyPart != nil {
 		h.logger.Debugf(
@@ -172,6 +225,14 @@ func (h *Handler) OnMeasurement(m modelx.Measurement) {
 			m.HTTPResponseDone.TransactionID,
 		)
 	}
+	if m.HTTPResponseDone != nil && m.HTTPResponseDone.BodyStats != nil {
+		stats := m.HTTPResponseDone.BodyStats
+		h.logger.Debugf(
+			"[httpTxID: %d] body stats: %d bytes, complete: %t, sha256: %s, ttfb: %s",
+			m.HTTPResponseDone.TransactionID, stats.Size, stats.Complete,
+			stats.SHA256, stats.TimeToFirstByte,
+		)
+	}
 }
 
 func tlsVersionString(d uint16) string {
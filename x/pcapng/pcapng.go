@@ -0,0 +1,390 @@
+// Package pcapng contains a handler that writes the bytes flowing
+// through measured connections into a pcapng file.
+//
+// This is an experimental package and may change/disappear
+// at any time without any documentation.
+//
+// We do not capture packets. Rather, we synthesize IP, TCP and UDP
+// headers using the endpoints, the bytes, and the timing of the
+// events emitted by netx, so that the result can be opened with tools
+// like Wireshark. Because of that, the bytes must be included in the
+// events, which requires setting MaxConnSnapSize in the MeasurementRoot.
+// When a snap is truncated, the TCP sequence numbers still account
+// for all the bytes, so the missing data is visible as a gap.
+//
+// To decrypt TLS and QUIC, save the TLS secrets using, e.g., the
+// netx.Dialer.SetKeyLogWriter method and configure Wireshark to read
+// them (Preferences > Protocols > TLS > (Pre)-Master-Secret log).
+package pcapng
+
+import (
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ooni/netx/modelx"
+)
+
+const (
+	blockTypeSHB = 0x0A0D0D0A
+	blockTypeIDB = 0x00000001
+	blockTypeEPB = 0x00000006
+
+	byteOrderMagic = 0x1A2B3C4D
+
+	linkTypeRaw = 101
+
+	protoTCP = 6
+	protoUDP = 17
+
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+
+	// maxSegmentSize is the maximum amount of data per packet, which
+	// must fit the 16 bit length fields of IPv4 and UDP.
+	maxSegmentSize = 1 << 15
+
+	// initialSeq is the initial TCP sequence number.
+	initialSeq = 1 << 10
+)
+
+// flow is a connection or a datagram socket we're tracking.
+type flow struct {
+	local     netip.AddrPort
+	remote    netip.AddrPort
+	tcp       bool
+	localSeq  uint32
+	remoteSeq uint32
+}
+
+// Handler is a modelx.Handler that writes a pcapng file.
+type Handler struct {
+	beginning time.Time
+	err       error
+	flows     map[int64]*flow
+	mu        sync.Mutex
+	w         io.Writer
+}
+
+// NewHandler creates a new Handler writing into w. The beginning
+// must be the Beginning of the MeasurementRoot, since we use it to
+// compute the timestamp of each packet. We write the pcapng header
+// immediately, and we return error if that fails.
+func NewHandler(w io.Writer, beginning time.Time) (*Handler, error) {
+	h := &Handler{
+		beginning: beginning,
+		flows:     make(map[int64]*flow),
+		w:         w,
+	}
+	h.writeHeader()
+	return h, h.err
+}
+
+// Err returns the first error that occurred when writing.
+func (h *Handler) Err() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err
+}
+
+// OnMeasurement handles a measurement event.
+func (h *Handler) OnMeasurement(m modelx.Measurement) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch {
+	case m.Connect != nil:
+		h.onConnect(m.Connect)
+	case m.ListenPacket != nil:
+		ev := m.ListenPacket
+		if ev.Error == nil {
+			h.flows[ev.ConnID] = &flow{local: parseAddrPort(ev.LocalAddress)}
+		}
+	case m.QUICHandshakeStart != nil:
+		ev := m.QUICHandshakeStart
+		h.flows[ev.ConnID] = &flow{
+			local:  parseAddrPort(ev.LocalAddress),
+			remote: parseAddrPort(ev.RemoteAddress),
+		}
+	case m.Read != nil:
+		ev := m.Read
+		if f := h.flows[ev.ConnID]; f != nil {
+			h.onData(ev.DurationSinceBeginning, f, false, ev.Data, ev.NumBytes)
+		}
+	case m.Write != nil:
+		ev := m.Write
+		if f := h.flows[ev.ConnID]; f != nil {
+			h.onData(ev.DurationSinceBeginning, f, true, ev.Data, ev.NumBytes)
+		}
+	case m.ReadFrom != nil:
+		ev := m.ReadFrom
+		if f := h.flows[ev.ConnID]; f != nil {
+			h.writeDatagram(ev.DurationSinceBeginning, f.local,
+				parseAddrPort(ev.RemoteAddress), false, ev.Data)
+		}
+	case m.WriteTo != nil:
+		ev := m.WriteTo
+		if f := h.flows[ev.ConnID]; f != nil {
+			h.writeDatagram(ev.DurationSinceBeginning, f.local,
+				parseAddrPort(ev.RemoteAddress), true, ev.Data)
+		}
+	case m.Close != nil:
+		h.onClose(m.Close)
+	}
+}
+
+func (h *Handler) onConnect(ev *modelx.ConnectEvent) {
+	if ev.Error != nil {
+		return
+	}
+	f := &flow{
+		local:     parseAddrPort(ev.LocalAddress),
+		remote:    parseAddrPort(ev.RemoteAddress),
+		tcp:       strings.HasPrefix(ev.Network, "tcp"),
+		localSeq:  initialSeq,
+		remoteSeq: initialSeq,
+	}
+	h.flows[ev.ConnID] = f
+	if !f.tcp {
+		return
+	}
+	// Synthesize the three way handshake
+	start := ev.DurationSinceBeginning - ev.SyscallDuration
+	h.writeSegment(start, f, true, tcpSYN, nil)
+	f.localSeq++
+	h.writeSegment(ev.DurationSinceBeginning, f, false, tcpSYN|tcpACK, nil)
+	f.remoteSeq++
+	h.writeSegment(ev.DurationSinceBeginning, f, true, tcpACK, nil)
+}
+
+func (h *Handler) onData(
+	elapsed time.Duration, f *flow, outgoing bool, data []byte, count int64,
+) {
+	if !f.tcp {
+		h.writeDatagram(elapsed, f.local, f.remote, outgoing, data)
+		return
+	}
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > maxSegmentSize {
+			chunk = chunk[:maxSegmentSize]
+		}
+		h.writeSegment(elapsed, f, outgoing, tcpPSH|tcpACK, chunk)
+		h.advance(f, outgoing, int64(len(chunk)))
+		data, count = data[len(chunk):], count-int64(len(chunk))
+	}
+	if count > 0 {
+		h.advance(f, outgoing, count) // bytes not included in the snap
+	}
+}
+
+func (h *Handler) advance(f *flow, outgoing bool, count int64) {
+	if outgoing {
+		f.localSeq += uint32(count)
+	} else {
+		f.remoteSeq += uint32(count)
+	}
+}
+
+func (h *Handler) onClose(ev *modelx.CloseEvent) {
+	f := h.flows[ev.ConnID]
+	if f == nil {
+		return
+	}
+	delete(h.flows, ev.ConnID)
+	if !f.tcp {
+		return
+	}
+	h.writeSegment(ev.DurationSinceBeginning, f, true, tcpFIN|tcpACK, nil)
+	f.localSeq++
+	h.writeSegment(ev.DurationSinceBeginning, f, false, tcpACK, nil)
+}
+
+func (h *Handler) writeSegment(
+	elapsed time.Duration, f *flow, outgoing bool, flags byte, data []byte,
+) {
+	src, dst, seq, ack := f.local, f.remote, f.localSeq, f.remoteSeq
+	if !outgoing {
+		src, dst, seq, ack = dst, src, ack, seq
+	}
+	if flags&tcpACK == 0 {
+		ack = 0
+	}
+	header := make([]byte, 20)
+	binary.BigEndian.PutUint16(header[0:], src.Port())
+	binary.BigEndian.PutUint16(header[2:], dst.Port())
+	binary.BigEndian.PutUint32(header[4:], seq)
+	binary.BigEndian.PutUint32(header[8:], ack)
+	header[12] = 5 << 4 // data offset
+	header[13] = flags
+	binary.BigEndian.PutUint16(header[14:], 0xffff) // window
+	h.writePacket(elapsed, src, dst, protoTCP, append(header, data...))
+}
+
+func (h *Handler) writeDatagram(
+	elapsed time.Duration, local, remote netip.AddrPort,
+	outgoing bool, data []byte,
+) {
+	if len(data) <= 0 || len(data) > maxSegmentSize {
+		return // we did not save the datagram
+	}
+	src, dst := local, remote
+	if !outgoing {
+		src, dst = dst, src
+	}
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint16(header[0:], src.Port())
+	binary.BigEndian.PutUint16(header[2:], dst.Port())
+	binary.BigEndian.PutUint16(header[4:], uint16(8+len(data)))
+	h.writePacket(elapsed, src, dst, protoUDP, append(header, data...))
+}
+
+// writePacket prepends the IP header to the payload, fills the
+// transport checksum, and writes the packet.
+func (h *Handler) writePacket(
+	elapsed time.Duration, src, dst netip.AddrPort, proto byte, payload []byte,
+) {
+	srcIP, dstIP := sameFamily(src.Addr(), dst.Addr())
+	checksumOffset := 16 // TCP
+	if proto == protoUDP {
+		checksumOffset = 6
+	}
+	var packet []byte
+	if srcIP.Is4() {
+		header := make([]byte, 20)
+		header[0] = 0x45 // version and header length
+		binary.BigEndian.PutUint16(header[2:], uint16(20+len(payload)))
+		binary.BigEndian.PutUint16(header[6:], 0x4000) // don't fragment
+		header[8] = 64                                 // TTL
+		header[9] = proto
+		src4, dst4 := srcIP.As4(), dstIP.As4()
+		copy(header[12:], src4[:])
+		copy(header[16:], dst4[:])
+		binary.BigEndian.PutUint16(header[10:], checksum(0, header))
+		pseudo := make([]byte, 12)
+		copy(pseudo[0:], src4[:])
+		copy(pseudo[4:], dst4[:])
+		pseudo[9] = proto
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(payload)))
+		putTransportChecksum(payload, checksumOffset, pseudo)
+		packet = append(header, payload...)
+	} else {
+		header := make([]byte, 40)
+		header[0] = 0x60 // version
+		binary.BigEndian.PutUint16(header[4:], uint16(len(payload)))
+		header[6] = proto
+		header[7] = 64 // hop limit
+		src16, dst16 := srcIP.As16(), dstIP.As16()
+		copy(header[8:], src16[:])
+		copy(header[24:], dst16[:])
+		pseudo := make([]byte, 40)
+		copy(pseudo[0:], src16[:])
+		copy(pseudo[16:], dst16[:])
+		binary.BigEndian.PutUint32(pseudo[32:], uint32(len(payload)))
+		pseudo[39] = proto
+		putTransportChecksum(payload, checksumOffset, pseudo)
+		packet = append(header, payload...)
+	}
+	h.writeEPB(h.beginning.Add(elapsed), packet)
+}
+
+func putTransportChecksum(payload []byte, offset int, pseudo []byte) {
+	sum := checksum(checksum(0, pseudo)^0xffff, payload)
+	if sum == 0 && offset == 6 {
+		sum = 0xffff // zero means no checksum for UDP
+	}
+	binary.BigEndian.PutUint16(payload[offset:], sum)
+}
+
+// checksum computes the internet checksum of data continuing
+// from the complemented checksum of previous data, if any.
+func checksum(initial uint16, data []byte) uint16 {
+	sum := uint32(initial)
+	for len(data) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(data))
+		data = data[2:]
+	}
+	if len(data) > 0 {
+		sum += uint32(data[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// sameFamily makes sure both addresses belong to the same family,
+// which may not be the case, e.g., for dual stack sockets bound
+// to the unspecified IPv6 address and sending to IPv4.
+func sameFamily(src, dst netip.Addr) (netip.Addr, netip.Addr) {
+	src, dst = src.Unmap(), dst.Unmap()
+	switch {
+	case !src.IsValid() && !dst.IsValid():
+		return netip.IPv4Unspecified(), netip.IPv4Unspecified()
+	case src.Is4() && !dst.Is4():
+		return src, unspecifiedLike(dst, src)
+	case !src.Is4() && dst.Is4():
+		return unspecifiedLike(src, dst), dst
+	}
+	return src, dst
+}
+
+func unspecifiedLike(addr, other netip.Addr) netip.Addr {
+	if other.Is4() {
+		return netip.IPv4Unspecified()
+	}
+	if addr.IsValid() {
+		return addr
+	}
+	return netip.IPv6Unspecified()
+}
+
+func parseAddrPort(s string) netip.AddrPort {
+	addrport, _ := netip.ParseAddrPort(s)
+	return addrport
+}
+
+func (h *Handler) writeHeader() {
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], byteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:], 1) // major version
+	binary.LittleEndian.PutUint16(shb[6:], 0) // minor version
+	binary.LittleEndian.PutUint64(shb[8:], 0xffffffffffffffff)
+	h.writeBlock(blockTypeSHB, shb)
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:], linkTypeRaw)
+	binary.LittleEndian.PutUint32(idb[4:], 0) // no snap length limit
+	h.writeBlock(blockTypeIDB, idb)
+}
+
+func (h *Handler) writeEPB(t time.Time, packet []byte) {
+	body := make([]byte, 20, 20+len(packet)+3)
+	micros := uint64(t.UnixNano() / 1000)      // default resolution
+	binary.LittleEndian.PutUint32(body[0:], 0) // interface ID
+	binary.LittleEndian.PutUint32(body[4:], uint32(micros>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(micros))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(packet)))
+	body = append(body, packet...)
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	h.writeBlock(blockTypeEPB, body)
+}
+
+func (h *Handler) writeBlock(blockType uint32, body []byte) {
+	if h.err != nil {
+		return
+	}
+	length := uint32(12 + len(body))
+	block := make([]byte, 8, length)
+	binary.LittleEndian.PutUint32(block[0:], blockType)
+	binary.LittleEndian.PutUint32(block[4:], length)
+	block = append(block, body...)
+	block = binary.LittleEndian.AppendUint32(block, length)
+	_, h.err = h.w.Write(block)
+}
@@ -0,0 +1,362 @@
+package pcapng
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ooni/netx/handlers"
+	"github.com/ooni/netx/httpx"
+	"github.com/ooni/netx/modelx"
+)
+
+type block struct {
+	blockType uint32
+	body      []byte
+}
+
+func parseBlocks(t *testing.T, data []byte) (blocks []block) {
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatal("truncated block")
+		}
+		blockType := binary.LittleEndian.Uint32(data[0:])
+		length := binary.LittleEndian.Uint32(data[4:])
+		if length%4 != 0 || int(length) > len(data) {
+			t.Fatal("invalid block length")
+		}
+		if binary.LittleEndian.Uint32(data[length-4:]) != length {
+			t.Fatal("trailing length mismatch")
+		}
+		blocks = append(blocks, block{
+			blockType: blockType,
+			body:      data[8 : length-4],
+		})
+		data = data[length:]
+	}
+	return
+}
+
+// packet is a parsed enhanced packet block
+type packet struct {
+	time    time.Time
+	version byte
+	proto   byte
+	src     netip.AddrPort
+	dst     netip.AddrPort
+	seq     uint32
+	flags   byte
+	data    []byte
+}
+
+func parsePacket(t *testing.T, body []byte) (p packet) {
+	micros := uint64(binary.LittleEndian.Uint32(body[4:]))<<32 |
+		uint64(binary.LittleEndian.Uint32(body[8:]))
+	p.time = time.Unix(0, int64(micros)*1000)
+	length := binary.LittleEndian.Uint32(body[12:])
+	raw := body[20 : 20+length]
+	p.version = raw[0] >> 4
+	var (
+		srcIP, dstIP netip.Addr
+		pseudo       []byte
+		payload      []byte
+	)
+	switch p.version {
+	case 4:
+		header := raw[:20]
+		if checksum(0, header) != 0 {
+			t.Fatal("invalid IPv4 checksum")
+		}
+		p.proto = header[9]
+		srcIP = netip.AddrFrom4([4]byte(header[12:16]))
+		dstIP = netip.AddrFrom4([4]byte(header[16:20]))
+		payload = raw[20:]
+		pseudo = make([]byte, 12)
+		copy(pseudo, header[12:20])
+		pseudo[9] = p.proto
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(payload)))
+	case 6:
+		header := raw[:40]
+		p.proto = header[6]
+		srcIP = netip.AddrFrom16([16]byte(header[8:24]))
+		dstIP = netip.AddrFrom16([16]byte(header[24:40]))
+		payload = raw[40:]
+		pseudo = make([]byte, 40)
+		copy(pseudo, header[8:40])
+		binary.BigEndian.PutUint32(pseudo[32:], uint32(len(payload)))
+		pseudo[39] = p.proto
+	default:
+		t.Fatal("unexpected IP version")
+	}
+	if checksum(checksum(0, pseudo)^0xffff, payload) != 0 {
+		t.Fatal("invalid transport checksum")
+	}
+	p.src = netip.AddrPortFrom(srcIP, binary.BigEndian.Uint16(payload[0:]))
+	p.dst = netip.AddrPortFrom(dstIP, binary.BigEndian.Uint16(payload[2:]))
+	switch p.proto {
+	case protoTCP:
+		p.seq = binary.BigEndian.Uint32(payload[4:])
+		p.flags = payload[13]
+		p.data = payload[20:]
+	case protoUDP:
+		p.data = payload[8:]
+	}
+	return
+}
+
+func newHandler(t *testing.T, buf *bytes.Buffer) (*Handler, time.Time) {
+	beginning := time.Now()
+	handler, err := NewHandler(buf, beginning)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handler, beginning
+}
+
+func packets(t *testing.T, data []byte) (out []packet) {
+	blocks := parseBlocks(t, data)
+	if len(blocks) < 2 {
+		t.Fatal("expected at least two blocks")
+	}
+	if blocks[0].blockType != blockTypeSHB {
+		t.Fatal("expected section header block")
+	}
+	if binary.LittleEndian.Uint32(blocks[0].body) != byteOrderMagic {
+		t.Fatal("invalid byte order magic")
+	}
+	if blocks[1].blockType != blockTypeIDB {
+		t.Fatal("expected interface description block")
+	}
+	if binary.LittleEndian.Uint16(blocks[1].body) != linkTypeRaw {
+		t.Fatal("unexpected link type")
+	}
+	for _, b := range blocks[2:] {
+		if b.blockType != blockTypeEPB {
+			t.Fatal("expected enhanced packet block")
+		}
+		out = append(out, parsePacket(t, b.body))
+	}
+	return
+}
+
+func TestUnitTCP(t *testing.T) {
+	buf := new(bytes.Buffer)
+	handler, beginning := newHandler(t, buf)
+	handler.OnMeasurement(modelx.Measurement{
+		Connect: &modelx.ConnectEvent{
+			ConnID:                 1,
+			DurationSinceBeginning: 20 * time.Millisecond,
+			LocalAddress:           "10.0.0.1:54321",
+			Network:                "tcp",
+			RemoteAddress:          "93.184.216.34:443",
+			SyscallDuration:        10 * time.Millisecond,
+		},
+	})
+	handler.OnMeasurement(modelx.Measurement{
+		Write: &modelx.WriteEvent{
+			ConnID:                 1,
+			Data:                   []byte("abc"),
+			DurationSinceBeginning: 30 * time.Millisecond,
+			NumBytes:               3,
+		},
+	})
+	handler.OnMeasurement(modelx.Measurement{
+		Read: &modelx.ReadEvent{
+			ConnID:                 1,
+			Data:                   []byte("de"), // truncated snap
+			DurationSinceBeginning: 40 * time.Millisecond,
+			NumBytes:               4,
+		},
+	})
+	handler.OnMeasurement(modelx.Measurement{
+		Read: &modelx.ReadEvent{
+			ConnID:                 1,
+			Data:                   []byte("h"),
+			DurationSinceBeginning: 50 * time.Millisecond,
+			NumBytes:               1,
+		},
+	})
+	handler.OnMeasurement(modelx.Measurement{
+		Close: &modelx.CloseEvent{
+			ConnID:                 1,
+			DurationSinceBeginning: 60 * time.Millisecond,
+		},
+	})
+	handler.OnMeasurement(modelx.Measurement{
+		Write: &modelx.WriteEvent{ // after close: ignored
+			ConnID: 1, Data: []byte("x"), NumBytes: 1,
+		},
+	})
+	if err := handler.Err(); err != nil {
+		t.Fatal(err)
+	}
+	pkts := packets(t, buf.Bytes())
+	expectFlags := []byte{
+		tcpSYN, tcpSYN | tcpACK, tcpACK, tcpPSH | tcpACK, tcpPSH | tcpACK,
+		tcpPSH | tcpACK, tcpFIN | tcpACK, tcpACK,
+	}
+	if len(pkts) != len(expectFlags) {
+		t.Fatalf("expected %d packets, got %d", len(expectFlags), len(pkts))
+	}
+	local := netip.MustParseAddrPort("10.0.0.1:54321")
+	for idx, p := range pkts {
+		if p.version != 4 || p.proto != protoTCP {
+			t.Fatal("unexpected packet type")
+		}
+		if p.flags != expectFlags[idx] {
+			t.Fatalf("packet %d: unexpected flags %x", idx, p.flags)
+		}
+		if (p.src == local) != (idx != 1 && idx != 4 && idx != 5 && idx != 7) {
+			t.Fatalf("packet %d: unexpected direction", idx)
+		}
+	}
+	if !pkts[0].time.Equal(beginning.Add(10 * time.Millisecond).Truncate(time.Microsecond)) {
+		t.Fatal("unexpected SYN time")
+	}
+	if string(pkts[3].data) != "abc" || pkts[3].seq != initialSeq+1 {
+		t.Fatal("unexpected first data segment")
+	}
+	if string(pkts[4].data) != "de" || pkts[4].seq != initialSeq+1 {
+		t.Fatal("unexpected second data segment")
+	}
+	if string(pkts[5].data) != "h" || pkts[5].seq != initialSeq+1+4 {
+		t.Fatal("truncated data not accounted in sequence numbers")
+	}
+	if pkts[6].seq != initialSeq+1+3 {
+		t.Fatal("unexpected FIN sequence number")
+	}
+}
+
+func TestUnitUDPAndQUIC(t *testing.T) {
+	buf := new(bytes.Buffer)
+	handler, _ := newHandler(t, buf)
+	handler.OnMeasurement(modelx.Measurement{
+		ListenPacket: &modelx.ListenPacketEvent{
+			ConnID:       1,
+			LocalAddress: "[::]:5353",
+			Network:      "udp",
+		},
+	})
+	handler.OnMeasurement(modelx.Measurement{
+		WriteTo: &modelx.WriteToEvent{
+			ConnID:        1,
+			Data:          []byte("query"),
+			NumBytes:      5,
+			RemoteAddress: "8.8.8.8:53",
+		},
+	})
+	handler.OnMeasurement(modelx.Measurement{
+		ReadFrom: &modelx.ReadFromEvent{
+			ConnID:        1,
+			Data:          []byte("reply"),
+			NumBytes:      5,
+			RemoteAddress: "8.8.8.8:53",
+		},
+	})
+	handler.OnMeasurement(modelx.Measurement{
+		QUICHandshakeStart: &modelx.QUICHandshakeStartEvent{
+			ConnID:        2,
+			LocalAddress:  "[2001:db8::1]:1234",
+			RemoteAddress: "[2001:db8::2]:443",
+		},
+	})
+	handler.OnMeasurement(modelx.Measurement{
+		WriteTo: &modelx.WriteToEvent{
+			ConnID:        2,
+			Data:          []byte("initial"),
+			NumBytes:      7,
+			RemoteAddress: "[2001:db8::2]:443",
+		},
+	})
+	handler.OnMeasurement(modelx.Measurement{
+		WriteTo: &modelx.WriteToEvent{ // no data: skipped
+			ConnID:        2,
+			NumBytes:      7,
+			RemoteAddress: "[2001:db8::2]:443",
+		},
+	})
+	pkts := packets(t, buf.Bytes())
+	if len(pkts) != 3 {
+		t.Fatal("unexpected number of packets")
+	}
+	if pkts[0].version != 4 || pkts[0].proto != protoUDP {
+		t.Fatal("expected the dual stack socket to be mapped to IPv4")
+	}
+	if pkts[0].dst.String() != "8.8.8.8:53" || string(pkts[0].data) != "query" {
+		t.Fatal("unexpected query packet")
+	}
+	if pkts[1].src.String() != "8.8.8.8:53" || string(pkts[1].data) != "reply" {
+		t.Fatal("unexpected reply packet")
+	}
+	if pkts[2].version != 6 || pkts[2].src.String() != "[2001:db8::1]:1234" {
+		t.Fatal("unexpected QUIC packet")
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("mocked error")
+}
+
+func TestUnitWriteFailure(t *testing.T) {
+	handler, err := NewHandler(failingWriter{}, time.Now())
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if handler.Err() != err {
+		t.Fatal("expected to see the same error")
+	}
+}
+
+func TestIntegrationHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hello, world"))
+		},
+	))
+	defer server.Close()
+	buf := new(bytes.Buffer)
+	handler, beginning := newHandler(t, buf)
+	client := httpx.NewClientWithoutProxy(handlers.NoHandler)
+	ctx := modelx.WithMeasurementRoot(context.Background(), &modelx.MeasurementRoot{
+		Beginning:       beginning,
+		Handler:         handler,
+		MaxConnSnapSize: -1,
+	})
+	req, err := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.HTTPClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	client.Transport.CloseIdleConnections()
+	var sent, received []byte
+	for _, p := range packets(t, buf.Bytes()) {
+		if p.dst.String() == server.Listener.Addr().String() {
+			sent = append(sent, p.data...)
+		} else {
+			received = append(received, p.data...)
+		}
+	}
+	if !strings.HasPrefix(string(sent), "GET / HTTP/1.1\r\n") {
+		t.Fatal("unexpected request bytes")
+	}
+	if !strings.HasSuffix(string(received), "hello, world") {
+		t.Fatal("unexpected response bytes")
+	}
+}
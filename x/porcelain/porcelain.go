@@ -5,6 +5,7 @@
 package porcelain
 
 import (
+	"bytes"
 	"context"
 	"io"
 	"io/ioutil"
@@ -49,10 +50,11 @@ func (h *channelHandler) OnMeasurement(m modelx.Measurement) {
 // can be improved by emitting estimates when we know that we are
 // using the system resolver, so we can pick up estimates here.
 type Results struct {
-	Connects      []*modelx.ConnectEvent
-	HTTPRequests  []*modelx.HTTPRoundTripDoneEvent
-	Resolves      []*modelx.ResolveDoneEvent
-	TLSHandshakes []*modelx.TLSHandshakeDoneEvent
+	Connects       []*modelx.ConnectEvent
+	HTTPRequests   []*modelx.HTTPRoundTripDoneEvent
+	QUICHandshakes []*modelx.QUICHandshakeDoneEvent
+	Resolves       []*modelx.ResolveDoneEvent
+	TLSHandshakes  []*modelx.TLSHandshakeDoneEvent
 
 	SentBytes     int64
 	ReceivedBytes int64
@@ -65,6 +67,9 @@ func (r *Results) onMeasurement(m modelx.Measurement) {
 	if m.HTTPRoundTripDone != nil {
 		r.HTTPRequests = append(r.HTTPRequests, m.HTTPRoundTripDone)
 	}
+	if m.QUICHandshakeDone != nil {
+		r.QUICHandshakes = append(r.QUICHandshakes, m.QUICHandshakeDone)
+	}
 	if m.ResolveDone != nil {
 		r.Resolves = append(r.Resolves, m.ResolveDone)
 	}
@@ -77,6 +82,12 @@ func (r *Results) onMeasurement(m modelx.Measurement) {
 	if m.Write != nil {
 		r.SentBytes += m.Write.NumBytes // overflow unlikely
 	}
+	if m.ReadFrom != nil {
+		r.ReceivedBytes += m.ReadFrom.NumBytes // overflow unlikely
+	}
+	if m.WriteTo != nil {
+		r.SentBytes += m.WriteTo.NumBytes // overflow unlikely
+	}
 }
 
 func (r *Results) collect(
@@ -213,6 +224,7 @@ type HTTPDoConfig struct {
 	Accept             string
 	AcceptLanguage     string
 	Body               []byte
+	ContentType        string
 	DNSServerAddress   string
 	DNSServerNetwork   string
 	Handler            modelx.Handler
@@ -222,6 +234,12 @@ type HTTPDoConfig struct {
 	URL                string
 	UserAgent          string
 
+	// Headers contains extra request headers. They are added after
+	// the headers configured using the above fields, so they replace
+	// them when they have the same name. A Host header, if present,
+	// overrides the host of the URL in the request.
+	Headers http.Header
+
 	// MaxEventsBodySnapSize controls the snap size that
 	// we're using for bodies returned as modelx.Measurement.
 	//
@@ -233,6 +251,24 @@ type HTTPDoConfig struct {
 	//
 	// Same rules as modelx.MeasurementRoot.MaxBodySnapSize.
 	MaxResponseBodySnapSize int64
+
+	// CookieJar is the optional cookie jar to use. You can use the
+	// same jar for several HTTPDo calls, to share cookies among them.
+	//
+	// Same rules as httpx.Client.SetCookieJar.
+	CookieJar http.CookieJar
+
+	// Beginning is the "zero" time of the events emitted by HTTPDo,
+	// which is useful to correlate them with other measurements, e.g.,
+	// when using x/har. When it is zero, we use the current time.
+	Beginning time.Time
+
+	// MaxRedirects is the maximum number of redirects to follow. Zero
+	// means using the net/http default, i.e., ten redirects. A negative
+	// value means that we don't follow redirects.
+	//
+	// Same rules as httpx.Client.SetMaxRedirects.
+	MaxRedirects int
 }
 
 // HTTPDoResults contains the results of a HTTPDo
@@ -242,6 +278,61 @@ type HTTPDoResults struct {
 	Headers    http.Header
 	BodySnap   []byte
 	Error      error
+
+	// RedirectChain contains a hop for each round trip performed
+	// following redirects, starting from the original request.
+	RedirectChain []RedirectHop
+}
+
+// RedirectHop is a hop of a redirect chain. Each hop is a
+// separate HTTP transaction.
+type RedirectHop struct {
+	Error               error
+	Location            string
+	Method              string
+	ParentTransactionID int64
+	SetCookies          []string
+	StatusCode          int64
+	TransactionID       int64
+	URL                 string
+}
+
+// newRedirectChain reconstructs the redirect chain starting with
+// the request with the specified method and URL using the events
+// in requests. We identify the original request as the first one
+// not caused by a redirect with the same method and URL.
+func newRedirectChain(
+	requests []*modelx.HTTPRoundTripDoneEvent, method, URL string,
+) (chain []RedirectHop) {
+	var current *modelx.HTTPRoundTripDoneEvent
+	for _, ev := range requests {
+		if ev.ParentTransactionID == 0 && ev.RequestMethod == method &&
+			ev.RequestURL == URL {
+			current = ev
+			break
+		}
+	}
+	for current != nil {
+		chain = append(chain, RedirectHop{
+			Error:               current.Error,
+			Location:            current.ResponseHeaders.Get("Location"),
+			Method:              current.RequestMethod,
+			ParentTransactionID: current.ParentTransactionID,
+			SetCookies:          current.ResponseHeaders.Values("Set-Cookie"),
+			StatusCode:          current.ResponseStatusCode,
+			TransactionID:       current.TransactionID,
+			URL:                 current.RequestURL,
+		})
+		parent := current
+		current = nil
+		for _, ev := range requests {
+			if ev.ParentTransactionID == parent.TransactionID {
+				current = ev
+				break
+			}
+		}
+	}
+	return
 }
 
 // HTTPDo performs a HTTP request
@@ -253,9 +344,13 @@ func HTTPDo(
 		results = new(HTTPDoResults)
 	)
 	channel := make(chan modelx.Measurement)
+	beginning := config.Beginning
+	if beginning.IsZero() {
+		beginning = time.Now()
+	}
 	// TODO(bassosimone): tell client to use specific CA bundle?
 	root := &modelx.MeasurementRoot{
-		Beginning: time.Now(),
+		Beginning: beginning,
 		Handler: &channelHandler{
 			ch: channel,
 		},
@@ -276,8 +371,17 @@ func HTTPDo(
 	if config.InsecureSkipVerify {
 		client.ForceSkipVerify()
 	}
-	// TODO(bassosimone): implement sending body
-	req, err := http.NewRequest(config.Method, config.URL, nil)
+	client.SetCookieJar(config.CookieJar)
+	if config.MaxRedirects != 0 {
+		client.SetMaxRedirects(config.MaxRedirects)
+	}
+	var body io.Reader
+	if config.Body != nil {
+		// Using a bytes.Reader allows net/http to send the body
+		// again when following 307 and 308 redirects.
+		body = bytes.NewReader(config.Body)
+	}
+	req, err := http.NewRequest(config.Method, config.URL, body)
 	if err != nil {
 		results.Error = err
 		return results
@@ -288,7 +392,21 @@ func HTTPDo(
 	if config.AcceptLanguage != "" {
 		req.Header.Set("Accept-Language", config.AcceptLanguage)
 	}
+	if config.ContentType != "" {
+		req.Header.Set("Content-Type", config.ContentType)
+	}
 	req.Header.Set("User-Agent", config.UserAgent)
+	for key := range config.Headers {
+		req.Header.Del(key)
+	}
+	for key, values := range config.Headers {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host // net/http ignores the Host header
+	}
 	req = req.WithContext(ctx)
 	results.TestKeys.collect(channel, config.Handler, func() {
 		defer client.HTTPClient.CloseIdleConnections()
@@ -314,6 +432,8 @@ func HTTPDo(
 		results.BodySnap, results.Error = data, err
 		mu.Unlock()
 	})
+	results.RedirectChain = newRedirectChain(
+		results.TestKeys.HTTPRequests, req.Method, req.URL.String())
 	return results
 }
 
@@ -373,3 +493,60 @@ func TLSConnect(
 	})
 	return results
 }
+
+// QUICConnectConfig contains QUICConnect settings.
+type QUICConnectConfig struct {
+	ALPN             []string // default: []string{"h3"}
+	Address          string
+	DNSServerAddress string
+	DNSServerNetwork string
+	Handler          modelx.Handler
+	SNI              string
+}
+
+// QUICConnectResults contains the results of a QUICConnect
+type QUICConnectResults struct {
+	TestKeys Results
+	Error    error
+}
+
+// QUICConnect performs a QUIC handshake.
+func QUICConnect(
+	ctx context.Context, config QUICConnectConfig,
+) *QUICConnectResults {
+	var (
+		mu      sync.Mutex
+		results = new(QUICConnectResults)
+	)
+	channel := make(chan modelx.Measurement)
+	root := &modelx.MeasurementRoot{
+		Beginning: time.Now(),
+		Handler: &channelHandler{
+			ch: channel,
+		},
+	}
+	ctx = modelx.WithMeasurementRoot(ctx, root)
+	dialer := netx.NewDialer(handlers.NoHandler)
+	resolver, err := configureDNS(
+		time.Now().UnixNano(),
+		config.DNSServerNetwork,
+		config.DNSServerAddress,
+	)
+	if err != nil {
+		results.Error = err
+		return results
+	}
+	dialer.SetResolver(resolver)
+	dialer.ForceSpecificSNI(config.SNI)
+	dialer.SetALPN(config.ALPN)
+	results.TestKeys.collect(channel, config.Handler, func() {
+		conn, err := dialer.DialQUICContext(ctx, config.Address)
+		if conn != nil {
+			defer conn.CloseWithError(0, "")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		results.Error = err
+	})
+	return results
+}
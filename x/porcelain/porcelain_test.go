@@ -2,12 +2,18 @@ package porcelain
 
 import (
 	"context"
+	"errors"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/ooni/netx/httpx"
 	"github.com/ooni/netx/modelx"
+	"github.com/quic-go/quic-go"
 )
 
 func TestUnitChannelHandlerWriteLateOnChannel(t *testing.T) {
@@ -217,3 +223,209 @@ func TestIntegrationBodySnapSizes(t *testing.T) {
 		}
 	}
 }
+
+func TestQUICConnectUnknownAuthority(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {},
+	))
+	defer server.Close()
+	config := server.TLS.Clone()
+	config.NextProtos = []string{"antani"}
+	listener, err := quic.ListenAddr("127.0.0.1:0", config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	results := QUICConnect(context.Background(), QUICConnectConfig{
+		ALPN:    []string{"antani"},
+		Address: listener.Addr().String(),
+		SNI:     "example.com",
+	})
+	if results.Error == nil || results.Error.Error() != "ssl_unknown_authority" {
+		t.Fatal("not the error we expected", results.Error)
+	}
+	if len(results.TestKeys.QUICHandshakes) != 1 {
+		t.Fatal("unexpected number of QUIC handshakes")
+	}
+	if results.TestKeys.QUICHandshakes[0].Error == nil {
+		t.Fatal("expected an error in the QUIC handshake event")
+	}
+	if results.TestKeys.SentBytes <= 0 || results.TestKeys.ReceivedBytes <= 0 {
+		t.Fatal("expected to count datagram bytes")
+	}
+}
+
+func newRedirectServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/":
+				http.SetCookie(w, &http.Cookie{Name: "a", Value: "b"})
+				http.Redirect(w, r, "/first", http.StatusFound)
+			case "/first":
+				http.Redirect(w, r, "/second", http.StatusMovedPermanently)
+			default:
+				w.Write([]byte("done"))
+			}
+		},
+	))
+}
+
+func TestHTTPDoRedirectChain(t *testing.T) {
+	server := newRedirectServer()
+	defer server.Close()
+	results := HTTPDo(context.Background(), HTTPDoConfig{
+		Method: "GET",
+		URL:    server.URL,
+	})
+	if results.Error != nil {
+		t.Fatal(results.Error)
+	}
+	chain := results.RedirectChain
+	if len(chain) != 3 {
+		t.Fatal("unexpected redirect chain length", len(chain))
+	}
+	if chain[0].URL != server.URL || chain[0].StatusCode != 302 ||
+		chain[0].Location != "/first" || chain[0].ParentTransactionID != 0 {
+		t.Fatal("unexpected first hop")
+	}
+	if len(chain[0].SetCookies) != 1 || chain[0].SetCookies[0] != "a=b" {
+		t.Fatal("unexpected cookies")
+	}
+	if chain[1].StatusCode != 301 || chain[1].Location != "/second" ||
+		chain[1].ParentTransactionID != chain[0].TransactionID {
+		t.Fatal("unexpected second hop")
+	}
+	if chain[2].StatusCode != 200 || chain[2].Location != "" ||
+		chain[2].ParentTransactionID != chain[1].TransactionID ||
+		chain[2].URL != server.URL+"/second" {
+		t.Fatal("unexpected last hop")
+	}
+}
+
+func TestHTTPDoMaxRedirects(t *testing.T) {
+	server := newRedirectServer()
+	defer server.Close()
+	results := HTTPDo(context.Background(), HTTPDoConfig{
+		MaxRedirects: 1,
+		Method:       "GET",
+		URL:          server.URL,
+	})
+	if !errors.Is(results.Error, httpx.ErrTooManyRedirects) {
+		t.Fatal("not the error we expected", results.Error)
+	}
+	if len(results.RedirectChain) != 2 {
+		t.Fatal("unexpected redirect chain length")
+	}
+	results = HTTPDo(context.Background(), HTTPDoConfig{
+		MaxRedirects: -1,
+		Method:       "GET",
+		URL:          server.URL,
+	})
+	if results.Error != nil {
+		t.Fatal(results.Error)
+	}
+	if results.StatusCode != 302 || len(results.RedirectChain) != 1 {
+		t.Fatal("expected to stop at the first redirect")
+	}
+}
+
+func TestHTTPDoBeginning(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {},
+	))
+	defer server.Close()
+	results := HTTPDo(context.Background(), HTTPDoConfig{
+		Beginning: time.Now().Add(-time.Hour),
+		Method:    "GET",
+		URL:       server.URL,
+	})
+	if results.Error != nil {
+		t.Fatal(results.Error)
+	}
+	if len(results.TestKeys.HTTPRequests) != 1 {
+		t.Fatal("unexpected number of requests")
+	}
+	if results.TestKeys.HTTPRequests[0].DurationSinceBeginning < time.Hour {
+		t.Fatal("the configured beginning has not been used")
+	}
+}
+
+func TestHTTPDoWithBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" || r.Host != "example.com" {
+				w.WriteHeader(400)
+				return
+			}
+			if r.Header.Get("Content-Type") != "application/x-www-form-urlencoded" {
+				w.WriteHeader(400)
+				return
+			}
+			if r.Header.Get("User-Agent") != "antani/1.0" ||
+				r.Header.Get("X-Custom") != "foo" {
+				w.WriteHeader(400)
+				return
+			}
+			if err := r.ParseForm(); err != nil || r.PostForm.Get("q") != "netx" {
+				w.WriteHeader(400)
+				return
+			}
+			w.Write([]byte("ok"))
+		},
+	))
+	defer server.Close()
+	results := HTTPDo(context.Background(), HTTPDoConfig{
+		Body:        []byte("q=netx"),
+		ContentType: "application/x-www-form-urlencoded",
+		Headers: http.Header{
+			"Host":       {"example.com"},
+			"User-Agent": {"antani/1.0"},
+			"X-Custom":   {"foo"},
+		},
+		Method:    "POST",
+		URL:       server.URL,
+		UserAgent: "miniooni/0.1",
+	})
+	if results.Error != nil {
+		t.Fatal(results.Error)
+	}
+	if results.StatusCode != 200 {
+		t.Fatal("the server did not like our request")
+	}
+	if len(results.TestKeys.HTTPRequests) != 1 {
+		t.Fatal("unexpected number of requests")
+	}
+	if string(results.TestKeys.HTTPRequests[0].RequestBodySnap) != "q=netx" {
+		t.Fatal("the request body has not been saved")
+	}
+}
+
+func TestHTTPDoCookieJar(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if _, err := r.Cookie("seen"); err != nil {
+				http.SetCookie(w, &http.Cookie{Name: "seen", Value: "1"})
+				w.WriteHeader(401)
+			}
+		},
+	))
+	defer server.Close()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []int64{401, 200} {
+		results := HTTPDo(context.Background(), HTTPDoConfig{
+			CookieJar: jar,
+			Method:    "GET",
+			URL:       server.URL,
+		})
+		if results.Error != nil {
+			t.Fatal(results.Error)
+		}
+		if results.StatusCode != expect {
+			t.Fatal("unexpected status code", results.StatusCode)
+		}
+	}
+}